@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Alert states
+const (
+	alertLow   = "low"
+	alertHigh  = "high"
+	alertClear = "clear"
+)
+
+// Temperature must recover this far past a threshold before an alert clears.
+// This keeps a sensor sitting right at the threshold from flapping.
+const alertHysteresisF = 1.0
+
+// Temperature alert thresholds for one node from the "thresholds" section of
+// config.json. These are pointers so that unset and 0°F are different.
+type Threshold struct {
+	LowF  *float64 `json:"low_f"`
+	HighF *float64 `json:"high_f"`
+}
+
+// One temperature alert state change for a node
+type Alert struct {
+	Timestamp time.Time
+	Node      string
+	State     string  // "low", "high", or "clear"
+	TempF     float64 // Temperature that triggered the state change
+	LimitF    float64 // Threshold that was crossed
+}
+
+// Describe the alert in words
+func (a Alert) Message() string {
+	name := nodeName(a.Node)
+	if name == "" {
+		name = "Node " + a.Node
+	}
+	switch a.State {
+	case alertLow:
+		return fmt.Sprintf("%s is %.0f°F, below %.0f°F", name, a.TempF,
+			a.LimitF)
+	case alertHigh:
+		return fmt.Sprintf("%s is %.0f°F, above %.0f°F", name, a.TempF,
+			a.LimitF)
+	default:
+		return fmt.Sprintf("%s is back to %.0f°F", name, a.TempF)
+	}
+}
+
+// Tracks alert state of each node so alerts only fire on state changes
+type AlertTracker struct {
+	state map[string]string // Current alert state by node ID
+}
+
+// Check a report against its node's thresholds. Returns ok=true if the
+// node's alert state changed.
+func (t *AlertTracker) Check(d SensorData,
+	thresholds map[string]Threshold) (alert Alert, ok bool) {
+
+	if t.state == nil {
+		t.state = make(map[string]string)
+	}
+	th, exists := thresholds[d.Node]
+	if !exists {
+		return Alert{}, false
+	}
+	prev := t.state[d.Node]
+	if prev == "" {
+		prev = alertClear
+	}
+
+	// Work out the new state, using hysteresis for leaving alert states
+	next := prev
+	limit := 0.0
+	switch {
+	case th.LowF != nil && d.TempF < *th.LowF:
+		next, limit = alertLow, *th.LowF
+	case th.HighF != nil && d.TempF > *th.HighF:
+		next, limit = alertHigh, *th.HighF
+	case prev == alertLow && th.LowF == nil:
+		next = alertClear
+	case prev == alertLow && d.TempF >= *th.LowF+alertHysteresisF:
+		next, limit = alertClear, *th.LowF
+	case prev == alertHigh && th.HighF == nil:
+		next = alertClear
+	case prev == alertHigh && d.TempF <= *th.HighF-alertHysteresisF:
+		next, limit = alertClear, *th.HighF
+	}
+	if next == prev {
+		return Alert{}, false
+	}
+	t.state[d.Node] = next
+	return Alert{
+		Timestamp: d.Timestamp,
+		Node:      d.Node,
+		State:     next,
+		TempF:     d.TempF,
+		LimitF:    limit,
+	}, true
+}
@@ -0,0 +1,304 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Reports get handed from the serial input to the outputs (CSV logger,
+// databases, chart, IRC bots, ...) through queues, one per output, so a slow
+// output can only fall behind on its own. For example, an IRC bot waiting to
+// reconnect must not hold up the CSV logger. When a queue is full, its
+// overflow policy decides what to do with a new event:
+//
+//	drop-oldest  Drop the oldest queued event to make room
+//	coalesce     Replace whatever is queued, keeping only the newest event
+//	block        Make the publisher wait for room. This holds up the serial
+//	             input and every other output, so use it with care.
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowCoalesce   = "coalesce"
+	overflowBlock      = "block"
+)
+
+// Default queue sizes by output name (these are the names used by the queues
+// config setting)
+var defaultQueueSizes = map[string]int{
+	"logger":   1024,
+	"sqlite":   256,
+	"store":    256,
+	"mqtt":     256,
+	"influxdb": 256,
+	"graphite": 256,
+	"webhooks": 256,
+	"chart":    1,
+	"irc":      32,
+}
+
+// Queue settings for one output
+type QueueConfig struct {
+	Size   int    `json:"size"`   // Maximum queued events (0 means default)
+	Policy string `json:"policy"` // Overflow policy ("" means default)
+}
+
+// Check queue settings
+func (q *QueueConfig) Prepare() error {
+	switch q.Policy {
+	case "", overflowDropOldest, overflowCoalesce, overflowBlock:
+	default:
+		return fmt.Errorf("unknown overflow policy %q", q.Policy)
+	}
+	if q.Size < 0 {
+		return fmt.Errorf("size must not be negative")
+	}
+	return nil
+}
+
+// Get queue settings for the named output from the queues config setting,
+// falling back to the default size and the given default policy
+func queueConfig(name string, policy string) QueueConfig {
+	q := QueueConfig{Size: defaultQueueSizes[name], Policy: policy}
+	if c, ok := cfg.Queues[name]; ok {
+		if c.Size > 0 {
+			q.Size = c.Size
+		}
+		if c.Policy != "" {
+			q.Policy = c.Policy
+		}
+	}
+	return q
+}
+
+// Queue status, shared with the web server
+type QueueStats struct {
+	Name    string `json:"name"`
+	Policy  string `json:"policy"`
+	Size    int    `json:"size"`
+	Queued  int    `json:"queued"`  // Events waiting for the output
+	Dropped uint64 `json:"dropped"` // Events dropped or coalesced away
+}
+
+// Running queues, for the web server's /health page
+var eventQueues = struct {
+	mu     sync.Mutex
+	queues map[queueStatser]bool
+}{queues: make(map[queueStatser]bool)}
+
+type queueStatser interface {
+	Stats() QueueStats
+}
+
+// Get the status of all running queues, sorted by name
+func EventQueueStats() []QueueStats {
+	eventQueues.mu.Lock()
+	stats := []QueueStats{}
+	for q := range eventQueues.queues {
+		stats = append(stats, q.Stats())
+	}
+	eventQueues.mu.Unlock()
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// Queue of events for one output. Push adds events according to the overflow
+// policy, and a goroutine delivers them in order on the channel from Out.
+type EventQueue[T any] struct {
+	name   string
+	policy string
+	size   int
+	onDrop func(n int) // Optional callback to count dropped events
+
+	mu      sync.Mutex
+	cond    *sync.Cond // Signaled when events get added or removed
+	pending []T
+	closed  bool
+	warned  bool // Has a full queue been logged since it was last empty?
+	dropped uint64
+	out     chan T
+	stop    chan struct{} // Closed by Discard
+}
+
+// Make a queue and start delivering its events. Sizes below 1 mean 1, and
+// coalesce queues always hold one event.
+func NewEventQueue[T any](name string, c QueueConfig) *EventQueue[T] {
+	q := &EventQueue[T]{
+		name:   name,
+		policy: c.Policy,
+		size:   max(c.Size, 1),
+		out:    make(chan T),
+		stop:   make(chan struct{}),
+	}
+	switch q.policy {
+	case "":
+		q.policy = overflowDropOldest
+	case overflowCoalesce:
+		q.size = 1
+	}
+	q.cond = sync.NewCond(&q.mu)
+	eventQueues.mu.Lock()
+	eventQueues.queues[q] = true
+	eventQueues.mu.Unlock()
+	go q.deliver()
+	return q
+}
+
+// Channel for receiving events. It gets closed after Close once all queued
+// events have been delivered.
+func (q *EventQueue[T]) Out() <-chan T {
+	return q.out
+}
+
+// Add an event to the queue, applying the overflow policy if it is full
+func (q *EventQueue[T]) Push(v T) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.policy == overflowBlock {
+		for len(q.pending) >= q.size && !q.closed {
+			q.cond.Wait()
+		}
+	}
+	if q.closed {
+		return
+	}
+	n := 0
+	switch {
+	case q.policy == overflowCoalesce:
+		n = len(q.pending)
+		q.pending = q.pending[:0]
+	case len(q.pending) >= q.size:
+		n = len(q.pending) - q.size + 1
+		q.pending = q.pending[n:]
+		if !q.warned {
+			log.Printf("WARN: %s queue is full; dropping oldest events",
+				q.name)
+			q.warned = true
+		}
+	}
+	if n > 0 {
+		q.dropped += uint64(n)
+		if q.onDrop != nil {
+			q.onDrop(n)
+		}
+	}
+	q.pending = append(q.pending, v)
+	q.cond.Broadcast()
+}
+
+// Stop taking events. Events already queued still get delivered, then the
+// Out channel gets closed.
+func (q *EventQueue[T]) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// Stop taking events and throw away any that are queued, for when the output
+// has stopped reading. The Out channel does not get closed.
+func (q *EventQueue[T]) Discard() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		q.pending = nil
+		close(q.stop)
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// Get the status of the queue
+func (q *EventQueue[T]) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Name:    q.name,
+		Policy:  q.policy,
+		Size:    q.size,
+		Queued:  len(q.pending),
+		Dropped: q.dropped,
+	}
+}
+
+// Deliver queued events to the Out channel until the queue is closed and
+// empty, or discarded
+func (q *EventQueue[T]) deliver() {
+	defer func() {
+		eventQueues.mu.Lock()
+		delete(eventQueues.queues, q)
+		eventQueues.mu.Unlock()
+	}()
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.warned = false
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			// Closed and everything has been delivered (or discarded)
+			select {
+			case <-q.stop:
+			default:
+				close(q.out)
+			}
+			q.mu.Unlock()
+			return
+		}
+		v := q.pending[0]
+		q.pending = q.pending[1:]
+		q.cond.Broadcast() // Wake a blocked Push
+		q.mu.Unlock()
+
+		select {
+		case q.out <- v:
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Publish/subscribe bus that copies each event to the queues of all its
+// subscribers
+type EventBus[T any] struct {
+	mu   sync.Mutex
+	subs []*EventQueue[T]
+}
+
+// Subscribe an output to the bus, returning the channel it should read
+func (b *EventBus[T]) Subscribe(name string, c QueueConfig) <-chan T {
+	return b.SubscribeQueue(NewEventQueue[T](name, c))
+}
+
+// Subscribe a queue made by the caller (e.g. with an onDrop callback)
+func (b *EventBus[T]) SubscribeQueue(q *EventQueue[T]) <-chan T {
+	b.mu.Lock()
+	b.subs = append(b.subs, q)
+	b.mu.Unlock()
+	return q.Out()
+}
+
+// Send an event to every subscriber. This only waits if a subscriber with
+// the block policy is full.
+func (b *EventBus[T]) Publish(v T) {
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+	for _, q := range subs {
+		q.Push(v)
+	}
+}
+
+// Close all subscriber queues. Subscribers get the events already queued,
+// then their channel gets closed.
+func (b *EventBus[T]) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.subs {
+		q.Close()
+	}
+}
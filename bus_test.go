@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Close a queue and collect everything it still delivers
+func drainQueue[T any](q *EventQueue[T]) []T {
+	q.Close()
+	got := []T{}
+	for v := range q.Out() {
+		got = append(got, v)
+	}
+	return got
+}
+
+func TestEventQueuePolicies(t *testing.T) {
+	// Nobody reads until the end, so at most one event is in flight to the
+	// reader and the queue keeps the newest `size` of the rest
+	q := NewEventQueue[int]("test", QueueConfig{Size: 3})
+	for i := range 10 {
+		q.Push(i)
+	}
+	got := drainQueue(q)
+	if n := len(got); n < 3 || n > 4 || !slices.Equal(got[n-3:],
+		[]int{7, 8, 9}) {
+		t.Errorf("drop-oldest: got %v, want [7 8 9] plus maybe one more", got)
+	}
+	if st := q.Stats(); st.Dropped != uint64(10-len(got)) {
+		t.Errorf("drop-oldest: dropped %d, delivered %d", st.Dropped,
+			len(got))
+	}
+
+	q = NewEventQueue[int]("test", QueueConfig{Policy: overflowCoalesce})
+	for i := range 10 {
+		q.Push(i)
+	}
+	if got := drainQueue(q); got[len(got)-1] != 9 || len(got) > 2 {
+		t.Errorf("coalesce: got %v, want [9] plus maybe one more", got)
+	}
+
+	// Block loses nothing, holding up the publisher instead
+	q = NewEventQueue[int]("test", QueueConfig{Size: 2,
+		Policy: overflowBlock})
+	done := make(chan bool)
+	go func() {
+		for i := range 10 {
+			q.Push(i)
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatal("block: publisher didn't wait for the reader")
+	case <-time.After(50 * time.Millisecond):
+	}
+	got = []int{}
+	for len(got) < 10 {
+		got = append(got, <-q.Out())
+	}
+	<-done
+	if !slices.Equal(got, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("block: got %v", got)
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := &EventBus[int]{}
+	fast := bus.Subscribe("fast", QueueConfig{Size: 100})
+	slow := bus.Subscribe("slow", QueueConfig{Size: 1})
+
+	// Publishing doesn't wait for the slow subscriber, which isn't reading
+	for i := range 50 {
+		bus.Publish(i)
+	}
+	bus.Close()
+	n := 0
+	for range fast {
+		n++
+	}
+	if n != 50 {
+		t.Errorf("fast subscriber got %d events, want 50", n)
+	}
+	last := -1
+	for v := range slow {
+		last = v
+	}
+	if last != 49 {
+		t.Errorf("slow subscriber's last event was %d, want 49", last)
+	}
+}
@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Calibrations correct each node's readings as they arrive, before anything
+// else sees them. When a node has a calibration for a measurement, the log
+// keeps the raw reading too, so the calibration can be fixed later and the
+// logs recalibrated from the raw readings (see the recalibrate tool). SQLite
+// and the time-series store only keep calibrated readings, so recalibrate
+// updates the reports it changes in them too.
+
+// Name of the battery voltage measurement (the others are metric names)
+const metricBatteryV = "battery_v"
+
+// A unit that readings of a measurement can come in, with its conversion to
+// the hub's unit
+type calibrationUnit struct {
+	name    string
+	convert func(float64) float64
+}
+
+// Units for each measurement that can be calibrated. The first one is the
+// hub's unit, which is the default.
+var calibrationUnits = map[string][]calibrationUnit{
+	metricTempF: {
+		{"F", nil},
+		{"C", cToF},
+		{"K", func(k float64) float64 { return cToF(k - 273.15) }},
+	},
+	metricBatteryV: {
+		{"V", nil},
+		{"mV", func(mv float64) float64 { return mv / 1000 }},
+	},
+	metricHumidity: {
+		{"%", nil},
+		{"fraction", func(f float64) float64 { return f * 100 }},
+	},
+}
+
+// Calibration of one measurement from one node. Readings get converted from
+// the node's unit to the hub's unit (°F, V, or %), then corrected with the
+// table if there is one, or else with the gain and offset.
+type Calibration struct {
+	Unit   string   `json:"unit"`   // Unit the node reports in
+	Gain   *float64 `json:"gain"`   // Multiplier (default 1)
+	Offset float64  `json:"offset"` // Added after the gain, like -2
+	// Points of [reading, true value] in the hub's unit, interpolated
+	// between and extrapolated past the ends from the nearest two points
+	Table [][2]float64 `json:"table"`
+
+	convert func(float64) float64 // Conversion from Unit (nil for none)
+}
+
+// Check a calibration for `measurement` and look up its unit
+func (c *Calibration) Prepare(measurement string) error {
+	units, ok := calibrationUnits[measurement]
+	if !ok {
+		return fmt.Errorf("unknown measurement %q (expected temp_f, "+
+			"battery_v, or humidity)", measurement)
+	}
+	if c.Unit == "" {
+		c.Unit = units[0].name
+	}
+	i := slices.IndexFunc(units,
+		func(u calibrationUnit) bool { return u.name == c.Unit })
+	if i < 0 {
+		names := []string{}
+		for _, u := range units {
+			names = append(names, u.name)
+		}
+		return fmt.Errorf("unit: expected one of %v, got %q", names, c.Unit)
+	}
+	c.convert = units[i].convert
+	if c.Table == nil {
+		return nil
+	}
+	if c.Gain != nil || c.Offset != 0 {
+		return fmt.Errorf("use a table or gain and offset, not both")
+	}
+	if len(c.Table) < 2 {
+		return fmt.Errorf("table: needs at least 2 points")
+	}
+	c.Table = slices.Clone(c.Table)
+	sort.Slice(c.Table, func(i, j int) bool {
+		return c.Table[i][0] < c.Table[j][0]
+	})
+	for i := 1; i < len(c.Table); i++ {
+		if c.Table[i][0] == c.Table[i-1][0] {
+			return fmt.Errorf("table: two points for reading %v",
+				c.Table[i][0])
+		}
+	}
+	return nil
+}
+
+// Convert and correct a reading
+func (c *Calibration) Apply(v float64) float64 {
+	if c.convert != nil {
+		v = c.convert(v)
+	}
+	if n := len(c.Table); n >= 2 {
+		// Find the segment the reading falls in (or the end one past it)
+		i, _ := slices.BinarySearchFunc(c.Table, v,
+			func(p [2]float64, v float64) int {
+				switch {
+				case p[0] < v:
+					return -1
+				case p[0] > v:
+					return 1
+				}
+				return 0
+			})
+		i = max(1, min(n-1, i))
+		a, b := c.Table[i-1], c.Table[i]
+		return a[1] + (v-a[0])*(b[1]-a[1])/(b[0]-a[0])
+	}
+	if c.Gain != nil {
+		v *= *c.Gain
+	}
+	return v + c.Offset
+}
+
+// Check the calibrations of each node
+func prepareCalibrations(nodes map[string]map[string]Calibration) error {
+	for node, cals := range nodes {
+		for measurement, c := range cals {
+			if err := c.Prepare(measurement); err != nil {
+				return fmt.Errorf("calibration[%q][%q]: %v", node,
+					measurement, err)
+			}
+			cals[measurement] = c
+		}
+	}
+	return nil
+}
+
+// Calibrate the readings with a node's calibrations (nil if it has none),
+// keeping the raw readings of the measurements that have a calibration.
+// Readings that already have raw readings get calibrated again from those,
+// so the result is the same as if they'd arrived with these calibrations.
+func (sd *SensorData) Calibrate(cals map[string]Calibration) {
+	calibrate := func(measurement string, v *float64, raw **float64) {
+		if *raw != nil {
+			*v = **raw
+		}
+		c, ok := cals[measurement]
+		if !ok {
+			*raw = nil
+			return
+		}
+		r := *v
+		*raw = &r
+		*v = c.Apply(r)
+	}
+	calibrate(metricTempF, &sd.TempF, &sd.RawTemp)
+	calibrate(metricBatteryV, &sd.BatteryV, &sd.RawBatteryV)
+	if sd.Humidity != nil {
+		humidity := *sd.Humidity
+		calibrate(metricHumidity, &humidity, &sd.RawHumidity)
+		sd.Humidity = &humidity
+	}
+}
@@ -0,0 +1,225 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"math"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCalibrationApply(t *testing.T) {
+	gain := 1.1
+	tests := []struct {
+		name        string
+		measurement string
+		c           Calibration
+		in, want    float64
+	}{
+		{"offset", metricTempF, Calibration{Offset: -2}, 65, 63},
+		{"gain and offset", metricTempF,
+			Calibration{Gain: &gain, Offset: -5}, 50, 50},
+		{"celsius", metricTempF, Calibration{Unit: "C"}, 20, 68},
+		{"kelvin", metricTempF, Calibration{Unit: "K", Offset: 1},
+			273.15, 33},
+		{"millivolts", metricBatteryV, Calibration{Unit: "mV"}, 3750, 3.75},
+		{"fraction", metricHumidity, Calibration{Unit: "fraction"},
+			0.455, 45.5},
+		// Tables interpolate between points and extrapolate past the ends
+		{"table between", metricTempF, Calibration{
+			Table: [][2]float64{{80, 78}, {32, 32}}}, 56, 55},
+		{"table below", metricTempF, Calibration{
+			Table: [][2]float64{{32, 32}, {80, 78}}}, 8, 9},
+		{"table above", metricTempF, Calibration{
+			Table: [][2]float64{{32, 32}, {80, 78}, {100, 96}}}, 110, 105},
+		{"table point", metricTempF, Calibration{Unit: "C",
+			Table: [][2]float64{{32, 32}, {80, 78}, {100, 96}}}, 26.6667,
+			78},
+	}
+	for _, tt := range tests {
+		if err := tt.c.Prepare(tt.measurement); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := tt.c.Apply(tt.in); math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("%s: Apply(%v) = %v, want %v", tt.name, tt.in, got,
+				tt.want)
+		}
+	}
+
+	for _, bad := range []struct {
+		measurement string
+		c           Calibration
+	}{
+		{"pressure", Calibration{}},
+		{metricTempF, Calibration{Unit: "mV"}},
+		{metricTempF, Calibration{Offset: 1,
+			Table: [][2]float64{{0, 0}, {1, 1}}}},
+		{metricTempF, Calibration{Table: [][2]float64{{0, 0}}}},
+		{metricTempF, Calibration{Table: [][2]float64{{0, 0}, {0, 1}}}},
+	} {
+		if err := bad.c.Prepare(bad.measurement); err == nil {
+			t.Errorf("%s %+v didn't fail", bad.measurement, bad.c)
+		}
+	}
+}
+
+func TestSensorDataCalibrate(t *testing.T) {
+	cals := map[string]map[string]Calibration{"2": {
+		metricTempF:    {Offset: -2},
+		metricHumidity: {Offset: 5},
+	}}
+	useTestConfig(t, ServerConfig{Calibration: cals})
+	humidity := 90.0
+	sd := SensorData{Node: "2", BatteryV: 3.8, TempF: 65,
+		Humidity: &humidity}
+	sd.Calibrate(cfg.Calibration["2"])
+	if sd.TempF != 63 || *sd.Humidity != 95 || sd.BatteryV != 3.8 {
+		t.Errorf("got %v°F %v%% %vV, want 63°F 95%% 3.8V", sd.TempF,
+			*sd.Humidity, sd.BatteryV)
+	}
+	if sd.RawTemp == nil || *sd.RawTemp != 65 || sd.RawHumidity == nil ||
+		*sd.RawHumidity != 90 || sd.RawBatteryV != nil {
+		t.Errorf("got raw readings %v, %v, %v", sd.RawTemp, sd.RawBatteryV,
+			sd.RawHumidity)
+	}
+
+	// Calibrating again starts over from the raw readings, and without a
+	// calibration the readings go back to the raw ones
+	sd.Calibrate(map[string]Calibration{metricTempF: {Offset: -1}})
+	if sd.TempF != 64 || *sd.Humidity != 90 || sd.RawHumidity != nil {
+		t.Errorf("recalibrated: got %v°F %v%% raw humidity %v", sd.TempF,
+			*sd.Humidity, sd.RawHumidity)
+	}
+
+	// Raw readings make it through the log with all their digits
+	raw := 18.0625
+	sd = SensorData{Timestamp: mustTime(t, "2025-11-17T10:00:00Z"),
+		Node: "1", BatteryV: 3.8, TempF: 64.5, RawTemp: &raw}
+	scan := parseSensorLog(encodeSensorLog([]SensorData{sd}))
+	if scan.SchemaErr != nil || len(scan.Reports) != 1 {
+		t.Fatalf("schema error %v, reports %v", scan.SchemaErr,
+			scan.Reports)
+	}
+	if got := scan.Reports[0].RawTemp; got == nil || *got != raw {
+		t.Errorf("got raw temperature %v from the log, want %v", got, raw)
+	}
+}
+
+func TestConfigCalibration(t *testing.T) {
+	c := ServerConfig{Calibration: map[string]map[string]Calibration{
+		"1": {metricBatteryV: {Unit: "mV"}},
+	}}
+	if err := c.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Calibration["1"][metricBatteryV]; got.Apply(3800) != 3.8 {
+		t.Errorf("got %v, want 3.8", got.Apply(3800))
+	}
+	c = ServerConfig{Calibration: map[string]map[string]Calibration{
+		"1": {"temp_c": {}},
+	}}
+	if err := c.prepare(); err == nil {
+		t.Errorf("unknown measurement didn't fail")
+	}
+}
+
+func TestRecalibrateStorage(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{
+		LogDir:     filepath.Join(dir, "logs"),
+		StoreDir:   filepath.Join(dir, "store"),
+		SQLitePath: filepath.Join(dir, "hub.db"),
+		Storage:    []string{storageCSV, storageSQLite},
+		Calibration: map[string]map[string]Calibration{
+			"1": {metricTempF: {Offset: -2}},
+		},
+	})
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 CLI not installed")
+	}
+	fake := useFakeClock(t, mustTime(t, "2025-11-17T12:00:00Z"))
+	store, err := OpenStore(cfg.StoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenSQLite(cfg.SQLitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the last day is still in the CSV logs. Node 3's report is only in
+	// the database, like one from an import.
+	logFile := CurrentLogFile{}
+	for _, sd := range []SensorData{
+		{Timestamp: mustTime(t, "2025-11-01T10:00:00.25Z"), Node: "1",
+			TempF: 62},
+		{Timestamp: mustTime(t, "2025-11-05T10:00:00Z"), Node: "3",
+			TempF: 55},
+		{Timestamp: mustTime(t, "2025-11-17T10:00:00.5Z"), Node: "1",
+			TempF: 70},
+		{Timestamp: mustTime(t, "2025-11-17T10:00:01Z"), Node: "2",
+			TempF: 50},
+	} {
+		sd.BatteryV = 3.8
+		sd.Calibrate(cfg.Calibration[sd.Node])
+		if err := db.Insert([]SensorData{sd}); err != nil {
+			t.Fatal(err)
+		}
+		if sd.Node == "3" {
+			continue
+		}
+		if err := store.Add(sd); err != nil {
+			t.Fatal(err)
+		}
+		if sd.Timestamp.Day() == 17 {
+			fake.Set(sd.Timestamp)
+			if err := logFile.WriteReport(sd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	logFile.Close()
+	store.Close()
+
+	cfg.Calibration["1"][metricTempF] = Calibration{Offset: -10}
+	if code := recalibrateCommand([]string{"--node", "1"}); code != 0 {
+		t.Fatalf("recalibrate exited with %d", code)
+	}
+
+	// The logged report changed everywhere, and nothing else got lost
+	from := mustTime(t, "2025-10-01T00:00:00Z")
+	to := mustTime(t, "2025-12-01T00:00:00Z")
+	if store, err = OpenStore(cfg.StoreDir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	samples, err := store.QueryRaw("1", from, to)
+	if err != nil || len(samples) != 2 {
+		t.Fatalf("got store samples %v, %v", samples, err)
+	}
+	if samples[0].Values[0] != 60 || samples[1].Values[0] != 60 ||
+		samples[1].Time.UnixMilli()%1000 != 500 {
+		t.Errorf("got store samples %v", samples)
+	}
+	rollups, err := store.QueryRollups("1", "1h", from, to)
+	if err != nil || len(rollups) != 2 || rollups[1].Stats[0].Max != 60 {
+		t.Errorf("got rollups %+v, %v", rollups, err)
+	}
+	if samples, _ := store.QueryRaw("2", from, to); len(samples) != 1 ||
+		samples[0].Values[0] != 50 {
+		t.Errorf("got node 2 store samples %v", samples)
+	}
+	rows, err := db.queryReports("", from, to)
+	if err != nil || len(rows) != 4 {
+		t.Fatalf("got SQLite rows %+v, %v", rows, err)
+	}
+	for _, row := range rows {
+		want := map[string]float64{"1": 60, "2": 50, "3": 55}[row.Node]
+		if row.TempF == nil || *row.TempF != want {
+			t.Errorf("got node %s %v°F in SQLite, want %v", row.Node,
+				row.TempF, want)
+		}
+	}
+}
@@ -4,14 +4,61 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type nodeInfo struct {
 	id    string
-	name  string
-	color string
+	label string // Legend text, like "1: Greenhouse"
+	color string // CSS class for the default color
+	fill  string // Configured color from node_colors (overrides the class)
+}
+
+// CSS classes for the default node colors. Node N gets color N-1 (wrapping
+// around), so a node's color doesn't depend on which other nodes reported.
+var chartColors = []string{"blue", "orange", "purple", "green", "red",
+	"brown", "pink", "gray", "olive", "cyan"}
+
+// Legend entries per row at the top of the chart, and the most rows. Nodes
+// past the last spot get counted in a "+N more" entry instead.
+const (
+	chartLegendColumns = 5
+	chartLegendRows    = 4
+)
+
+// Get the legend text and default color class for a node. Unnamed nodes
+// get called "Node <id>". IDs that aren't numbers get a color from `i`.
+func chartNodeInfo(id string, i int) nodeInfo {
+	info := nodeInfo{id: id, label: "Node " + id, fill: nodeColor(id)}
+	if name := nodeName(id); name != "" {
+		info.label = id + ": " + name
+	}
+	if n, err := strconv.Atoi(id); err == nil && n > 0 {
+		i = n - 1
+	}
+	info.color = chartColors[i%len(chartColors)]
+	return info
+}
+
+// Sort node IDs numerically, with IDs that aren't numbers last
+func compareNodeIDs(a, b string) int {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return cmp.Compare(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
 }
 
 // Utility function to write formatted strings to a buffer
@@ -19,42 +66,191 @@ func write(buf *bytes.Buffer, format string, args ...interface{}) {
 	buf.WriteString(fmt.Sprintf(format, args...))
 }
 
-// GenerateTemperatureChart creates a simple SVG temperature chart
+// One point to plot on the chart
+type chartPoint struct {
+	Timestamp time.Time
+	Value     float64 // Temperature °F, or another metric
+}
+
+// Default seconds between chart redraws when no reports arrive
+const defaultChartInterval = 300
+
+// GenerateTemperatureChart creates a simple SVG temperature chart of the
+// reports in the in-memory node histories from the history_hours window (the
+// last 36 hours by default)
 func GenerateTemperatureChart(histories NodeHistories) ([]byte, error) {
+	return GenerateMetricChart(histories, metricTempF)
+}
+
+// GenerateMetricChart creates an SVG chart like GenerateTemperatureChart for
+// a measured or derived metric (see chartAxes). Reports that don't have the
+// metric, like ones without humidity, get left out.
+func GenerateMetricChart(histories NodeHistories, metric string) ([]byte,
+	error) {
+
+	axis, ok := chartAxes[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+	now := clock.Now()
+	earliest := now.Add(-cfg.HistoryWindow())
+	points := make(map[string][]chartPoint)
+	for nodeID, h := range histories {
+		for _, r := range h.Reports {
+			// Skip reports kept for longer windows
+			v := r.Metric(metric)
+			if r.Timestamp.Before(earliest) || math.IsNaN(v) {
+				continue
+			}
+			points[nodeID] = append(points[nodeID],
+				chartPoint{Timestamp: r.Timestamp, Value: v})
+		}
+	}
+	return renderChart(points, now, cfg.HistoryWindow(), axis)
+}
+
+// GenerateTemperatureChartDays creates an SVG temperature chart of the last
+// `days` days using mean temperatures from the time-series store rollups
+func GenerateTemperatureChartDays(s *Store, days int) ([]byte, error) {
+	return GenerateMetricChartDays(s, days, metricTempF)
+}
+
+// GenerateMetricChartDays creates an SVG chart like
+// GenerateTemperatureChartDays for a measured or derived metric. Derived
+// metrics come from each bucket's mean temperature and humidity.
+func GenerateMetricChartDays(s *Store, days int, metric string) ([]byte,
+	error) {
+
+	axis, ok := chartAxes[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+	latest := clock.Now()
+	span := time.Duration(days) * 24 * time.Hour
+	earliest := latest.Add(-span)
+
+	// Pick a rollup resolution that gives a reasonable number of points
+	res := "1d"
+	switch {
+	case days <= 3:
+		res = "5m"
+	case days <= 60:
+		res = "1h"
+	}
+
+	points := make(map[string][]chartPoint)
+	for _, nodeID := range s.Nodes() {
+		rollups, err := s.QueryRollups(nodeID, res, earliest, latest)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rollups {
+			v := r.Report().Metric(metric)
+			if math.IsNaN(v) {
+				continue
+			}
+			points[nodeID] = append(points[nodeID],
+				chartPoint{Timestamp: r.Start, Value: v})
+		}
+	}
+	return renderChart(points, latest, span, axis)
+}
+
+// Pick time axis grid step for a chart time span. Steps of a day or more are
+// given in days so they can follow local midnight across DST changes.
+func chartGridStep(span time.Duration) (hours int, days int) {
+	switch {
+	case span <= 48*time.Hour:
+		return 4, 0
+	case span <= 4*24*time.Hour:
+		return 12, 0
+	case span <= 14*24*time.Hour:
+		return 0, 1
+	case span <= 90*24*time.Hour:
+		return 0, 7
+	default:
+		return 0, 30
+	}
+}
+
+// Render SVG temperature chart of points by node ID for the time span ending
+// at `latestTime`
+func renderTemperatureChart(points map[string][]chartPoint,
+	latestTime time.Time, span time.Duration) ([]byte, error) {
+
+	return renderChart(points, latestTime, span, chartAxes[metricTempF])
+}
+
+// Render SVG chart of points by node ID for the time span ending at
+// `latestTime`, with a vertical axis for the metric being plotted
+func renderChart(points map[string][]chartPoint, latestTime time.Time,
+	span time.Duration, axis chartAxis) ([]byte, error) {
+
 	const (
-		width        = 1024  // Total SVG width
-		height       = 768   // Total SVG height
-		marginLeft   = 150   // Left margin for labels
-		marginTop    = 50    // Top margin for title/labels
-		marginRight  = 20    // Right margin
-		marginBottom = 110   // Bottom margin for time labels
-		minTempF     = 0.0   // Minimum temperature
-		maxTempF     = 110.0 // Maximum temperature
-		tempStep     = 10    // Temperature axis grid step
-		hours        = 36    // Time range (36 hours)
-		hoursStep    = 4     // Time axis grid step
+		width        = 1024 // Total SVG width
+		height       = 768  // Total SVG height
+		marginLeft   = 150  // Left margin for labels
+		marginRight  = 20   // Right margin
+		marginBottom = 110  // Bottom margin for time labels
+		legendRow    = 24   // Height of each extra row of the legend
 	)
 
+	// Collect list of IDs, names, and colors for the configured sensor
+	// nodes and the nodes with points to plot, in node ID order
+	ids := []string{}
+	for _, id := range []string{"1", "2", "3"} {
+		if nodeName(id) != "" {
+			ids = append(ids, id)
+		}
+	}
+	for id, p := range points {
+		if len(p) > 0 && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, compareNodeIDs)
+	nodes := []nodeInfo{}
+	for i, id := range ids {
+		nodes = append(nodes, chartNodeInfo(id, i))
+	}
+	// Top margin for the legend, which wraps to more rows for lots of nodes
+	legendSpots := min(len(nodes), chartLegendColumns*chartLegendRows)
+	legendRows := max(1, (legendSpots+chartLegendColumns-1)/chartLegendColumns)
+	marginTop := 50 + legendRow*(legendRows-1)
+	legendNodes := len(nodes)
+	if legendNodes > legendSpots {
+		legendNodes = legendSpots - 1
+	}
+	// Position of a legend entry, evenly dividing the usable width into
+	// columns
+	legendXY := func(i int) (int, int) {
+		columns := max(1, min(len(nodes), chartLegendColumns))
+		segment := (width - marginLeft - marginRight) / columns
+		return marginLeft + i%columns*segment,
+			marginTop - 25 - legendRow*(legendRows-1-i/columns)
+	}
+	minValue, maxValue := axis.min, axis.max
+	hours := span.Hours()                      // Time range
+	hoursStep, daysStep := chartGridStep(span) // Time axis grid step
+
 	// Adjusted dimensions accounting for margins
 	chartWidth := width - marginLeft - marginRight
 	chartHeight := height - marginTop - marginBottom
 
-	// Right edge is current time rounded up to the next whole hour, left edge
-	// is 36 hours before then
-	latestTime := time.Now()
-	earliestTime := latestTime.Add(-hours * time.Hour)
+	// Right edge is latest time, left edge is span before then
+	earliestTime := latestTime.Add(-span)
 
 	// Coordinate transformations
-	tempToY := func(temp float64) int {
-		// Scale temperature to Y position on the chart, considering the margin
+	valueToY := func(v float64) int {
+		// Scale value to Y position on the chart, considering the margin
 		return marginTop + chartHeight -
-			int((temp-minTempF)/(maxTempF-minTempF)*float64(chartHeight))
+			int((v-minValue)/(maxValue-minValue)*float64(chartHeight))
 	}
 
 	timeToX := func(t time.Time) int {
 		elapsed := t.Sub(earliestTime).Hours()
 		// Scale time to X position on the chart, considering the margin
-		return marginLeft + int((elapsed/float64(hours))*float64(chartWidth))
+		return marginLeft + int((elapsed/hours)*float64(chartWidth))
 	}
 
 	var buf bytes.Buffer
@@ -71,6 +267,13 @@ line{stroke:#777;stroke-width=1px;}
 .blue{fill:#2f87b4e8;}
 .orange{fill:#ff7f0ee8;}
 .purple{fill:#9467bde8;}
+.green{fill:#2ca02ce8;}
+.red{fill:#d62728e8;}
+.brown{fill:#8c564be8;}
+.pink{fill:#e377c2e8;}
+.gray{fill:#7f7f7fe8;}
+.olive{fill:#bcbd22e8;}
+.cyan{fill:#17becfe8;}
 text{fill:#000;font-size:16px;font-family:"Verdana",sans-serif;font-weight:bold;
 text-anchor:end;}
 text.legend{text-anchor:start;}
@@ -82,27 +285,57 @@ text.legend{text-anchor:start;}
 
 	// Horizontal grid lines and labels
 	lineFmt := `<line x1="%d" y1="%d" x2="%d" y2="%d"/>` + "\n"
-	for temp := minTempF; temp <= maxTempF; temp += tempStep {
-		y := tempToY(temp)
+	for v := minValue; v <= maxValue; v += axis.step {
+		y := valueToY(v)
 		write(&buf, lineFmt, marginLeft, y, width-marginRight, y)
 	}
 
-	// Round current time down to a multiple of 4 hours
-	hourFloor4 := int(latestTime.Hour()/4) * 4
-	lastT := time.Date(latestTime.Year(), latestTime.Month(),
-		latestTime.Day(), hourFloor4, 0, 0, 0, latestTime.Location())
+	// Round current time down to a multiple of the grid step (hours step) or
+	// to local midnight (days step)
+	loc := cfg.Location()
+	local := latestTime.In(loc)
+	hourFloor := 0
+	if hoursStep > 0 {
+		hourFloor = int(local.Hour()/hoursStep) * hoursStep
+	}
+	lastT := time.Date(local.Year(), local.Month(), local.Day(), hourFloor,
+		0, 0, 0, loc)
+	// Step back by local wall clock time rather than elapsed time, so grid
+	// lines stay on multiples of the grid step (e.g. midnight, 4am, 8am, ...)
+	// across daylight saving time changes. Those days have a 3 or 5 hour gap
+	// between two of the lines.
+	prevT := func(t time.Time) time.Time {
+		if daysStep > 0 {
+			return t.AddDate(0, 0, -daysStep)
+		}
+		t = t.In(loc)
+		h := t.Hour() - hoursStep
+		if h < 0 {
+			// Previous day, re-snapped in case today started at 1am
+			t = t.AddDate(0, 0, -1)
+			h += 24
+		}
+		h = h / hoursStep * hoursStep
+		return time.Date(t.Year(), t.Month(), t.Day(), h, 0, 0, 0, loc)
+	}
+	labelFmt := "Mon 2Jan 3pm"
+	if daysStep > 0 {
+		labelFmt = "Mon 2Jan"
+	}
+	if daysStep > 1 {
+		labelFmt = "2Jan 2006"
+	}
 
 	// Vertical grid lines and labels. This is tricky. There are always lines
 	// at the left and right margins. But, the position of the interior lines
 	// depends on the current time. The lines always get drawn at multiples of
-	// 4 hours, so they shift around based on how far you are from noon, 4 PM,
-	// 8 PM, midnight, etc.
+	// the grid step (e.g. 4 hours), so they shift around based on how far you
+	// are from noon, 4 PM, 8 PM, midnight, etc.
 	write(&buf, lineFmt, marginLeft, marginTop, marginLeft, height-marginBottom)
-	subTime := -time.Duration(hoursStep) * time.Hour
-	for t := lastT; t.After(earliestTime); t = t.Add(subTime) {
+	for t := lastT; t.After(earliestTime); t = prevT(t) {
 		x := timeToX(t)
 		write(&buf, lineFmt, x, marginTop, x, height-marginBottom)
-		fmtTime := t.In(time.Local).Format("Mon 2Jan 3pm")
+		fmtTime := t.In(loc).Format(labelFmt)
 		xx := int(x) + 8
 		yy := int(marginTop + chartHeight + 10)
 		write(&buf,
@@ -112,88 +345,65 @@ text.legend{text-anchor:start;}
 	write(&buf, lineFmt, marginLeft+chartWidth, marginTop,
 		marginLeft+chartWidth, height-marginBottom)
 
-	// Temperature axis text labels (vertical axis, left margin)
-	for temp := minTempF; temp <= maxTempF; temp += tempStep {
-		y := tempToY(temp)
+	// Value axis text labels (vertical axis, left margin)
+	for v := minValue; v <= maxValue; v += axis.step {
+		y := valueToY(v)
 		offset := 5
-		if temp == minTempF {
-			offset = 0 // nudge lowest temp label upward
-		} else if temp == maxTempF {
-			offset = 10 // nudge highest temp label downward
+		if v == minValue {
+			offset = 0 // nudge lowest label upward
+		} else if v == maxValue {
+			offset = 10 // nudge highest label downward
 		}
-		write(&buf, `<text x="%d" y="%d">%d°F</text>`+"\n",
-			int(marginLeft-5), int(y+offset), int(temp))
-	}
-
-	// Collect list of IDs, names, and colors for configured sensor nodes
-	nodes := []nodeInfo{}
-	if cfg.Node1 != "" {
-		nodes = append(nodes, nodeInfo{id: "1", name: cfg.Node1, color: "blue"})
-	}
-	if cfg.Node2 != "" {
-		nodes = append(nodes, nodeInfo{id: "2", name: cfg.Node2,
-			color: "orange"})
-	}
-	if cfg.Node3 != "" {
-		nodes = append(nodes, nodeInfo{id: "3", name: cfg.Node3,
-			color: "purple"})
+		write(&buf, `<text x="%d" y="%d">`+axis.label+`</text>`+"\n",
+			int(marginLeft-5), int(y+offset), v)
 	}
 
 	// Define reusable circle shape
 	write(&buf, `<defs><circle id="c" cx="0" cy="0" r="2.2"/></defs>`+"\n")
 
-	// Plot data points by node
-	for nodeID, h := range histories {
-		if len(h.Reports) == 0 {
+	// Plot data points by node, in node ID order so the SVG is the same
+	// every time for the same points
+	for idx, info := range nodes {
+		nodePoints := points[info.id]
+		if len(nodePoints) == 0 {
 			continue
 		}
 
-		// find config entry
-		var info *nodeInfo
-		for i := range nodes {
-			if nodes[i].id == nodeID {
-				info = &nodes[i]
-				break
-			}
-		}
-		if info == nil {
-			continue // node not configured, skip
+		// Enclose scatter plot dots in a group to share the color class
+		if info.fill != "" {
+			write(&buf, `<g class="%s" style="fill:%s">`+"\n", info.color,
+				info.fill)
+		} else {
+			write(&buf, `<g class="%s">`+"\n", info.color)
 		}
 
-		// Enclose scatter plot dots in a group to share the color class
-		write(&buf, `<g class="%s">`+"\n", info.color)
-
-		// Data series legend:
-		// 1. Find index of this node in nodes[]
-		var idx int
-		for i := range nodes {
-			if nodes[i].id == nodeID {
-				idx = i
-				break
-			}
+		// Data series legend: a color dot and a text label
+		if idx < legendNodes {
+			x, y := legendXY(idx)
+			write(&buf, `<circle r="8" cx="%d" cy="%d"/>`+"\n", x+40, y)
+			write(&buf, `<text x="%d" y="%d" class="legend">%s</text>`+"\n",
+				x+54, y+6, info.label)
 		}
-		// 2. Evenly divide legend positions across the usable width
-		segment := (width - marginLeft - marginRight) / len(nodes)
-		xBase := marginLeft + idx*segment
-		// 3. Draw a color dot and a text label
-		write(&buf, `<circle r="8" cx="%d" cy="%d"/>`+"\n", xBase+40,
-			marginTop-25)
-		write(&buf, `<text x="%d" y="%d" class="legend">%s: %s</text>`+"\n",
-			xBase+54, marginTop-19, info.id, info.name)
 
 		// Scatter plot dots
-		for _, report := range h.Reports {
-			if report.Timestamp.Before(earliestTime) {
+		for _, point := range nodePoints {
+			if point.Timestamp.Before(earliestTime) {
 				continue
 			}
-			x := timeToX(report.Timestamp)
-			y := tempToY(report.TempF)
+			x := timeToX(point.Timestamp)
+			y := valueToY(point.Value)
 			write(&buf, `<use href="#c" x="%d" y="%d"/>`+"\n", x, y)
 		}
 
 		write(&buf, "</g>\n")
 	}
 
+	if legendNodes < len(nodes) {
+		x, y := legendXY(legendNodes)
+		write(&buf, `<text x="%d" y="%d" class="legend">+%d more</text>`+"\n",
+			x+32, y+6, len(nodes)-legendNodes)
+	}
+
 	write(&buf, "</svg>")
 
 	return buf.Bytes(), nil
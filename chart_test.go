@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Run `go test -run Chart -update` to rewrite the golden files after a
+// deliberate change to the chart, then look at the new SVGs in a browser
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// Compare `got` to a golden file in testdata (or rewrite it with -update)
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s doesn't match; run with -update if the change is on "+
+			"purpose", path)
+	}
+}
+
+// Make a day/night temperature curve for a node, one report every `step`
+func testDiurnalReports(end time.Time, span, step time.Duration,
+	meanF, swingF float64) []chartPoint {
+
+	points := []chartPoint{}
+	for ts := end.Add(-span); !ts.After(end); ts = ts.Add(step) {
+		hour := float64(ts.Unix()%86400) / 3600
+		tempF := meanF + swingF*math.Sin((hour-14)/24*2*math.Pi+math.Pi/2)
+		points = append(points, chartPoint{Timestamp: ts, Value: tempF})
+	}
+	return points
+}
+
+func TestGenerateTemperatureChartGolden(t *testing.T) {
+	useTestConfig(t, ServerConfig{
+		Node1:      "Greenhouse",
+		Node2:      "Outside",
+		NodeColors: map[string]string{"2": "teal"},
+		Timezone:   "America/Chicago",
+	})
+	now := mustTime(t, "2025-11-17T23:43:00Z")
+	useFakeClock(t, now)
+
+	// Node 3 has no name, so it gets a default name and color
+	histories := NodeHistories{}
+	for node, mean := range map[string]float64{"1": 70, "2": 45, "3": 60} {
+		h := &ReportHistory{}
+		for _, p := range testDiurnalReports(now, 40*time.Hour,
+			20*time.Minute, mean, 12) {
+			h.Add(p.Timestamp, 3.8, p.Value)
+		}
+		histories[node] = h
+	}
+	got, err := GenerateTemperatureChart(histories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "chart-36h.svg", got)
+}
+
+func TestRenderTemperatureChartDSTGolden(t *testing.T) {
+	useTestConfig(t, ServerConfig{
+		Node1:    "Greenhouse",
+		Timezone: "America/Chicago",
+	})
+	// A week that includes the fall DST change on Nov 2
+	latest := mustTime(t, "2025-11-05T18:00:00Z")
+	span := 7 * 24 * time.Hour
+	points := map[string][]chartPoint{
+		"1": testDiurnalReports(latest, span, time.Hour, 65, 15),
+	}
+	got, err := renderTemperatureChart(points, latest, span)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "chart-7d-dst.svg", got)
+}
+
+// Chart a day of reports from simulated nodes, every 20 minutes. Node 2 is
+// the only one with a name.
+func simulatedNodesChart(t *testing.T, c SimulateConfig) []byte {
+	useTestConfig(t, ServerConfig{Node2: "Outside", Timezone: "UTC",
+		Simulate: c})
+	start := mustTime(t, "2025-07-01T00:00:00Z")
+	fake := useFakeClock(t, start)
+	s := newSimulator(&cfg.Simulate)
+	histories := NodeHistories{}
+	for step := range 24 * 3 {
+		now := start.Add(time.Duration(step) * 20 * time.Minute)
+		fake.Set(now)
+		for _, n := range s.nodes {
+			for _, line := range s.reports(n, now) {
+				sd, ok := parseSensorReport(line)
+				if !ok {
+					continue
+				}
+				h, exists := histories[sd.Node]
+				if !exists {
+					h = &ReportHistory{}
+					histories[sd.Node] = h
+				}
+				h.AddReport(sd.Report())
+			}
+		}
+	}
+	got, err := GenerateTemperatureChart(histories)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestChartManySimulatedNodes(t *testing.T) {
+	c := SimulateConfig{Nodes: 12, Seed: 1}
+	got := simulatedNodesChart(t, c)
+
+	// Every node gets plotted with its own legend entry, in rows that fit
+	legend := regexp.MustCompile(
+		`<circle r="8" cx="(\d+)" cy="(\d+)"/>\n<text [^>]*>([^<]*)</text>`)
+	entries := legend.FindAllSubmatch(got, -1)
+	if len(entries) != c.Nodes {
+		t.Fatalf("got %d legend entries, want %d", len(entries), c.Nodes)
+	}
+	seen := map[string]bool{}
+	for i, e := range entries {
+		want := fmt.Sprintf("Node %d", i+1)
+		if i == 1 {
+			want = "2: Outside"
+		}
+		if string(e[3]) != want {
+			t.Errorf("legend entry %d: got %q, want %q", i, e[3], want)
+		}
+		pos := string(e[1]) + "," + string(e[2])
+		if x, _ := strconv.Atoi(string(e[1])); seen[pos] || x > 1024-150 {
+			t.Errorf("legend entry %q at %s overlaps or runs off", e[3], pos)
+		}
+		seen[pos] = true
+	}
+	if n := bytes.Count(got, []byte(`<g class="`)); n != c.Nodes {
+		t.Errorf("got %d node groups, want %d", n, c.Nodes)
+	}
+	// Colors wrap around after the last one
+	node11 := regexp.MustCompile(
+		`<g class="blue">\n<circle [^>]*>\n<text [^>]*>Node 11<`)
+	if !node11.Match(got) {
+		t.Errorf("node 11 isn't blue")
+	}
+}
+
+func TestChartHundredsOfSimulatedNodes(t *testing.T) {
+	c := SimulateConfig{Nodes: 250, Seed: 1}
+	got := simulatedNodesChart(t, c)
+
+	// The legend stops at 4 rows, so the plot area keeps its height
+	grid := regexp.MustCompile(`<line x1="150" y1="(\d+)" x2="1004" y2="\d+"/>`)
+	lines := grid.FindAllSubmatch(got, -1)
+	if len(lines) < 2 {
+		t.Fatalf("got %d horizontal grid lines", len(lines))
+	}
+	bottom, _ := strconv.Atoi(string(lines[0][1]))
+	top, _ := strconv.Atoi(string(lines[len(lines)-1][1]))
+	if top < 100 || bottom-top < 500 {
+		t.Errorf("got plot area from y=%d to y=%d", top, bottom)
+	}
+	if n := bytes.Count(got, []byte(`class="legend"`)); n != 20 {
+		t.Errorf("got %d legend entries, want 20", n)
+	}
+	if !bytes.Contains(got, []byte(">+231 more</text>")) {
+		t.Errorf("legend doesn't count the other 231 nodes")
+	}
+	if n := bytes.Count(got, []byte(`<g class="`)); n != c.Nodes {
+		t.Errorf("got %d node groups, want %d", n, c.Nodes)
+	}
+}
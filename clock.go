@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of the current time for report timestamps, the report histories,
+// the chart, log file names, and log retention. Normally this is the system
+// clock, but simulations, replays, and tests can run at a fixed or
+// accelerated time (see clock_start and clock_speed). Network timeouts, rate
+// limits, and timers always use real time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Clock that reads the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Clock that only moves when told to, for replays and tests
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// Make a manual clock set to time `t`
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{now: t}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set the clock to time `t`
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.mu.Unlock()
+}
+
+// Move the clock forward by `d`
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// Clock that starts at a given time and runs at `speed` times real time. For
+// example, speed 60 runs a simulated hour every real minute, and speed 0
+// stands still.
+type ScaledClock struct {
+	start     time.Time // Clock time when the clock was made
+	realStart time.Time // Real time (with monotonic reading) at that moment
+	speed     float64
+}
+
+// Make a scaled clock starting now at time `start`
+func NewScaledClock(start time.Time, speed float64) *ScaledClock {
+	return &ScaledClock{start: start, realStart: time.Now(), speed: speed}
+}
+
+func (c *ScaledClock) Now() time.Time {
+	elapsed := time.Since(c.realStart)
+	return c.start.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+// Global clock
+var clock Clock = systemClock{}
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScaledClock(t *testing.T) {
+	start := mustTime(t, "2025-11-17T06:00:00Z")
+	fast := NewScaledClock(start, 3600)
+	stopped := NewScaledClock(start, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	// 20ms at 3600x is over a minute of clock time
+	if got := fast.Now().Sub(start); got < time.Minute || got > time.Hour {
+		t.Errorf("fast clock moved %v, want about 72s", got)
+	}
+	if got := stopped.Now(); !got.Equal(start) {
+		t.Errorf("stopped clock moved to %v", got)
+	}
+}
+
+func TestServerConfigNewClock(t *testing.T) {
+	c := ServerConfig{}
+	if err := c.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.NewClock().(systemClock); !ok {
+		t.Errorf("got %T, want the system clock by default", c.NewClock())
+	}
+
+	speed := 0.0
+	c = ServerConfig{ClockStart: "2025-11-17T06:00:00-06:00",
+		ClockSpeed: &speed}
+	if err := c.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	want := mustTime(t, "2025-11-17T12:00:00Z")
+	if got := c.NewClock().Now(); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	negative := -1.0
+	for _, bad := range []ServerConfig{
+		{ClockStart: "yesterday"},
+		{ClockSpeed: &negative},
+	} {
+		if err := bad.prepare(); err == nil {
+			t.Errorf("%+v: got no error", bad)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default config file path (relative to the working directory). The -config
+// flag can point somewhere else.
+const defaultConfigPath = "config.json"
+
+// Struct type for server config loaded from config.json
+type ServerConfig struct {
+	Comment string `json:"comment"` // Note for humans (ignored)
+	Server  string `json:"server"`
+	Nick    string `json:"nick"`
+	Channel string `json:"channel"`
+	Node1   string `json:"node1"` // Chart legend text for nodeID=1
+	Node2   string `json:"node2"` // Chart legend text for nodeID=2
+	Node3   string `json:"node3"` // Chart legend text for nodeID=3
+	// Chart colors by node ID, as CSS colors like "#2f87b4" or "teal"
+	// (default is blue, orange, and purple for nodes 1, 2, and 3)
+	NodeColors map[string]string `json:"node_colors"`
+	// Minimum seconds between IRC topic updates (0 means use the default)
+	TopicInterval int `json:"topic_interval"`
+	// List of IRC output targets. If this is empty, the server, nick, and
+	// channel settings above get used as a single topic target.
+	IRC []IRCTarget `json:"irc"`
+	// Optional MQTT publisher (disabled if broker is empty)
+	MQTT MQTTConfig `json:"mqtt"`
+	// Optional outbound webhooks and where to keep their retry queues
+	Webhooks        []WebhookConfig `json:"webhooks"`
+	WebhookQueueDir string          `json:"webhook_queue_dir"`
+	// Optional InfluxDB and Graphite sinks (disabled if url/udp/addr empty)
+	InfluxDB InfluxConfig   `json:"influxdb"`
+	Graphite GraphiteConfig `json:"graphite"`
+	// CSV log fsync policy ("always", "interval", or "never") and interval
+	LogFsync         string `json:"log_fsync"`
+	LogFsyncInterval int    `json:"log_fsync_interval"`
+	// CSV log directory, retention, and compression of completed days
+	LogDir             string `json:"log_dir"`
+	LogRetentionDays   int    `json:"log_retention_days"`
+	LogRetentionAction string `json:"log_retention_action"`
+	LogArchiveDir      string `json:"log_archive_dir"`
+	LogCompress        bool   `json:"log_compress"`
+	// Time-series store directory
+	StoreDir string `json:"store_dir"`
+	// Storage backends for reports: "csv" and/or "sqlite" (default csv), and
+	// where to keep the SQLite database
+	Storage    []string `json:"storage"`
+	SQLitePath string   `json:"sqlite_path"`
+	// Temperature alert thresholds by node ID
+	Thresholds map[string]Threshold `json:"thresholds"`
+	// Timezone for displaying times and for "today" stats, as an IANA name
+	// like "America/Chicago" (default is the system timezone)
+	Timezone string `json:"timezone"`
+	// Name log files by "utc" day (default) or "local" day (in Timezone)
+	LogFileTimezone string `json:"log_file_timezone"`
+	// Web server listen address (default "0.0.0.0:8080")
+	WebAddr string `json:"web_addr"`
+	// Seconds between chart redraws when no reports arrive (default 300)
+	ChartInterval int `json:"chart_interval"`
+	// Hours of reports kept in memory for rolling min/max and the chart
+	// (default 36)
+	HistoryHours int `json:"history_hours"`
+	// Most reports kept in memory per node, however fast a node reports
+	// (default 20000)
+	HistoryMaxReports int `json:"history_max_reports"`
+	// Rolling windows to keep node statistics for, like "1h" or "7d",
+	// besides today (since local midnight) and the history_hours window
+	// (default ["1h", "24h"])
+	Windows []string `json:"windows"`
+	// Window for the min/max in IRC summaries (default is the history_hours
+	// window)
+	SummaryWindow string `json:"summary_window"`
+	// Growing degree day base, cap, and season start
+	GDD GDDConfig `json:"gdd"`
+	// Sensor calibrations by node ID, then by measurement ("temp_f",
+	// "battery_v", or "humidity")
+	Calibration map[string]map[string]Calibration `json:"calibration"`
+	// Days of CSV logs to check and load at startup (default 3)
+	StartupLoadDays int `json:"startup_load_days"`
+	// Run the clock from a given time (RFC 3339) and/or at a multiple of
+	// real time, for demos and simulations (default is the system clock).
+	// Speed 0 stops the clock.
+	ClockStart string   `json:"clock_start"`
+	ClockSpeed *float64 `json:"clock_speed"`
+	// Optional simulated sensor nodes instead of the serial port
+	Simulate SimulateConfig `json:"simulate"`
+	// Queue size and overflow policy by output name, like "logger" or "irc"
+	// (see bus.go for the names and defaults)
+	Queues map[string]QueueConfig `json:"queues"`
+
+	location   *time.Location  // Loaded from Timezone
+	clockStart time.Time       // Parsed from ClockStart
+	windows    []historyWindow // Parsed from Windows and HistoryHours
+}
+
+// Log file naming timezones for the "log_file_timezone" setting
+const (
+	logZoneUTC   = "utc"
+	logZoneLocal = "local"
+)
+
+// Matches the CSS colors allowed in node_colors: hex colors or color names
+var cssColorRE = regexp.MustCompile(
+	`^(#([0-9a-fA-F]{3,4}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})|[a-zA-Z]+)$`)
+
+// Global config struct
+var cfg ServerConfig
+
+// Lock for config settings that can change on reload while other goroutines
+// are reading them (node names and colors). The other reloadable settings
+// only get used by the main goroutine, which is also the one that reloads.
+var cfgMu sync.RWMutex
+
+// Load server config file into the global config struct
+func LoadServerConfig(path string) error {
+	c, err := ReadServerConfig(path)
+	if err != nil {
+		return err
+	}
+	cfg = *c
+	return nil
+}
+
+// Read a server config file, apply environment and flag overrides, and check
+// the result. Errors include the file path, and for JSON problems, the line
+// and column (e.g. "config.json:7:12: ..."), or for bad values, the name of
+// the setting.
+func ReadServerConfig(path string) (*ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &ServerConfig{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Catch misspelled setting names, which would otherwise get ignored
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, configDecodeError(path, data, dec.InputOffset(), err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		// Point at the data, not the end of the whitespace before it
+		offset := dec.InputOffset()
+		rest := bytes.TrimLeft(data[offset:], " \t\r\n")
+		offset = int64(len(data) - len(rest))
+		return nil, configDecodeError(path, data, offset,
+			fmt.Errorf("unexpected data after the closing }"))
+	}
+	// Overrides for IRC settings go to the IRC targets, so the old style
+	// settings need to be converted first
+	c.convertLegacyIRC()
+	if err := c.applyOverrides(); err != nil {
+		return nil, err
+	}
+	if err := c.prepare(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Describe a JSON decoding error with its line and column in the file.
+// `offset` is the decoder's input offset, which is the best guess for errors
+// that don't say where they happened.
+func configDecodeError(path string, data []byte, offset int64,
+	err error) error {
+
+	msg := err.Error()
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// Offset is just past the bad character
+		offset = syntaxErr.Offset - 1
+	case errors.As(err, &typeErr):
+		// Offset is just past the bad value
+		offset = typeErr.Offset - 1
+		msg = fmt.Sprintf("%s: expected %s, got JSON %s", typeErr.Field,
+			typeErr.Type, typeErr.Value)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		offset = int64(len(data))
+		msg = "unexpected end of file (missing } or ]?)"
+	case strings.HasPrefix(msg, "json: unknown field "):
+		// The decoder has read the whole object by now, so look for the
+		// first place the name gets used as a key
+		key := strings.TrimPrefix(msg, "json: unknown field ")
+		keyRE := regexp.MustCompile(regexp.QuoteMeta(key) + `\s*:`)
+		if loc := keyRE.FindIndex(data); loc != nil {
+			offset = int64(loc[0])
+		}
+		msg = "unknown setting " + key
+	}
+	msg = strings.TrimPrefix(msg, "json: ")
+	offset = max(0, min(offset, int64(len(data))))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("%s:%d:%d: %s", path, line, col, msg)
+}
+
+// Convert old style single server/nick/channel config to an IRC target.
+// Returns true if there was something to convert.
+func (c *ServerConfig) convertLegacyIRC() bool {
+	if len(c.IRC) > 0 || c.Server == "" {
+		return false
+	}
+	c.IRC = []IRCTarget{{
+		Server:   c.Server,
+		Nick:     c.Nick,
+		Channels: []string{c.Channel},
+		Mode:     ircModeTopic,
+		Interval: c.TopicInterval,
+	}}
+	return true
+}
+
+// Check settings and fill in defaults. Error messages start with the name of
+// the bad setting.
+func (c *ServerConfig) prepare() error {
+	var err error
+
+	legacyIRC := c.convertLegacyIRC()
+	for i := range c.IRC {
+		if err := c.IRC[i].Prepare(); err != nil {
+			if legacyIRC {
+				return fmt.Errorf("server/nick/channel: %v", err)
+			}
+			return fmt.Errorf("irc[%d]: %v", i, err)
+		}
+	}
+	for id, color := range c.NodeColors {
+		if !cssColorRE.MatchString(color) {
+			return fmt.Errorf("node_colors[%q]: bad color %q", id, color)
+		}
+	}
+	for id, t := range c.Thresholds {
+		if t.LowF != nil && t.HighF != nil && *t.LowF >= *t.HighF {
+			return fmt.Errorf("thresholds[%q]: low_f must be below high_f",
+				id)
+		}
+	}
+	if c.MQTT.Broker != "" {
+		if err := c.MQTT.Prepare(); err != nil {
+			return fmt.Errorf("mqtt: %v", err)
+		}
+	}
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].Prepare(); err != nil {
+			return fmt.Errorf("webhooks[%d]: %v", i, err)
+		}
+	}
+	if c.WebhookQueueDir == "" {
+		c.WebhookQueueDir = "webhook-queue"
+	}
+	if c.InfluxDB.URL != "" || c.InfluxDB.UDP != "" {
+		if err := c.InfluxDB.Prepare(); err != nil {
+			return fmt.Errorf("influxdb: %v", err)
+		}
+	}
+	if c.Graphite.Addr != "" {
+		c.Graphite.Prepare()
+	}
+	switch c.LogFsync {
+	case "":
+		c.LogFsync = fsyncInterval
+	case fsyncAlways, fsyncInterval, fsyncNever:
+	default:
+		return fmt.Errorf("log_fsync: unknown policy %q", c.LogFsync)
+	}
+	if c.LogFsyncInterval <= 0 {
+		c.LogFsyncInterval = defaultFsyncInterval
+	}
+	if c.LogDir == "" {
+		c.LogDir = defaultLogDir
+	}
+	if c.LogRetentionDays < 0 {
+		return fmt.Errorf("log_retention_days: must not be negative")
+	}
+	if c.StoreDir == "" {
+		c.StoreDir = defaultStoreDir
+	}
+	if len(c.Storage) == 0 {
+		c.Storage = []string{storageCSV}
+	}
+	for _, backend := range c.Storage {
+		if backend != storageCSV && backend != storageSQLite {
+			return fmt.Errorf("storage: unknown backend %q", backend)
+		}
+	}
+	if c.SQLitePath == "" {
+		c.SQLitePath = defaultSQLitePath
+	}
+	c.location = time.Local
+	if c.Timezone != "" {
+		if c.location, err = time.LoadLocation(c.Timezone); err != nil {
+			return fmt.Errorf("timezone: %v", err)
+		}
+	}
+	switch c.LogFileTimezone {
+	case "":
+		c.LogFileTimezone = logZoneUTC
+	case logZoneUTC, logZoneLocal:
+	default:
+		return fmt.Errorf("log_file_timezone: unknown timezone %q",
+			c.LogFileTimezone)
+	}
+	switch c.LogRetentionAction {
+	case "":
+		c.LogRetentionAction = retentionDelete
+	case retentionDelete, retentionArchive:
+	default:
+		return fmt.Errorf("log_retention_action: unknown action %q",
+			c.LogRetentionAction)
+	}
+	if c.WebAddr == "" {
+		c.WebAddr = defaultWebAddr
+	}
+	if c.ChartInterval <= 0 {
+		c.ChartInterval = defaultChartInterval
+	}
+	if c.HistoryHours <= 0 {
+		c.HistoryHours = defaultHistoryHours
+	}
+	if c.HistoryMaxReports <= 0 {
+		c.HistoryMaxReports = defaultHistoryMaxReports
+	}
+	if c.StartupLoadDays <= 0 {
+		c.StartupLoadDays = defaultStartupLoadDays
+	}
+	if err := c.prepareWindows(); err != nil {
+		return err
+	}
+	if err := c.GDD.Prepare(); err != nil {
+		return fmt.Errorf("gdd: %v", err)
+	}
+	if err := prepareCalibrations(c.Calibration); err != nil {
+		return err
+	}
+	for i, t := range c.IRC {
+		if w, ok := c.FindWindow(t.Window); ok {
+			c.IRC[i].Window = w.name
+		} else if t.Window != "" {
+			return fmt.Errorf("irc[%d]: window %q is not one of the windows",
+				i, t.Window)
+		}
+	}
+	if c.ClockStart != "" {
+		c.clockStart, err = time.Parse(time.RFC3339, c.ClockStart)
+		if err != nil {
+			return fmt.Errorf("clock_start: expected a time like "+
+				"2025-11-17T06:00:00-06:00, got %q", c.ClockStart)
+		}
+	}
+	if c.ClockSpeed != nil && *c.ClockSpeed < 0 {
+		return fmt.Errorf("clock_speed: must not be negative")
+	}
+	if err := c.Simulate.Prepare(); err != nil {
+		return fmt.Errorf("simulate: %v", err)
+	}
+	for name, q := range c.Queues {
+		if _, ok := defaultQueueSizes[name]; !ok {
+			return fmt.Errorf("queues: unknown output %q", name)
+		}
+		if err := q.Prepare(); err != nil {
+			return fmt.Errorf("queues[%q]: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Copy the settings that can change without a restart (node names and
+// colors, alert thresholds, calibrations, and IRC targets) from `next`
+func (c *ServerConfig) applyReloadable(next *ServerConfig) {
+	c.Comment = next.Comment
+	c.Node1, c.Node2, c.Node3 = next.Node1, next.Node2, next.Node3
+	c.NodeColors = next.NodeColors
+	c.Thresholds = next.Thresholds
+	c.Calibration = next.Calibration
+	// The old style IRC settings are part of the IRC targets
+	c.Server, c.Nick, c.Channel = next.Server, next.Nick, next.Channel
+	c.TopicInterval = next.TopicInterval
+	c.IRC = next.IRC
+}
+
+// List the names of settings that differ in `next` but can't change without
+// a restart
+func (c *ServerConfig) restartSettings(next *ServerConfig) []string {
+	old := *c
+	old.applyReloadable(next)
+	var a, b map[string]json.RawMessage
+	for _, pair := range []struct {
+		c *ServerConfig
+		m *map[string]json.RawMessage
+	}{{&old, &a}, {next, &b}} {
+		data, err := json.Marshal(pair.c)
+		if err == nil {
+			err = json.Unmarshal(data, pair.m)
+		}
+		if err != nil {
+			return []string{fmt.Sprintf("(can't compare: %v)", err)}
+		}
+	}
+	changed := []string{}
+	for name := range a {
+		if !bytes.Equal(a[name], b[name]) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Is a storage backend ("csv" or "sqlite") enabled?
+func storageEnabled(backend string) bool {
+	for _, b := range cfg.Storage {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the timezone for displaying times (the system timezone unless the
+// "timezone" setting is set)
+func (c *ServerConfig) Location() *time.Location {
+	if c.location == nil {
+		return time.Local
+	}
+	return c.location
+}
+
+// Make the clock set up by clock_start and clock_speed (the system clock if
+// neither is set)
+func (c *ServerConfig) NewClock() Clock {
+	if c.ClockStart == "" && c.ClockSpeed == nil {
+		return systemClock{}
+	}
+	start := time.Now()
+	if c.ClockStart != "" {
+		start = c.clockStart
+	}
+	speed := 1.0
+	if c.ClockSpeed != nil {
+		speed = *c.ClockSpeed
+	}
+	return NewScaledClock(start, speed)
+}
+
+// Get how far back the in-memory report histories go
+func (c *ServerConfig) HistoryWindow() time.Duration {
+	if c.HistoryHours <= 0 {
+		return defaultHistoryHours * time.Hour
+	}
+	return time.Duration(c.HistoryHours) * time.Hour
+}
+
+// Get the most reports to keep in memory for each node
+func (c *ServerConfig) HistoryLimit() int {
+	if c.HistoryMaxReports <= 0 {
+		return defaultHistoryMaxReports
+	}
+	return c.HistoryMaxReports
+}
+
+// Look up the configured name for a node ID (empty if not configured)
+func nodeName(node string) string {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	switch node {
+	case "1":
+		return cfg.Node1
+	case "2":
+		return cfg.Node2
+	case "3":
+		return cfg.Node3
+	}
+	return ""
+}
+
+// Look up the configured chart color for a node ID (empty if not configured)
+func nodeColor(node string) string {
+	cfgMu.RLock()
+	defer cfgMu.RUnlock()
+	return cfg.NodeColors[node]
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Write a config file in a temp dir and return its path
+func writeTestConfig(t *testing.T, dir string, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Send log output to a buffer for the rest of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestReadServerConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data string
+		want string // Error after the path
+	}{
+		{"unknown setting",
+			"{\n  \"node1\": \"A\",\n  \"nod2\": \"B\"\n}",
+			`:3:3: unknown setting "nod2"`},
+		{"unknown nested setting",
+			"{\n  \"mqtt\": {\"brokr\": \"tcp://x:1883\"}\n}",
+			`:2:12: unknown setting "brokr"`},
+		{"missing comma",
+			"{\n  \"node1\": \"A\"\n  \"node2\": \"B\"\n}",
+			`:3:3: invalid character '"' after object key:value pair`},
+		{"wrong type",
+			"{\n  \"history_hours\": \"36\"\n}",
+			`:2:23: history_hours: expected int, got JSON string`},
+		{"unexpected end",
+			"{\n  \"node1\": \"A\",\n",
+			`:3:1: unexpected end of file (missing } or ]?)`},
+		{"trailing data",
+			"{\n  \"node1\": \"A\"\n}\n}\n",
+			`:4:1: unexpected data after the closing }`},
+	}
+	for _, tt := range tests {
+		path := writeTestConfig(t, dir, tt.data)
+		_, err := ReadServerConfig(path)
+		if err == nil || err.Error() != path+tt.want {
+			t.Errorf("%s: got error %v, want %s%s", tt.name, err, path,
+				tt.want)
+		}
+	}
+}
+
+func TestReloadServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestConfig(t, dir, `{
+  "node1": "Porch",
+  "node_colors": {"1": "red"},
+  "web_addr": "127.0.0.1:8080",
+  "chart_interval": 300
+}`)
+	c, err := ReadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestConfig(t, *c)
+	old := histories
+	histories = NewHistoryStore(nil)
+	t.Cleanup(func() { histories = old })
+	logs := captureLog(t)
+
+	// Names and colors change right away, and the restart-only settings
+	// get reported but left alone
+	writeTestConfig(t, dir, `{
+  "node1": "Back Porch",
+  "node_colors": {"1": "teal"},
+  "web_addr": "127.0.0.1:9090",
+  "chart_interval": 600
+}`)
+	next, err := ReadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChanged := []string{"chart_interval", "web_addr"}
+	if got := cfg.restartSettings(next); !slices.Equal(got, wantChanged) {
+		t.Errorf("got restart settings %q, want %q", got, wantChanged)
+	}
+	var wg sync.WaitGroup
+	reloadServerConfig(context.Background(), &wg, path, nil)
+	wg.Wait()
+	if got := nodeName("1"); got != "Back Porch" {
+		t.Errorf("got node 1 name %q", got)
+	}
+	if got := nodeColor("1"); got != "teal" {
+		t.Errorf("got node 1 color %q", got)
+	}
+	if cfg.WebAddr != "127.0.0.1:8080" || cfg.ChartInterval != 300 {
+		t.Errorf("restart-only settings changed: web_addr %q, "+
+			"chart_interval %d", cfg.WebAddr, cfg.ChartInterval)
+	}
+	want := "restart to apply changes to: chart_interval, web_addr"
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("log is missing %q:\n%s", want, logs)
+	}
+
+	// A config with errors leaves the old one in effect
+	writeTestConfig(t, dir, `{"node1": "Shed",}`)
+	reloadServerConfig(context.Background(), &wg, path, nil)
+	if got := nodeName("1"); got != "Back Porch" {
+		t.Errorf("after bad reload, got node 1 name %q", got)
+	}
+	if !strings.Contains(logs.String(), "keeping old config") {
+		t.Errorf("log is missing the reload failure:\n%s", logs)
+	}
+}
@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// Derived metrics get worked out from the measured temperature and relative
+// humidity of each report whenever they're needed, rather than stored, so
+// they're always available for whatever reports the history has (including
+// past days loaded from the CSV logs). Growing degree days come from the
+// daily temperature ranges of each node.
+
+// Names of measured and derived metrics, as used by the API and the chart
+const (
+	metricTempF      = "temp_f"       // Temperature °F
+	metricHumidity   = "humidity"     // Relative humidity %
+	metricDewPointF  = "dew_point_f"  // Dew point °F
+	metricHeatIndexF = "heat_index_f" // Heat index (apparent temperature) °F
+	metricVPDkPa     = "vpd_kpa"      // Vapor pressure deficit kPa
+)
+
+// Get a measured or derived metric of a report by name. Returns NaN if the
+// report doesn't have what it takes (like humidity) or the name is unknown.
+func (r Report) Metric(name string) float64 {
+	switch name {
+	case metricTempF:
+		return r.TempF
+	case metricHumidity:
+		return r.Humidity
+	case metricDewPointF:
+		return DewPointF(r.TempF, r.Humidity)
+	case metricHeatIndexF:
+		return HeatIndexF(r.TempF, r.Humidity)
+	case metricVPDkPa:
+		return VPDkPa(r.TempF, r.Humidity)
+	}
+	return math.NaN()
+}
+
+// Does the report have a relative humidity?
+func (r Report) HasHumidity() bool {
+	return !math.IsNaN(r.Humidity)
+}
+
+func fToC(tempF float64) float64 {
+	return (tempF - 32) * 5 / 9
+}
+
+func cToF(tempC float64) float64 {
+	return tempC*9/5 + 32
+}
+
+// Calculate the dew point from temperature and relative humidity %, using
+// the Magnus formula with the Alduchov and Eskridge (1996) coefficients.
+// Returns NaN if rh is NaN or not more than 0.
+func DewPointF(tempF, rh float64) float64 {
+	if !(rh > 0) {
+		return math.NaN()
+	}
+	const a, b = 17.625, 243.04
+	tempC := fToC(tempF)
+	gamma := math.Log(min(rh, 100)/100) + a*tempC/(b+tempC)
+	return cToF(b * gamma / (a - gamma))
+}
+
+// Calculate the heat index from temperature and relative humidity %, the
+// way the US National Weather Service does (Steadman's simple formula, or
+// the Rothfusz regression with adjustments when it's 80°F or more). Returns
+// NaN if rh is NaN.
+func HeatIndexF(tempF, rh float64) float64 {
+	if math.IsNaN(rh) {
+		return math.NaN()
+	}
+	t := tempF
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 < 80 {
+		return hi
+	}
+	hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+		0.00683783*t*t - 0.05481717*rh*rh + 0.00122874*t*t*rh +
+		0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+	switch {
+	case rh < 13 && t >= 80 && t <= 112:
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	case rh > 85 && t >= 80 && t <= 87:
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+	return hi
+}
+
+// Calculate the vapor pressure deficit in kPa from temperature and relative
+// humidity %, using the Tetens formula for saturation vapor pressure.
+// Returns NaN if rh is NaN.
+func VPDkPa(tempF, rh float64) float64 {
+	if math.IsNaN(rh) {
+		return math.NaN()
+	}
+	tempC := fToC(tempF)
+	saturation := 0.6108 * math.Exp(17.27*tempC/(tempC+237.3))
+	return saturation * (1 - max(0, min(rh, 100))/100)
+}
+
+// Default growing degree day settings (the usual ones for corn and many
+// vegetables)
+const (
+	defaultGDDBaseF = 50
+	defaultGDDCapF  = 86
+	defaultGDDStart = "01-01"
+)
+
+// Most days of daily temperature ranges kept per node (a bit over a year)
+const maxDailyRanges = 400
+
+// Settings for growing degree days
+type GDDConfig struct {
+	BaseF float64 `json:"base_f"` // Base temperature (default 50)
+	CapF  float64 `json:"cap_f"`  // Cap on highs and lows (default 86)
+	Start string  `json:"start"`  // Season start, like "03-15" (Jan 1)
+
+	month time.Month // Parsed from Start
+	day   int
+}
+
+// Check growing degree day settings and fill in defaults
+func (c *GDDConfig) Prepare() error {
+	if c.BaseF == 0 {
+		c.BaseF = defaultGDDBaseF
+	}
+	if c.CapF == 0 {
+		c.CapF = defaultGDDCapF
+	}
+	if c.CapF <= c.BaseF {
+		return fmt.Errorf("cap_f must be more than base_f")
+	}
+	if c.Start == "" {
+		c.Start = defaultGDDStart
+	}
+	// Parse in a leap year so "02-29" works
+	t, err := time.Parse("2006-01-02", "2024-"+c.Start)
+	if err != nil {
+		return fmt.Errorf("start: expected a month and day like 03-15, "+
+			"got %q", c.Start)
+	}
+	c.month, c.day = t.Month(), t.Day()
+	return nil
+}
+
+// Get the start (local midnight) of the growing season that time `t` is in
+func (c *GDDConfig) SeasonStart(t time.Time) time.Time {
+	month, day := c.month, c.day
+	if month == 0 {
+		month, day = time.January, 1
+	}
+	loc := cfg.Location()
+	t = t.In(loc)
+	start := time.Date(t.Year(), month, day, 0, 0, 0, 0, loc)
+	if start.After(t) {
+		start = time.Date(t.Year()-1, month, day, 0, 0, 0, 0, loc)
+	}
+	return start
+}
+
+// Calculate growing degree days for one day from its low and high, with
+// both clamped between the base and the cap (the modified average method)
+func (c *GDDConfig) DegreeDays(minTempF, maxTempF float64) float64 {
+	base, limit := c.BaseF, c.CapF
+	if base == 0 && limit == 0 {
+		base, limit = defaultGDDBaseF, defaultGDDCapF
+	}
+	low := max(base, min(limit, minTempF))
+	high := max(base, min(limit, maxTempF))
+	return (low+high)/2 - base
+}
+
+// Temperature range of a node for one local day
+type DayRange struct {
+	Date     time.Time // Local midnight at the start of the day
+	MinTempF float64
+	MaxTempF float64
+}
+
+// Include a report in the temperature range for its local day. Reports
+// usually arrive in order, so that's quick, but older ones (like from
+// backfilling the growing season from the CSV logs) work too.
+func (h *ReportHistory) addDay(timestamp time.Time, tempF float64) {
+	if n := len(h.Days); n > 0 && !timestamp.Before(h.Days[n-1].Date) &&
+		timestamp.Before(h.dayEnd) {
+
+		d := &h.Days[n-1]
+		d.MinTempF = min(d.MinTempF, tempF)
+		d.MaxTempF = max(d.MaxTempF, tempF)
+		return
+	}
+	date := localDayStart(timestamp)
+	i, found := slices.BinarySearchFunc(h.Days, date,
+		func(d DayRange, t time.Time) int { return d.Date.Compare(t) })
+	if found {
+		h.Days[i].MinTempF = min(h.Days[i].MinTempF, tempF)
+		h.Days[i].MaxTempF = max(h.Days[i].MaxTempF, tempF)
+		return
+	}
+	h.Days = slices.Insert(h.Days, i,
+		DayRange{Date: date, MinTempF: tempF, MaxTempF: tempF})
+	if i == len(h.Days)-1 {
+		h.dayEnd = date.AddDate(0, 0, 1)
+	}
+	if n := len(h.Days) - maxDailyRanges; n > 0 {
+		h.Days = slices.Delete(h.Days, 0, n)
+	}
+}
+
+// Get the growing degree days since the start of the growing season,
+// counting today so far. Days with no reports count as 0.
+func (h *ReportHistory) GrowingDegreeDays() float64 {
+	start := cfg.GDD.SeasonStart(clock.Now())
+	total := 0.0
+	for _, d := range h.Days {
+		if !d.Date.Before(start) {
+			total += cfg.GDD.DegreeDays(d.MinTempF, d.MaxTempF)
+		}
+	}
+	return total
+}
+
+// Chart vertical axis for a metric
+type chartAxis struct {
+	min, max, step float64
+	label          string // Format for the labels, like "%.0f°F"
+}
+
+// Axes for the metrics the chart can show
+var chartAxes = map[string]chartAxis{
+	metricTempF:      {0, 110, 10, "%.0f°F"},
+	metricHumidity:   {0, 100, 10, "%.0f%%"},
+	metricDewPointF:  {0, 110, 10, "%.0f°F"},
+	metricHeatIndexF: {0, 130, 10, "%.0f°F"},
+	metricVPDkPa:     {0, 4, 0.5, "%.1f kPa"},
+}
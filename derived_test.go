@@ -0,0 +1,453 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDerivedMetrics(t *testing.T) {
+	near := func(got, want, tolerance float64) bool {
+		return math.Abs(got-want) <= tolerance
+	}
+	tests := []struct {
+		name           string
+		got, want, tol float64
+	}{
+		// 25°C at 50% has a dew point of 13.9°C
+		{"dew point 77F 50%", DewPointF(77, 50), 56.9, 0.1},
+		{"dew point 60F 100%", DewPointF(60, 100), 60, 1e-9},
+		// From the NWS heat index chart
+		{"heat index 90F 70%", HeatIndexF(90, 70), 106, 0.5},
+		{"heat index 100F 40%", HeatIndexF(100, 40), 109, 0.5},
+		{"heat index 70F 50%", HeatIndexF(70, 50), 69.05, 1e-9},
+		// Saturation vapor pressure at 25°C is 3.17 kPa
+		{"vpd 77F 50%", VPDkPa(77, 50), 1.58, 0.01},
+		{"vpd 77F 100%", VPDkPa(77, 100), 0, 1e-9},
+	}
+	for _, tt := range tests {
+		if !near(tt.got, tt.want, tt.tol) {
+			t.Errorf("%s: got %.3f, want %.3f", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Without humidity, there are no derived metrics
+	r := Report{TempF: 70, Humidity: math.NaN()}
+	for _, m := range []string{metricHumidity, metricDewPointF,
+		metricHeatIndexF, metricVPDkPa, "bogus"} {
+		if v := r.Metric(m); !math.IsNaN(v) {
+			t.Errorf("%s without humidity: got %v, want NaN", m, v)
+		}
+	}
+	if r.Metric(metricTempF) != 70 || r.HasHumidity() {
+		t.Errorf("temp_f without humidity: got %v", r.Metric(metricTempF))
+	}
+}
+
+func TestGDDConfig(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "America/Chicago",
+		GDD: GDDConfig{Start: "03-15"}})
+	c := &cfg.GDD
+	if c.BaseF != 50 || c.CapF != 86 {
+		t.Errorf("got base/cap %v/%v, want 50/86", c.BaseF, c.CapF)
+	}
+	tests := []struct{ low, high, want float64 }{
+		{40, 70, 10}, // Low raised to the base
+		{60, 95, 23}, // High capped
+		{30, 45, 0},  // Too cold to grow
+		{88, 99, 36}, // Both capped
+	}
+	for _, tt := range tests {
+		if got := c.DegreeDays(tt.low, tt.high); got != tt.want {
+			t.Errorf("DegreeDays(%v, %v) = %v, want %v", tt.low, tt.high,
+				got, tt.want)
+		}
+	}
+
+	// The season starts at local midnight on the most recent start date
+	for _, tt := range []struct{ t, want string }{
+		{"2025-03-15T04:59:00Z", "2024-03-15T00:00:00-05:00"},
+		{"2025-03-15T05:00:00Z", "2025-03-15T00:00:00-05:00"},
+		{"2025-11-17T12:00:00Z", "2025-03-15T00:00:00-05:00"},
+	} {
+		got := c.SeasonStart(mustTime(t, tt.t))
+		if want := mustTime(t, tt.want); !got.Equal(want) {
+			t.Errorf("SeasonStart(%s) = %v, want %v", tt.t, got, want)
+		}
+	}
+
+	for _, bad := range []GDDConfig{{Start: "13-01"}, {Start: "March 15"},
+		{BaseF: 60, CapF: 55}} {
+		if err := bad.Prepare(); err == nil {
+			t.Errorf("%+v didn't fail", bad)
+		}
+	}
+}
+
+func TestGrowingDegreeDays(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC",
+		GDD: GDDConfig{Start: "11-01"}})
+	now := mustTime(t, "2025-11-03T18:00:00Z")
+	useFakeClock(t, now)
+
+	h := &ReportHistory{}
+	day := func(d int, hour int) time.Time {
+		return time.Date(2025, 11, d, hour, 0, 0, 0, time.UTC)
+	}
+	// Before the season, then two full days and part of today
+	h.Add(day(1, 0).Add(-time.Hour), 3.8, 90)
+	h.Add(day(1, 6), 3.8, 40)
+	h.Add(day(1, 15), 3.8, 70)
+	h.Add(day(2, 6), 3.8, 60)
+	h.Add(day(2, 15), 3.8, 80)
+	h.Add(day(3, 6), 3.8, 55)
+	h.Add(day(3, 15), 3.8, 65)
+	// A late report from the first day (like from backfilling) fits in
+	h.addDay(day(1, 12), 72)
+
+	if len(h.Days) != 4 {
+		t.Fatalf("got %d days, want 4", len(h.Days))
+	}
+	if d := h.Days[1]; !d.Date.Equal(day(1, 0)) || d.MinTempF != 40 ||
+		d.MaxTempF != 72 {
+		t.Errorf("got first day %+v", d)
+	}
+	// (50+72)/2-50 + (60+80)/2-50 + (55+65)/2-50
+	if got := h.GrowingDegreeDays(); got != 11+20+10 {
+		t.Errorf("got %v GDD, want 41", got)
+	}
+
+	// Clones have their own days
+	c := h.Clone()
+	h.Add(now, 3.8, 85)
+	if c.Days[3].MaxTempF != 65 {
+		t.Errorf("clone changed when the original did")
+	}
+}
+
+func TestLoadSeasonDays(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{LogDir: dir, Timezone: "UTC",
+		GDD: GDDConfig{Start: "11-10"}})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	fake := useFakeClock(t, now)
+
+	// Logs from before the season, in the season, and recently
+	logFile := CurrentLogFile{}
+	for _, sd := range []SensorData{
+		{Timestamp: mustTime(t, "2025-11-09T12:00:00Z"), TempF: 90},
+		{Timestamp: mustTime(t, "2025-11-10T12:00:00Z"), TempF: 70},
+		{Timestamp: mustTime(t, "2025-11-12T12:00:00Z"), TempF: 60},
+		{Timestamp: mustTime(t, "2025-11-17T06:00:00Z"), TempF: 64},
+	} {
+		sd.Node, sd.BatteryV = "1", 3.8
+		fake.Set(sd.Timestamp)
+		if err := logFile.WriteReport(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logFile.Close()
+	fake.Set(now)
+
+	// The history loader already has today, so that doesn't get read again
+	histories := NodeHistories{}
+	LoadSeasonDays(histories, 1)
+	h := histories["1"]
+	if h == nil || len(h.Days) != 2 || len(h.Reports) != 0 {
+		t.Fatalf("got %+v", h)
+	}
+	// One report a day, so each day's low and high are the same
+	if got := h.GrowingDegreeDays(); got != 20+10 {
+		t.Errorf("got %v GDD, want 30", got)
+	}
+
+	// Without CSV storage, the days come from the store or SQLite database
+	days, err := listSensorLogDays(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := []SensorData{}
+	for _, day := range days {
+		r, err := readSensorLogDay(dir, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, r...)
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.csv"))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	cfg.Storage = []string{storageSQLite}
+	t.Cleanup(func() { sensorStore, sqliteDB = nil, nil })
+	store, err := OpenStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, sd := range reports {
+		if err := store.Add(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkDays := func(source string) {
+		t.Helper()
+		histories := NodeHistories{}
+		LoadSeasonDays(histories, 1)
+		h := histories["1"]
+		if h == nil || len(h.Days) != 2 {
+			t.Fatalf("%s: got %+v", source, h)
+		}
+		if got := h.GrowingDegreeDays(); got != 20+10 {
+			t.Errorf("%s: got %v GDD, want 30", source, got)
+		}
+	}
+	sensorStore = store
+	checkDays("store")
+
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 CLI not installed")
+	}
+	if sqliteDB, err = OpenSQLite(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqliteDB.Insert(reports); err != nil {
+		t.Fatal(err)
+	}
+	checkDays("SQLite")
+}
+
+func TestHumidityRestart(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{LogDir: dir})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	useFakeClock(t, now)
+	rh := 50.0
+	reports := []SensorData{
+		{Timestamp: now.Add(-time.Hour), Node: "1", RSSI: "-60", SNR: "1.0",
+			BatteryV: 3.8, TempF: 70},
+		{Timestamp: now, Node: "1", RSSI: "-60", SNR: "1.0", BatteryV: 3.8,
+			TempF: 77, Humidity: &rh},
+	}
+	// The derived metrics of the latest report after loading the histories
+	check := func(source string, histories NodeHistories) {
+		t.Helper()
+		h := histories["1"]
+		if h == nil || len(h.Reports) != 2 {
+			t.Fatalf("%s: got %+v", source, h)
+		}
+		if h.Reports[0].HasHumidity() {
+			t.Errorf("%s: got humidity %v for a report without it", source,
+				h.Reports[0].Humidity)
+		}
+		r := h.Reports[1]
+		for _, m := range []string{metricHumidity, metricDewPointF,
+			metricHeatIndexF, metricVPDkPa} {
+			want := reports[1].Report().Metric(m)
+			if got := r.Metric(m); got != want {
+				t.Errorf("%s: got %s %v, want %v", source, m, got, want)
+			}
+		}
+	}
+
+	storeDir := filepath.Join(dir, "store")
+	store, err := OpenStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sd := range reports {
+		if err := store.Add(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+	store, err = OpenStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	histories, err := store.LoadHistories(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("store", histories)
+	store.Close()
+
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 CLI not installed")
+	}
+	dbPath := filepath.Join(dir, "test.db")
+	db, err := OpenSQLite(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert(reports); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenSQLite(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	histories, err = db.LoadHistories(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("SQLite", histories)
+
+	// Upgrading a database from before humidity gets it from the CSV logs
+	_, err = db.run("DELETE FROM measurements WHERE name = 'humidity';\n" +
+		"PRAGMA user_version = 0;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile := CurrentLogFile{}
+	for _, sd := range reports {
+		if err := logFile.WriteReport(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logFile.Close()
+	if db, err = OpenSQLite(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	histories, err = db.LoadHistories(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("upgraded SQLite", histories)
+}
+
+func TestStoreMigration(t *testing.T) {
+	// A version 1 store, from before humidity, with two nodes
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	useFakeClock(t, now)
+	rawDir := filepath.Join(dir, "raw")
+	if err := os.MkdirAll(rawDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []string{"1", "2"} {
+		var old []byte
+		for i, tempF := range []float64{64, 65} {
+			ts := now.Add(time.Duration(i-2) * time.Hour).UnixMilli()
+			old = binary.LittleEndian.AppendUint64(old, uint64(ts))
+			for _, v := range []float64{tempF, 3.8, -60, 1} {
+				old = binary.LittleEndian.AppendUint64(old,
+					math.Float64bits(v))
+			}
+		}
+		path := filepath.Join(rawDir, storeFileName(node))
+		if err := os.WriteFile(path, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An upgrade that stopped after widening node 1's file
+	path := filepath.Join(rawDir, storeFileName("1"))
+	if err := widenStoreRecords(path, path+"2", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Finishing the upgrade, then opening the store again, leaves both
+	// nodes' records right
+	for try := range 2 {
+		store, err := OpenStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, node := range []string{"1", "2"} {
+			samples, err := store.QueryRaw(node, now.Add(-24*time.Hour), now)
+			if err != nil || len(samples) != 2 {
+				t.Fatalf("open %d node %s: got %v, %v", try, node, samples,
+					err)
+			}
+			s := samples[1]
+			if s.Values[0] != 65 || s.Values[3] != 1 ||
+				!math.IsNaN(s.Values[4]) {
+				t.Errorf("open %d node %s: got values %v", try, node,
+					s.Values)
+			}
+			rollups, err := store.QueryRollups(node, "1h",
+				now.Add(-24*time.Hour), now)
+			if err != nil || len(rollups) != 2 ||
+				rollups[0].Stats[0].Max != 64 {
+				t.Errorf("open %d node %s: got rollups %+v, %v", try, node,
+					rollups, err)
+			}
+		}
+		store.Close()
+	}
+	buf, _ := os.ReadFile(filepath.Join(dir, "version"))
+	if string(buf) != "2\n" {
+		t.Errorf("got version %q, want 2", buf)
+	}
+	leftover, _ := filepath.Glob(filepath.Join(rawDir, "*.dat?*"))
+	if len(leftover) > 0 {
+		t.Errorf("got leftover files %v", leftover)
+	}
+}
+
+func TestMetricChartDays(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{LogDir: dir})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	useFakeClock(t, now)
+	store, err := OpenStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// Node 1 has humidity and node 2 doesn't, so node 2 has no dew points
+	for i := range 48 {
+		rh := 40 + float64(i)
+		ts := now.Add(time.Duration(i-48)*time.Hour + time.Minute)
+		for _, sd := range []SensorData{
+			{Timestamp: ts, Node: "1", RSSI: "-60", SNR: "1.0",
+				BatteryV: 3.8, TempF: 50 + float64(i%24), Humidity: &rh},
+			{Timestamp: ts, Node: "2", RSSI: "-60", SNR: "1.0",
+				BatteryV: 3.8, TempF: 60},
+		} {
+			if err := store.Add(sd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// With one report in each 5 minute bucket, the bucket means are the
+	// stored values
+	samples, err := store.QueryRaw("1", now.Add(-72*time.Hour),
+		now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var points []chartPoint
+	for _, s := range samples {
+		points = append(points, chartPoint{
+			Timestamp: s.Time.Truncate(5 * time.Minute),
+			Value:     s.Report().Metric(metricDewPointF),
+		})
+	}
+	want, err := renderChart(map[string][]chartPoint{"1": points}, now,
+		72*time.Hour, chartAxes[metricDewPointF])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := GenerateMetricChartDays(store, 3, metricDewPointF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 48 || !bytes.Equal(got, want) {
+		t.Errorf("dew point chart of %d points differs from expected",
+			len(points))
+	}
+
+	if _, err := GenerateMetricChartDays(store, 3, "bogus"); err == nil {
+		t.Error("got no error for an unknown metric")
+	}
+}
@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// How long tests wait for something to happen before failing
+const testTimeout = 5 * time.Second
+
+// Use a manual clock set to `now` for the rest of the test
+func useFakeClock(t testing.TB, now time.Time) *ManualClock {
+	c := NewManualClock(now)
+	old := clock
+	clock = c
+	t.Cleanup(func() { clock = old })
+	return c
+}
+
+// Use `c` (with defaults filled in) as the global config for the rest of the
+// test
+func useTestConfig(t testing.TB, c ServerConfig) {
+	t.Helper()
+	if err := c.prepare(); err != nil {
+		t.Fatalf("test config: %v", err)
+	}
+	old := cfg
+	cfg = c
+	t.Cleanup(func() { cfg = old })
+}
+
+// Parse a time in RFC 3339 format or fail the test
+func mustTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// In-process IRC server that lets a test script both sides of the
+// conversation with an IRCBot
+type fakeIRCServer struct {
+	ln    net.Listener
+	conns chan *fakeIRCConn
+
+	mu   sync.Mutex
+	open []net.Conn // Connections to close at the end of the test
+}
+
+// One client connection to the fake IRC server
+type fakeIRCConn struct {
+	conn  net.Conn
+	lines chan string // Lines received from the client
+}
+
+// Start a fake IRC server on a free localhost port
+func newFakeIRCServer(t *testing.T) *fakeIRCServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeIRCServer{ln: ln, conns: make(chan *fakeIRCConn, 4)}
+	t.Cleanup(func() {
+		ln.Close()
+		s.mu.Lock()
+		for _, conn := range s.open {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.open = append(s.open, conn)
+			s.mu.Unlock()
+			c := &fakeIRCConn{conn: conn, lines: make(chan string, 64)}
+			go func() {
+				defer close(c.lines)
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					c.lines <- scanner.Text()
+				}
+			}()
+			s.conns <- c
+		}
+	}()
+	return s
+}
+
+// Server address for IRCTarget.Server
+func (s *fakeIRCServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Wait for the bot to connect
+func (s *fakeIRCServer) Accept(t *testing.T) *fakeIRCConn {
+	t.Helper()
+	select {
+	case c := <-s.conns:
+		return c
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for IRC connection")
+		return nil
+	}
+}
+
+// Check that the next line from the client is `want`
+func (c *fakeIRCConn) Expect(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got, ok := <-c.lines:
+		if !ok {
+			t.Fatalf("connection closed while waiting for %q", want)
+		}
+		if got != want {
+			t.Fatalf("got line %q, want %q", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %q", want)
+	}
+}
+
+// Send lines to the client
+func (c *fakeIRCConn) Send(t *testing.T, lines ...string) {
+	t.Helper()
+	text := strings.Join(lines, "\r\n") + "\r\n"
+	if _, err := c.conn.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,16 +4,203 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
+// Default minimum time between sends if config.json doesn't set an interval
+const (
+	defaultTopicInterval   = 30 * time.Second
+	defaultMessageInterval = 2 * time.Second
+)
+
+// Delay before connecting to an IRC server, which is also the starting delay
+// for reconnect backoff (tests make this shorter)
+var ircConnectDelay = 3 * time.Second
+
+// IRC target modes for how messages get delivered to channels
+const (
+	ircModeTopic   = "topic"
+	ircModeMessage = "privmsg"
+	ircModeNotice  = "notice"
+)
+
+// Settings for one IRC output target loaded from the "irc" list in
+// config.json. Each target gets its own IRCBot goroutine and connection.
+type IRCTarget struct {
+	Server   string   `json:"server"`   // IRC server "host:port"
+	Nick     string   `json:"nick"`     // Nick for this target's connection
+	Channels []string `json:"channels"` // Channels to join and send to
+	Mode     string   `json:"mode"`     // "topic", "privmsg", or "notice"
+	Template string   `json:"template"` // Go text/template for messages
+	Nodes    []string `json:"nodes"`    // Node IDs to send for (empty=all)
+	Interval int      `json:"interval"` // Minimum seconds between sends
+	Window   string   `json:"window"`   // Window for min/max (see windows)
+
+	tmpl *template.Template // Parsed version of Template
+}
+
+// Data available to IRC message templates
+type ircTemplateData struct {
+	Summary  string  // Multi-node summary from FormatReportSummary()
+	Node     string  // Node ID for the report that triggered this message
+	Name     string  // Configured name of the node (e.g. from "node1")
+	TempF    float64 // Most recent temperature
+	BatteryV float64 // Most recent battery voltage
+	Window   string  // Name of the target's window (e.g. "36h" or "today")
+	MinTempF float64 // Rolling minimum temperature over the window
+	MaxTempF float64 // Rolling maximum temperature over the window
+	Time     string  // Local time of most recent report (e.g. "17Nov 23:43")
+	// Minimum and maximum temperature since local midnight
+	TodayMinTempF float64
+	TodayMaxTempF float64
+	// Rolling mean, standard deviation, and median temperature over the
+	// window, and the change in °F per hour over the last hour
+	MeanTempF    float64
+	StdDevTempF  float64
+	MedianTempF  float64
+	RateFPerHour float64
+	// Statistics for every window by name, for templates like
+	// {{(index .Windows "1h").MaxTempF}}
+	Windows map[string]WindowStats
+	// Most recent humidity and the metrics derived from it (0 if the node
+	// doesn't report humidity)
+	HasHumidity bool
+	Humidity    float64
+	DewPointF   float64
+	HeatIndexF  float64
+	VPDkPa      float64
+	// Growing degree days since the start of the season
+	GDD float64
+}
+
+// Check target settings, fill in defaults, and parse the message template
+func (t *IRCTarget) Prepare() error {
+	if t.Server == "" || t.Nick == "" || len(t.Channels) == 0 {
+		return fmt.Errorf("irc target needs server, nick, and channels")
+	}
+	switch t.Mode {
+	case "":
+		t.Mode = ircModeTopic
+	case ircModeTopic, ircModeMessage, ircModeNotice:
+	default:
+		return fmt.Errorf("irc target %s: unknown mode %q", t.Server, t.Mode)
+	}
+	text := t.Template
+	if text == "" {
+		text = "{{.Summary}}"
+	}
+	tmpl, err := template.New(t.Server).Parse(text)
+	if err != nil {
+		return fmt.Errorf("irc target %s: %v", t.Server, err)
+	}
+	t.tmpl = tmpl
+	return nil
+}
+
+// Does this target want messages about the given node?
+func (t *IRCTarget) wantsNode(node string) bool {
+	if len(t.Nodes) == 0 {
+		return true
+	}
+	for _, n := range t.Nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Render this target's message for a new report from `node`. Returns ok=false
+// if the node is filtered out. An empty node means render a summary of the
+// most recent report from the target's nodes (used at startup), which is only
+// done for topic targets to avoid repeating old messages after a restart.
+func (t *IRCTarget) Format(histories NodeHistories, node string) (
+	msg string, ok bool) {
+
+	if node == "" {
+		if t.Mode != ircModeTopic {
+			return "", false
+		}
+		var latest time.Time
+		for id, h := range histories {
+			if !t.wantsNode(id) || len(h.Reports) == 0 {
+				continue
+			}
+			ts := h.Reports[len(h.Reports)-1].Timestamp
+			if node == "" || ts.After(latest) {
+				node = id
+				latest = ts
+			}
+		}
+		if node == "" {
+			return "", false
+		}
+	} else if !t.wantsNode(node) {
+		return "", false
+	}
+
+	window := t.Window
+	if window == "" {
+		window = cfg.SummaryWindow
+	}
+	data := ircTemplateData{
+		Summary: FormatReportSummary(histories, window),
+		Node:    node,
+		Name:    nodeName(node),
+		Window:  window,
+		Windows: map[string]WindowStats{},
+	}
+	if h, exists := histories[node]; exists && len(h.Reports) > 0 {
+		last := h.Reports[len(h.Reports)-1]
+		data.TempF = last.TempF
+		data.BatteryV = last.BatteryV
+		if w := h.Window(window); w != nil {
+			data.MinTempF = w.MinTempF
+			data.MaxTempF = w.MaxTempF
+			data.MeanTempF = w.MeanTempF
+			data.StdDevTempF = w.StdDevTempF
+			data.MedianTempF = w.PercentileTempF(50)
+		}
+		data.TodayMinTempF = h.TodayMinTempF
+		data.TodayMaxTempF = h.TodayMaxTempF
+		data.RateFPerHour = h.RateFPerHour
+		data.GDD = h.GrowingDegreeDays()
+		if last.HasHumidity() {
+			data.HasHumidity = true
+			data.Humidity = last.Humidity
+			data.DewPointF = last.Metric(metricDewPointF)
+			data.HeatIndexF = last.Metric(metricHeatIndexF)
+			data.VPDkPa = last.Metric(metricVPDkPa)
+		}
+		for _, w := range h.Windows {
+			data.Windows[w.Name] = w
+		}
+		data.Time = last.Timestamp.In(cfg.Location()).Format("02Jan 15:04")
+	}
+
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		log.Printf("WARN: IRC template for %s: %v", t.Server, err)
+		return "", false
+	}
+	// IRC messages are single lines, so don't let a template break that
+	msg = strings.ReplaceAll(buf.String(), "\n", " ")
+	msg = strings.ReplaceAll(msg, "\r", "")
+	return msg, msg != ""
+}
+
 // Send string to IRC server.
 func ircSend(conn net.Conn, msg string) error {
 	_, err := conn.Write([]byte(msg + "\r\n"))
@@ -23,6 +210,7 @@ func ircSend(conn net.Conn, msg string) error {
 	return err
 }
 
+// Compute next connection retry delay with randomized exponential backoff
 func ircNextBackoff(delay, max time.Duration) time.Duration {
 	// Increase current delay by 0.5 to 1.5 of its current value
 	delay += time.Duration(float64(delay) * (0.5 + rand.Float64()))
@@ -32,8 +220,169 @@ func ircNextBackoff(delay, max time.Duration) time.Duration {
 	return max
 }
 
-// Forward messages from input channel to the configured IRC server
-func IRCBot(ctx context.Context, cfg *ServerConfig, in <-chan string) {
+// Coalescing TOPIC sender. Only the most recent requested topic gets sent
+// (latest value wins), topics matching the channel's current topic are
+// skipped, and TOPIC commands are spaced at least `interval` apart to stay
+// under the IRC server's flood protection limits.
+type topicThrottle struct {
+	interval time.Duration
+	pending  string    // Most recent topic requested by the input channel
+	current  string    // Channel topic as last sent or reported by server
+	lastSent time.Time // When we last sent a TOPIC command
+}
+
+// Remember a new topic to be sent when allowed (replaces any pending topic)
+func (t *topicThrottle) Set(topic string) {
+	t.pending = topic
+}
+
+// Check whether the pending topic needs sending. Returns ok=false when there
+// is nothing new to send, otherwise returns how long to wait before sending.
+func (t *topicThrottle) Due(now time.Time) (wait time.Duration, ok bool) {
+	if t.pending == "" || t.pending == t.current {
+		return 0, false
+	}
+	wait = t.lastSent.Add(t.interval).Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// Record that a topic was sent to the server
+func (t *topicThrottle) Sent(topic string, now time.Time) {
+	t.current = topic
+	t.lastSent = now
+}
+
+// Forget the channel's current topic (e.g. after reconnecting)
+func (t *topicThrottle) Reset() {
+	t.current = ""
+}
+
+// Rate limited FIFO queue for PRIVMSG and NOTICE targets. Messages are spaced
+// at least `interval` apart. If messages arrive faster than they can be sent,
+// the oldest queued messages get dropped.
+type messageQueue struct {
+	interval time.Duration
+	max      int       // Maximum number of queued messages
+	pending  []string  // Messages waiting to be sent, oldest first
+	lastSent time.Time // When we last sent a message
+}
+
+// Add a message to the queue, dropping the oldest message if queue is full
+func (q *messageQueue) Push(msg string) {
+	if msg == "" {
+		return
+	}
+	if len(q.pending) >= q.max {
+		log.Printf("WARN: IRC message queue full, dropping: %s", q.pending[0])
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, msg)
+}
+
+// Check whether a queued message needs sending. Returns ok=false when the
+// queue is empty, otherwise returns how long to wait before sending.
+func (q *messageQueue) Due(now time.Time) (wait time.Duration, ok bool) {
+	if len(q.pending) == 0 {
+		return 0, false
+	}
+	wait = q.lastSent.Add(q.interval).Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// Remove the oldest queued message and record it as sent
+func (q *messageQueue) Pop(now time.Time) string {
+	msg := q.pending[0]
+	q.pending = q.pending[1:]
+	q.lastSent = now
+	return msg
+}
+
+// Running IRCBot goroutine for one IRC target
+type ircBot struct {
+	target *IRCTarget          // Settings for rendering messages
+	queue  *EventQueue[string] // Messages waiting for the goroutine
+	cancel context.CancelFunc
+}
+
+// Start an IRCBot goroutine for a target, tracked by `wg`. Canceling the
+// parent context or calling the bot's stop method stops it. Messages queue up
+// while the bot is connecting. Topic targets only keep the newest message,
+// since each one replaces the topic anyway.
+func startIRCBot(ctx context.Context, wg *sync.WaitGroup,
+	t *IRCTarget) *ircBot {
+
+	ctx, cancel := context.WithCancel(ctx)
+	policy := overflowDropOldest
+	if t.Mode == ircModeTopic {
+		policy = overflowCoalesce
+	}
+	name := fmt.Sprintf("irc %s %s", t.Server, strings.Join(t.Channels, ","))
+	q := NewEventQueue[string](name, queueConfig("irc", policy))
+	b := &ircBot{target: t, queue: q, cancel: cancel}
+	wg.Go(func() { IRCBot(ctx, t, q.Out()) })
+	return b
+}
+
+// Stop the bot's goroutine and throw away its queued messages
+func (b *ircBot) stop() {
+	b.cancel()
+	b.queue.Discard()
+}
+
+// Do two targets have the same connection settings? If so, a running bot for
+// one of them can send messages for the other.
+func (t *IRCTarget) sameConnection(o *IRCTarget) bool {
+	return t.Server == o.Server && t.Nick == o.Nick && t.Mode == o.Mode &&
+		t.Interval == o.Interval && slices.Equal(t.Channels, o.Channels)
+}
+
+// Update running bots for a new list of IRC targets (after a config reload).
+// Bots whose connection settings didn't change keep running with their new
+// template and node filter, so they stay connected. Other bots get stopped,
+// and new targets get a new bot, which is sent the startup summary.
+func reloadIRCBots(ctx context.Context, wg *sync.WaitGroup, bots []*ircBot,
+	targets []IRCTarget, histories NodeHistories) []*ircBot {
+
+	next := make([]*ircBot, len(targets))
+	kept := make([]bool, len(bots))
+	for i := range targets {
+		for j, b := range bots {
+			if !kept[j] && b.target.sameConnection(&targets[i]) {
+				kept[j] = true
+				b.target = &targets[i]
+				next[i] = b
+				break
+			}
+		}
+	}
+	for j, b := range bots {
+		if !kept[j] {
+			log.Printf("INFO: Stopping IRC target %s %v", b.target.Server,
+				b.target.Channels)
+			b.stop()
+		}
+	}
+	for i := range targets {
+		if next[i] == nil {
+			log.Printf("INFO: Starting IRC target %s %v", targets[i].Server,
+				targets[i].Channels)
+			next[i] = startIRCBot(ctx, wg, &targets[i])
+			if msg, ok := targets[i].Format(histories, ""); ok {
+				next[i].queue.Push(msg)
+			}
+		}
+	}
+	return next
+}
+
+// Forward messages from input channel to the IRC server of one IRC target
+func IRCBot(ctx context.Context, t *IRCTarget, in <-chan string) {
 	// Regex for parsing IRC lines: {prefix, command, params}
 	ircLineRE := regexp.MustCompile(
 		`^((:\S+)\s+)?` + // optional prefix (match group 2)
@@ -43,7 +392,7 @@ func IRCBot(ctx context.Context, cfg *ServerConfig, in <-chan string) {
 	numericCmdRE := regexp.MustCompile(`^\d{3}$`)
 
 	// These are for keeping track of connection retry backoff delay
-	baseDelay := 3 * time.Second
+	baseDelay := ircConnectDelay
 	maxDelay := 10 * time.Minute
 	connDelay := baseDelay
 
@@ -53,18 +402,47 @@ func IRCBot(ctx context.Context, cfg *ServerConfig, in <-chan string) {
 	var conn net.Conn = nil
 	var err error
 
+	// Topic throttles and message queue live outside of ConnectLoop so that
+	// anything requested while disconnected (e.g. the startup summary) gets
+	// sent after JOIN
+	interval := time.Duration(t.Interval) * time.Second
+	if interval <= 0 {
+		if t.Mode == ircModeTopic {
+			interval = defaultTopicInterval
+		} else {
+			interval = defaultMessageInterval
+		}
+	}
+	topics := make(map[string]*topicThrottle)
+	for _, ch := range t.Channels {
+		topics[ch] = &topicThrottle{interval: interval}
+	}
+	queue := messageQueue{interval: interval, max: 32}
+	sendTimer := time.NewTimer(interval)
+	sendTimer.Stop()
+	defer sendTimer.Stop()
+
+	// Command for PRIVMSG or NOTICE modes
+	msgCommand := "PRIVMSG"
+	if t.Mode == ircModeNotice {
+		msgCommand = "NOTICE"
+	}
+
 	// Loop forever with auto-reconnect using polite exponential backoff delay
 ConnectLoop:
 	for {
 		// Auto-close the connection so error handlers can just do a continue
 		if conn != nil {
-			log.Print("INFO: Closing IRC connection")
+			log.Printf("INFO: Closing IRC connection to %s", t.Server)
 			conn.Close()
 			conn = nil
 		}
 
 		// Always start with a delay before attempting to connect
-		time.Sleep(connDelay)
+		if !sleepCtx(ctx, connDelay) {
+			log.Print("DEBUG: IRC ConnectLoop got <-ctx.Done()")
+			return
+		}
 
 		// Connect or shutdown
 		select {
@@ -74,8 +452,9 @@ ConnectLoop:
 			return
 		default:
 			// Connect
-			log.Printf("INFO: IRC Connecting to %s", cfg.Server)
-			conn, err = net.Dial("tcp", cfg.Server)
+			log.Printf("INFO: IRC Connecting to %s", t.Server)
+			dialer := net.Dialer{Timeout: 30 * time.Second}
+			conn, err = dialer.DialContext(ctx, "tcp", t.Server)
 			if err != nil {
 				log.Printf("WARN: IRC connection failed: %v", err)
 				conn = nil
@@ -86,14 +465,15 @@ ConnectLoop:
 			connDelay = baseDelay
 		}
 
-		// Send messages to register nick and join channel
-		if err = ircSend(conn, "NICK "+cfg.Nick); err != nil {
+		// Send messages to register nick and join channels
+		if err = ircSend(conn, "NICK "+t.Nick); err != nil {
 			continue ConnectLoop
 		}
-		if err = ircSend(conn, "USER "+cfg.Nick+" 0 * :"+cfg.Nick); err != nil {
+		if err = ircSend(conn, "USER "+t.Nick+" 0 * :"+t.Nick); err != nil {
 			continue ConnectLoop
 		}
-		if err = ircSend(conn, "JOIN "+cfg.Channel); err != nil {
+		joinMsg := "JOIN " + strings.Join(t.Channels, ",")
+		if err = ircSend(conn, joinMsg); err != nil {
 			continue ConnectLoop
 		}
 
@@ -115,7 +495,9 @@ ConnectLoop:
 					return
 				}
 			}
-			if err := scanner.Err(); err != nil {
+			// Closed connection errors are from shutting down on purpose
+			err := scanner.Err()
+			if err != nil && !errors.Is(err, net.ErrClosed) {
 				log.Printf("WARN: IRC scanner failed: %v", err)
 				return
 			}
@@ -123,25 +505,94 @@ ConnectLoop:
 
 		// Connected Input Loop
 		registered := false
-		joined := false
+		joined := make(map[string]bool)
+		for _, topic := range topics {
+			topic.Reset()
+		}
+		sendTimer.Stop()
+		timerArmed := false
 	InputLoop:
 		for {
+			// Send pending topics or messages now if allowed, or arm timer to
+			// send them later
+			if registered && !timerArmed {
+				var minWait time.Duration
+				now := time.Now()
+				if t.Mode == ircModeTopic {
+					for _, ch := range t.Channels {
+						if !joined[ch] {
+							continue
+						}
+						topic := topics[ch]
+						wait, ok := topic.Due(now)
+						if !ok {
+							continue
+						}
+						if wait > 0 {
+							if minWait == 0 || wait < minWait {
+								minWait = wait
+							}
+							continue
+						}
+						msg := topic.pending
+						ircMsg := fmt.Sprintf("TOPIC %s :%s", ch, msg)
+						if err := ircSend(conn, ircMsg); err != nil {
+							continue ConnectLoop
+						}
+						topic.Sent(msg, now)
+					}
+				} else if len(joined) > 0 {
+					if wait, ok := queue.Due(now); ok {
+						if wait > 0 {
+							minWait = wait
+						} else {
+							msg := queue.Pop(now)
+							for _, ch := range t.Channels {
+								if !joined[ch] {
+									continue
+								}
+								ircMsg := fmt.Sprintf("%s %s :%s", msgCommand,
+									ch, msg)
+								if err := ircSend(conn, ircMsg); err != nil {
+									continue ConnectLoop
+								}
+							}
+							// Check again after the interval for more messages
+							minWait = queue.interval
+						}
+					}
+				}
+				if minWait > 0 {
+					sendTimer.Reset(minWait)
+					timerArmed = true
+				}
+			}
+
 			// Select between all the input sources
 			select {
 			case <-ctx.Done():
-				// Handle shutdown signal
+				// Handle shutdown signal. Say goodbye so the channel sees a
+				// quit message rather than a ping timeout later.
 				log.Print("DEBUG: IRC InputLoop got <-ctx.Done()")
+				conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+				ircSend(conn, "QUIT :Shutting down")
 				conn.Close()
 				return
 			case msg := <-in:
-				// Handle a message from the input channel by setting the
-				// topic of the configured channel
-				if registered && joined {
-					ircMsg := fmt.Sprintf("TOPIC %s :%s", cfg.Channel, msg)
-					if err := ircSend(conn, ircMsg); err != nil {
-						continue ConnectLoop
+				// Handle a message from the input channel by queueing it as
+				// the new topic of the target's channels or as a message. The
+				// actual IRC command gets sent at the top of InputLoop once
+				// allowed.
+				if t.Mode == ircModeTopic {
+					for _, topic := range topics {
+						topic.Set(msg)
 					}
+				} else {
+					queue.Push(msg)
 				}
+			case <-sendTimer.C:
+				// Minimum interval since the last send has elapsed
+				timerArmed = false
 			case line, ok := <-lineChan:
 				// Handle a line from the IRC server
 				if !ok {
@@ -175,9 +626,23 @@ ConnectLoop:
 				case "255":
 				case "265":
 				case "266":
+				case "332": // Current topic when joining channel
+					// params format is "<nick> <channel> :<topic>"
+					fields := strings.SplitN(params, " ", 3)
+					if len(fields) == 3 && topics[fields[1]] != nil {
+						topics[fields[1]].current = strings.TrimPrefix(
+							fields[2], ":")
+					}
 				case "333":
 				case "353":
-				case "366":
+				case "366": // End of NAMES list (sent after JOIN and topic)
+					// params format is "<nick> <channel> :End of /NAMES list"
+					// Waiting for this before setting topic avoids a double
+					// TOPIC when the 332 reply arrives after our JOIN.
+					fields := strings.SplitN(params, " ", 3)
+					if len(fields) == 3 && topics[fields[1]] != nil {
+						joined[fields[1]] = true
+					}
 
 				case "433": // Nick in use, reconnect after a delay
 					log.Printf("IRC: %s", line)
@@ -186,19 +651,27 @@ ConnectLoop:
 
 				case "442": // Not on channel (kicked by prankster?)
 					log.Printf("IRC: %s", line)
-					if strings.HasPrefix(params, cfg.Nick+" "+cfg.Channel) {
-						log.Printf("INFO: IRC 442 not in channel")
-						continue ConnectLoop
+					for _, ch := range t.Channels {
+						if strings.HasPrefix(params, t.Nick+" "+ch+" ") {
+							log.Printf("INFO: IRC 442 not in channel %s", ch)
+							continue ConnectLoop
+						}
 					}
 
 				case "JOIN": // Might be our JOIN or might be somebody else's
 					log.Printf("IRC: %s", line)
-					nickMatch := strings.HasPrefix(prefix, ":"+cfg.Nick+"!")
-					chanMatch := strings.HasPrefix(params, ":"+cfg.Channel)
-					if nickMatch && chanMatch {
-						log.Printf("INFO: IRC %s joined %s", cfg.Nick,
-							cfg.Channel)
-						joined = true
+					nickMatch := strings.HasPrefix(prefix, ":"+t.Nick+"!")
+					ch := strings.TrimPrefix(params, ":")
+					if nickMatch && topics[ch] != nil {
+						log.Printf("INFO: IRC %s joined %s", t.Nick, ch)
+					}
+
+				case "TOPIC": // Topic changed (by us or by somebody else)
+					log.Printf("IRC: %s", line)
+					fields := strings.SplitN(params, " ", 2)
+					if len(fields) == 2 && topics[fields[0]] != nil {
+						topics[fields[0]].current = strings.TrimPrefix(
+							fields[1], ":")
 					}
 
 				case "PING": // Reply with PONG to keep connection alive
@@ -213,7 +686,7 @@ ConnectLoop:
 						log.Printf("IRC: %s", line)
 					}
 				}
-			} // end select (<-ctx, <-in, <-lineChan)
+			} // end select (<-ctx, <-in, <-sendTimer, <-lineChan)
 		} // end InputLoop
 	} // end ConnectLoop
 }
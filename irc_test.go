@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start an IRCBot for a target on the fake server, with a short connect
+// delay. Returns the bot's input channel and a function that stops the bot
+// and waits for it to exit.
+func startTestIRCBot(t *testing.T, srv *fakeIRCServer, target IRCTarget) (
+	chan<- string, func()) {
+
+	t.Helper()
+	old := ircConnectDelay
+	ircConnectDelay = 10 * time.Millisecond
+	t.Cleanup(func() { ircConnectDelay = old })
+
+	target.Server = srv.Addr()
+	if err := target.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan string, 8)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() { IRCBot(ctx, &target, in) })
+	stop := func() {
+		cancel()
+		wg.Wait()
+	}
+	t.Cleanup(stop)
+	return in, stop
+}
+
+// Accept the bot's connection and go through registration and joining
+func registerTestIRCBot(t *testing.T, srv *fakeIRCServer, nick,
+	channel, topic string) *fakeIRCConn {
+
+	t.Helper()
+	c := srv.Accept(t)
+	c.Expect(t, "NICK "+nick)
+	c.Expect(t, "USER "+nick+" 0 * :"+nick)
+	c.Expect(t, "JOIN "+channel)
+	c.Send(t,
+		":irc.test 001 "+nick+" :Welcome to the test network",
+		":irc.test 002 "+nick+" :Your host is irc.test",
+		":"+nick+"!"+nick+"@localhost JOIN :"+channel,
+		":irc.test 332 "+nick+" "+channel+" :"+topic,
+		":irc.test 353 "+nick+" = "+channel+" :"+nick,
+		":irc.test 366 "+nick+" "+channel+" :End of /NAMES list")
+	return c
+}
+
+func TestIRCBotTopic(t *testing.T) {
+	srv := newFakeIRCServer(t)
+	in, stop := startTestIRCBot(t, srv, IRCTarget{
+		Nick:     "hub",
+		Channels: []string{"#greenhouse"},
+	})
+	c := registerTestIRCBot(t, srv, "hub", "#greenhouse", "old topic")
+
+	// The server pings and the bot answers
+	c.Send(t, "PING :irc.test")
+	c.Expect(t, "PONG :irc.test")
+
+	// A topic that matches the current topic doesn't get sent, so the next
+	// line is the TOPIC for the new one
+	in <- "old topic"
+	in <- "new topic"
+	c.Expect(t, "TOPIC #greenhouse :new topic")
+
+	// On shutdown, the bot says goodbye
+	stop()
+	c.Expect(t, "QUIT :Shutting down")
+}
+
+func TestIRCBotQueuesUntilJoined(t *testing.T) {
+	srv := newFakeIRCServer(t)
+	in, _ := startTestIRCBot(t, srv, IRCTarget{
+		Nick:     "hub",
+		Channels: []string{"#greenhouse"},
+		Mode:     ircModeMessage,
+	})
+	// Sent before connecting, so it waits until the bot has joined
+	in <- "hello"
+	c := registerTestIRCBot(t, srv, "hub", "#greenhouse", "")
+	c.Expect(t, "PRIVMSG #greenhouse :hello")
+}
+
+func TestIRCBotReconnects(t *testing.T) {
+	srv := newFakeIRCServer(t)
+	in, _ := startTestIRCBot(t, srv, IRCTarget{
+		Nick:     "hub",
+		Channels: []string{"#greenhouse"},
+	})
+	c := registerTestIRCBot(t, srv, "hub", "#greenhouse", "")
+	in <- "first"
+	c.Expect(t, "TOPIC #greenhouse :first")
+
+	// After the server drops the connection, the bot connects again
+	c.conn.Close()
+	c = registerTestIRCBot(t, srv, "hub", "#greenhouse", "first")
+
+	// Nick in use makes the bot reconnect too
+	c.Send(t, ":irc.test 433 * hub :Nickname is already in use")
+	registerTestIRCBot(t, srv, "hub", "#greenhouse", "first")
+}
@@ -3,10 +3,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,11 +27,38 @@ type SensorData struct {
 	Node      string
 	BatteryV  float64
 	TempF     float64
+	Protocol  string   // "ESPNOW" or "LORA" (empty in old logs)
+	NodeTime  string   // Node's own timestamp counter (hex)
+	Gateway   string   // Gateway that relayed the report (if known)
+	Humidity  *float64 // Relative humidity % (nil if not measured)
+	// Readings as the node sent them, for measurements that have a
+	// calibration (nil otherwise)
+	RawTemp     *float64
+	RawBatteryV *float64
+	RawHumidity *float64
+}
+
+// Get the report to add to a node's rolling history
+func (sd SensorData) Report() Report {
+	humidity := math.NaN()
+	if sd.Humidity != nil {
+		humidity = *sd.Humidity
+	}
+	return Report{
+		Timestamp: sd.Timestamp,
+		TempF:     sd.TempF,
+		BatteryV:  sd.BatteryV,
+		Humidity:  humidity,
+	}
 }
 
 type CurrentLogFile struct {
 	FilePath string
 	File     *os.File
+	Schema   *sensorLogSchema // Column layout of the current file
+	// Set if adding columns to the current file failed, so it doesn't get
+	// tried again for every report
+	widenFailed bool
 }
 
 // Does log file already have a non-zero amount of data?
@@ -54,92 +91,511 @@ func (c *CurrentLogFile) Rotate(filePath string) error {
 	return nil
 }
 
-// Generate sensor data log file directory from current working directory
+// Generate sensor data log file directory from the "log_dir" config setting.
+// Relative paths are relative to the current working directory.
 func getSensorLogDir() (string, error) {
+	logDir := cfg.LogDir
+	if logDir == "" {
+		logDir = defaultLogDir
+	}
+	if filepath.IsAbs(logDir) {
+		return logDir, nil
+	}
 	// Get current working directory
 	cwd, err := os.Getwd()
 	if err != nil {
 		return "", fmt.Errorf(
 			"ERROR: Checking current working directory failed: %v", err)
 	}
-	// CAUTION: This uses ./sensor-logs rather than something configurable
-	return filepath.Join(cwd, "sensor-logs"), nil
+	return filepath.Join(cwd, logDir), nil
+}
+
+// Open a daily sensor log file for reading. If `path` (a .csv file) doesn't
+// exist, but a gzip compressed copy (.csv.gz) does, the compressed copy gets
+// decompressed transparently.
+func openSensorLog(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return file, err
+	}
+	gzFile, gzErr := os.Open(path + ".gz")
+	if gzErr != nil {
+		// Report the original error since .csv is the usual case
+		return nil, err
+	}
+	gz, err := gzip.NewReader(gzFile)
+	if err != nil {
+		gzFile.Close()
+		return nil, fmt.Errorf("%s.gz: %v", path, err)
+	}
+	return &gzipFile{Reader: gz, file: gzFile}, nil
+}
+
+// Compressed file reader that closes both the gzip reader and the file
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
 }
 
 // Generate a log file path based on the number of `days` offset from today.
-// NOTE: This uses UTC to avoid timezone and daylight savings time troubles
+// NOTE: By default this uses UTC to avoid timezone and daylight savings time
+// troubles (see log_file_timezone)
 func getLogFilePathForTodayPlus(days int) (string, error) {
+	// Calculate relative date for the log file (days=0 is today)
+	loc, _ := logFileZone()
+	return getLogFilePathForTime(clock.Now().In(loc).AddDate(0, 0, days))
+}
+
+// Get the timezone for log file days and its file name suffix. Log files are
+// named by UTC day unless log_file_timezone is "local", in which case they
+// are named by day in the display timezone.
+func logFileZone() (*time.Location, string) {
+	if cfg.LogFileTimezone == logZoneLocal {
+		return cfg.Location(), "local"
+	}
+	return time.UTC, "UTC"
+}
+
+// Get the name of the day (e.g. "2025-11-17-UTC") of the log file that holds
+// reports from time `t`
+func sensorLogDayName(t time.Time) string {
+	loc, suffix := logFileZone()
+	return t.In(loc).Format("2006-01-02") + "-" + suffix
+}
+
+// Generate the path of the log file that holds reports from time `t`
+func getLogFilePathForTime(t time.Time) (string, error) {
 	// Log file directory
 	logDir, err := getSensorLogDir()
 	if err != nil {
 		return "", err
 	}
 
-	// Calculate relative UTC date for the log file (days=0 is today)
-	logDate := time.Now().UTC().AddDate(0, 0, days)
-
 	// Format log file path (e.g. ".../2025-11-17-UTC.csv")
-	name := fmt.Sprintf("%s-UTC.csv", logDate.Format("2006-01-02"))
+	name := sensorLogDayName(t) + ".csv"
 	logFilePath := filepath.Join(logDir, name)
 	return logFilePath, nil
 }
 
-// Log sensor data from incoming channel to daily rotating log file
-// CAUTION: This will return early for file IO errors
-func StartLogger(sensorLogChan <-chan SensorData) {
-	logFile := CurrentLogFile{}
+// Results of checking one sensor log file
+type LogCheckResult struct {
+	Path        string
+	Rows        int  // Data rows that parsed correctly
+	BadRows     int  // Data rows that failed to parse
+	Quarantined bool // Torn trailing row was moved to quarantine
+}
 
-	// Ensure sensor log directory exists
-	logDir, err := getSensorLogDir()
+// Check one sensor log file. If the file ends with a torn row (no trailing
+// newline, possibly followed by NUL bytes, as happens after a power cut), the
+// torn bytes get appended to a file of the same name in the quarantine
+// directory and the log file gets truncated to its last complete row.
+func CheckSensorLogFile(path string) (LogCheckResult, error) {
+	result := LogCheckResult{Path: path}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Print(err)
-		return // CAUTION!
+		return result, err
+	}
+
+	// Find the end of the last complete row, ignoring trailing NUL bytes
+	trimmed := bytes.TrimRight(data, "\x00")
+	good := len(trimmed)
+	if good > 0 && trimmed[good-1] != '\n' {
+		good = bytes.LastIndexByte(trimmed, '\n') + 1
 	}
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		log.Printf("ERROR: Creating logs directory failed: %v", err)
-		return // CAUTION!
+	if good < len(data) {
+		// Save the torn bytes before truncating so nothing gets lost
+		torn := data[good:]
+		qDir := filepath.Join(filepath.Dir(path), "quarantine")
+		if err := os.MkdirAll(qDir, 0755); err != nil {
+			return result, err
+		}
+		qPath := filepath.Join(qDir, filepath.Base(path))
+		q, err := os.OpenFile(qPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY,
+			0644)
+		if err != nil {
+			return result, err
+		}
+		_, err = q.Write(append(bytes.Clone(torn), '\n'))
+		if err == nil {
+			err = q.Sync()
+		}
+		q.Close()
+		if err != nil {
+			return result, err
+		}
+		if err := os.Truncate(path, int64(good)); err != nil {
+			return result, err
+		}
+		log.Printf("WARN: Moved torn row %q from %s to %s", torn, path, qPath)
+		result.Quarantined = true
+		data = data[:good]
 	}
 
-	// Log incoming sensor data channel messages
-	for sensorData := range sensorLogChan {
+	// Count good and bad rows
+	scan := parseSensorLog(data)
+	if scan.SchemaErr != nil {
+		log.Printf("WARN: %s: %v", path, scan.SchemaErr)
+	}
+	result.Rows = len(scan.Reports)
+	result.BadRows = len(scan.BadRows)
+	return result, nil
+}
 
-		// Get the current log file path (0 means use today's log file path)
-		logFilePath, err := getLogFilePathForTodayPlus(0)
+// Check and repair sensor log files for the past `days` number of days, then
+// log an integrity report. This should run before the logger starts.
+func CheckSensorLogs(days int) {
+	files, rows, bad, torn := 0, 0, 0, 0
+	for i := days - 1; i >= 0; i-- {
+		path, err := getLogFilePathForTodayPlus(-i)
 		if err != nil {
 			log.Print(err)
-			return // CAUTION!
+			return
 		}
+		result, err := CheckSensorLogFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("ERROR: Checking %s: %v", path, err)
+			continue
+		}
+		if result.BadRows > 0 || result.Quarantined {
+			log.Printf("WARN: Log check %s: %d rows ok, %d bad rows, "+
+				"torn row quarantined: %v", filepath.Base(path), result.Rows,
+				result.BadRows, result.Quarantined)
+		}
+		files++
+		rows += result.Rows
+		bad += result.BadRows
+		if result.Quarantined {
+			torn++
+		}
+	}
+	log.Printf("INFO: Log check: %d files, %d rows ok, %d bad rows, "+
+		"%d torn rows quarantined", files, rows, bad, torn)
+}
+
+// Log file fsync policies for the "log_fsync" setting in config.json
+const (
+	fsyncAlways   = "always"   // fsync after every report
+	fsyncInterval = "interval" // fsync every log_fsync_interval seconds
+	fsyncNever    = "never"    // leave it up to the OS
+)
+
+// Default seconds between fsyncs for the "interval" fsync policy
+const defaultFsyncInterval = 10
 
-		// Ensure correct log file is open and ready
-		if logFile.File == nil || logFilePath != logFile.FilePath {
-			if err := logFile.Rotate(logFilePath); err != nil {
-				log.Print("ERROR: Rotating log file failed: %v", err)
-				return // CAUTION!
+// Maximum number of sensor reports held in memory while log writes are
+// failing. When the buffer is full, the oldest reports get dropped. At one
+// report per minute from 3 nodes, this is a bit over 2 days.
+const loggerMaxBuffered = 10000
+
+// Health status of the CSV logger, shared with the web server
+type LoggerHealth struct {
+	OK            bool      `json:"ok"`
+	Buffered      int       `json:"buffered"` // Reports waiting to be written
+	Written       uint64    `json:"written"`  // Reports written since start
+	Dropped       uint64    `json:"dropped"`  // Reports lost to full buffers
+	LastWrite     time.Time `json:"last_write,omitzero"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitzero"`
+	mu            sync.Mutex
+}
+
+// Global logger health instance
+var loggerHealth = LoggerHealth{OK: true}
+
+// Get a copy of the current logger health status
+func (h *LoggerHealth) Snapshot() LoggerHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return LoggerHealth{
+		OK:            h.OK,
+		Buffered:      h.Buffered,
+		Written:       h.Written,
+		Dropped:       h.Dropped,
+		LastWrite:     h.LastWrite,
+		LastError:     h.LastError,
+		LastErrorTime: h.LastErrorTime,
+	}
+}
+
+// Count reports that were dropped before they could be written
+func (h *LoggerHealth) AddDropped(n int) {
+	h.mu.Lock()
+	h.Dropped += uint64(n)
+	h.mu.Unlock()
+}
+
+// Read the schema of an existing log file from its first lines
+func readSensorLogFileSchema(path string) (*sensorLogSchema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for len(lines) < 2 && scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	schema, _, err := readSensorLogSchema(lines)
+	return schema, err
+}
+
+// Write one sensor report to the correct daily log file, rotating files and
+// writing a CSV header as needed
+func (c *CurrentLogFile) WriteReport(sensorData SensorData) error {
+	// Get the log file path for the report's timestamp
+	logFilePath, err := getLogFilePathForTime(sensorData.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	// Ensure correct log file is open and ready
+	if c.File == nil || logFilePath != c.FilePath {
+		// Make sure sensor log directory exists (it may have been on a
+		// filesystem that was unmounted or remounted since last time)
+		if err := os.MkdirAll(filepath.Dir(logFilePath), 0755); err != nil {
+			return fmt.Errorf("creating logs directory failed: %v", err)
+		}
+		if err := c.Rotate(logFilePath); err != nil {
+			return fmt.Errorf("rotating log file failed: %v", err)
+		}
+		log.Printf("INFO: Logging sensor data to: %s", logFilePath)
+
+		// Only write CSV header if this is a new empty file. For example,
+		// the server could be stopped then restarted on the same day. In that
+		// case, keep using the file's column layout, which could be from an
+		// older schema version.
+		c.Schema = currentSensorLogSchema(nil)
+		c.widenFailed = false
+		if c.IsEmpty() {
+			header := c.Schema.HeaderLines()
+			if _, err := c.File.WriteString(header); err != nil {
+				return fmt.Errorf("writing sensor log header failed: %v", err)
 			}
-			log.Printf("INFO: Logging sensor data to: %s", logFilePath)
-
-			// Only write CSV header if this is a new empty file. For example,
-			// the server could be stopped then restarted on the same day.
-			if logFile.IsEmpty() {
-				header := "Timestamp,Node,RSSI,SNR,BatteryV,TempF\n"
-				if _, err := logFile.File.WriteString(header); err != nil {
-					log.Print("ERROR: Writing sensor log data failed: %v", err)
-					return // CAUTION!
-				}
+		} else {
+			schema, err := readSensorLogFileSchema(logFilePath)
+			if err != nil {
+				log.Printf("WARN: %s: %v (using current schema)",
+					logFilePath, err)
+			} else {
+				c.Schema = schema
 			}
 		}
+	}
+
+	// Rather than lose values for optional columns (like humidity) that the
+	// file doesn't have yet, rewrite the file with those columns added. That
+	// happens at most once per column per file.
+	if !c.widenFailed && c.Schema.MissingColumns(sensorData) {
+		err := c.widen(sensorData)
+		if err == nil {
+			return nil
+		}
+		log.Printf("WARN: Adding columns to %s failed: %v", c.FilePath, err)
+		c.widenFailed = true
+	}
+
+	// Write sensor data to log file
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(c.Schema.Record(sensorData))
+	w.Flush()
+	logLine := buf.String()
+	if _, err := c.File.WriteString(logLine); err != nil {
+		return fmt.Errorf("writing sensor log data failed: %v", err)
+	}
+	return nil
+}
+
+// Rewrite the current log file in the current schema with `sensorData`
+// added at the end. The next write reopens the file.
+func (c *CurrentLogFile) widen(sensorData SensorData) error {
+	path := c.FilePath
+	scan, err := scanSensorLog(path)
+	if err != nil {
+		return err
+	}
+	if scan.SchemaErr != nil {
+		return scan.SchemaErr
+	}
+	if err := scan.Schema.CheckRewrite(); err != nil {
+		return err
+	}
+	if len(scan.BadRows) > 0 {
+		if err := quarantineRows(path, scan.BadRows); err != nil {
+			return fmt.Errorf("quarantining bad rows: %v", err)
+		}
+	}
+	reports := append(scan.Reports, sensorData)
+	if err := writeSensorLog(path, encodeSensorLog(reports)); err != nil {
+		return err
+	}
+	log.Printf("INFO: Added columns to %s", path)
+	// The open file handle is for the replaced file
+	c.Close()
+	return nil
+}
+
+// Flush the current log file's data to disk
+func (c *CurrentLogFile) Sync() error {
+	if c.File == nil {
+		return nil
+	}
+	if err := c.File.Sync(); err != nil {
+		return fmt.Errorf("syncing sensor log failed: %v", err)
+	}
+	return nil
+}
 
-		// Write sensor data to log file
-		logLine := fmt.Sprintf("%s,%s,%s,%s,%.2f,%.0f\n",
-			sensorData.Timestamp.UTC().Format(time.RFC3339),
-			sensorData.Node,
-			sensorData.RSSI,
-			sensorData.SNR,
-			sensorData.BatteryV,
-			sensorData.TempF)
-		if _, err := logFile.File.WriteString(logLine); err != nil {
-			log.Print("ERROR: Writing sensor log data failed: %v", err)
-			return // CAUTION!
+// Close the current log file so the next write re-opens it
+func (c *CurrentLogFile) Close() {
+	if c.File != nil {
+		c.File.Close()
+		c.File = nil
+	}
+}
+
+// Log sensor data from incoming channel to daily rotating log file. If writes
+// fail (e.g. disk full or SD card remounted read-only), reports stay buffered
+// in memory and writes get retried with backoff. The incoming channel keeps
+// getting drained during outages so the sender never stalls.
+func StartLogger(sensorLogChan <-chan SensorData) {
+	logFile := CurrentLogFile{}
+	defer logFile.Close()
+
+	// These are for keeping track of write retry backoff delay
+	baseDelay := time.Second
+	maxDelay := 5 * time.Minute
+	retryDelay := baseDelay
+	retryTimer := time.NewTimer(retryDelay)
+	retryTimer.Stop()
+	defer retryTimer.Stop()
+	failing := false
+
+	// Reports waiting to be written, oldest first
+	pending := []SensorData{}
+
+	// Set up fsync policy. For the interval policy, dirty means there are
+	// writes that haven't been synced yet.
+	syncEach := cfg.LogFsync == fsyncAlways
+	var syncTick <-chan time.Time
+	if cfg.LogFsync == fsyncInterval {
+		ticker := time.NewTicker(
+			time.Duration(cfg.LogFsyncInterval) * time.Second)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	dirty := false
+
+	// Apply log retention and compression policies once an hour. Running
+	// this here means it can't race with writes to the current log file.
+	maintainTicker := time.NewTicker(time.Hour)
+	defer maintainTicker.Stop()
+
+	// Note a write failure, then schedule a retry
+	writeFailed := func(err error) {
+		// Close the file so the next attempt starts from scratch
+		logFile.Close()
+		if !failing {
+			log.Printf("ERROR: Sensor logger: %v (will retry)", err)
+		}
+		failing = true
+		loggerHealth.mu.Lock()
+		loggerHealth.OK = false
+		loggerHealth.Buffered = len(pending)
+		loggerHealth.LastError = err.Error()
+		loggerHealth.LastErrorTime = time.Now()
+		loggerHealth.mu.Unlock()
+		retryTimer.Reset(retryDelay)
+		retryDelay = ircNextBackoff(retryDelay, maxDelay)
+	}
+
+	// Write pending reports until done or a write fails
+	writePending := func() {
+		for len(pending) > 0 {
+			err := logFile.WriteReport(pending[0])
+			if err == nil && syncEach {
+				err = logFile.Sync()
+			}
+			if err != nil {
+				writeFailed(err)
+				return
+			}
+			dirty = !syncEach
+			pending = pending[1:]
+			loggerHealth.mu.Lock()
+			loggerHealth.Written++
+			loggerHealth.LastWrite = time.Now()
+			loggerHealth.mu.Unlock()
+		}
+		if failing {
+			log.Printf("INFO: Sensor logger recovered")
+		}
+		failing = false
+		retryDelay = baseDelay
+		pending = []SensorData{} // Let go of the old backing array
+		loggerHealth.mu.Lock()
+		loggerHealth.OK = true
+		loggerHealth.Buffered = 0
+		loggerHealth.mu.Unlock()
+	}
+
+	// Log incoming sensor data channel messages
+	for {
+		select {
+		case sensorData, ok := <-sensorLogChan:
+			if !ok {
+				// Last chance to write what's buffered, even if backing off
+				if len(pending) > 0 {
+					writePending()
+				}
+				if dirty {
+					logFile.Sync()
+				}
+				if len(pending) > 0 {
+					log.Printf("ERROR: Sensor logger exiting: %d buffered "+
+						"reports lost", len(pending))
+				}
+				return
+			}
+			pending = append(pending, sensorData)
+			if extra := len(pending) - loggerMaxBuffered; extra > 0 {
+				pending = pending[extra:]
+				loggerHealth.AddDropped(extra)
+			}
+			if failing {
+				// Wait for the retry timer rather than hammering the disk
+				loggerHealth.mu.Lock()
+				loggerHealth.Buffered = len(pending)
+				loggerHealth.mu.Unlock()
+				continue
+			}
+			writePending()
+		case <-retryTimer.C:
+			writePending()
+		case <-maintainTicker.C:
+			if !failing {
+				MaintainSensorLogs()
+			}
+		case <-syncTick:
+			if dirty && !failing {
+				if err := logFile.Sync(); err != nil {
+					writeFailed(err)
+					continue
+				}
+				dirty = false
+			}
 		}
 	}
 }
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSensorLogRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{LogDir: dir})
+
+	// Temperatures get logged as whole degrees
+	reports := []SensorData{
+		{Timestamp: mustTime(t, "2025-11-17T23:59:58Z"), Node: "1",
+			RSSI: "-122", SNR: "-14.0", BatteryV: 3.8, TempF: 63,
+			Protocol: "LORA", NodeTime: "38734ca6"},
+		{Timestamp: mustTime(t, "2025-11-17T23:59:59Z"), Node: "2",
+			RSSI: "-63", SNR: "0.0", BatteryV: 3.76, TempF: 66,
+			Protocol: "ESPNOW", NodeTime: "38734b3c"},
+		// Next UTC day goes in the next file
+		{Timestamp: mustTime(t, "2025-11-18T00:00:01Z"), Node: "1",
+			RSSI: "-120", SNR: "-12.5", BatteryV: 3.79, TempF: 62,
+			Protocol: "LORA", NodeTime: "38734cb0"},
+	}
+
+	logFile := CurrentLogFile{}
+	for _, sd := range reports {
+		if err := logFile.WriteReport(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logFile.Close()
+
+	// Each day's file starts with the schema version and header
+	data, err := os.ReadFile(filepath.Join(dir, "2025-11-17-UTC.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), currentSensorLogSchema(nil).
+		HeaderLines()) {
+		t.Errorf("log file doesn't start with the header:\n%s", data)
+	}
+
+	var got []SensorData
+	for _, day := range []string{"2025-11-17-UTC", "2025-11-18-UTC"} {
+		path := filepath.Join(dir, day+".csv")
+		err := readSensorLogFile(path, func(sd SensorData) {
+			got = append(got, sd)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != len(reports) {
+		t.Fatalf("got %d reports, want %d", len(got), len(reports))
+	}
+	for i := range reports {
+		if !got[i].Timestamp.Equal(reports[i].Timestamp) {
+			t.Errorf("report %d: got time %v, want %v", i,
+				got[i].Timestamp, reports[i].Timestamp)
+		}
+		got[i].Timestamp = reports[i].Timestamp
+		if !reflect.DeepEqual(got[i], reports[i]) {
+			t.Errorf("report %d:\ngot  %+v\nwant %+v", i, got[i], reports[i])
+		}
+	}
+}
+
+func TestLogFilePathDayRollover(t *testing.T) {
+	tests := []struct {
+		zone string // log_file_timezone
+		now  string
+		want string // Today's log file name
+	}{
+		{logZoneUTC, "2025-11-17T23:59:59Z", "2025-11-17-UTC.csv"},
+		{logZoneUTC, "2025-11-18T00:00:00Z", "2025-11-18-UTC.csv"},
+		// 11:59pm and midnight in Chicago (CST)
+		{logZoneLocal, "2025-11-18T05:59:59Z", "2025-11-17-local.csv"},
+		{logZoneLocal, "2025-11-18T06:00:00Z", "2025-11-18-local.csv"},
+		// Local midnight is 5am UTC in CDT, the day before the DST change
+		{logZoneLocal, "2025-11-01T05:00:00Z", "2025-11-01-local.csv"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		useTestConfig(t, ServerConfig{LogDir: dir, LogFileTimezone: tt.zone,
+			Timezone: "America/Chicago"})
+		useFakeClock(t, mustTime(t, tt.now))
+		got, err := getLogFilePathForTodayPlus(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(dir, tt.want); got != want {
+			t.Errorf("%s at %s: got %s, want %s", tt.zone, tt.now, got, want)
+		}
+	}
+}
+
+func TestSensorLogOptionalColumns(t *testing.T) {
+	humidity := 61.5
+	reports := []SensorData{
+		{Timestamp: mustTime(t, "2025-11-17T10:00:00Z"), Node: "1",
+			BatteryV: 3.8, TempF: 63},
+		// Fields with commas and quotes need CSV quoting
+		{Timestamp: mustTime(t, "2025-11-17T10:00:01Z"), Node: "2",
+			BatteryV: 3.76, TempF: 66, Gateway: `barn, "north"`,
+			Humidity: &humidity},
+	}
+	schema := currentSensorLogSchema(reports)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, sd := range reports {
+		w.Write(schema.Record(sd))
+	}
+	w.Flush()
+
+	scan := parseSensorLog([]byte(schema.HeaderLines() + buf.String()))
+	if scan.SchemaErr != nil || len(scan.BadRows) > 0 {
+		t.Fatalf("schema error %v, bad rows %v", scan.SchemaErr,
+			scan.BadRows)
+	}
+	if !reflect.DeepEqual(scan.Reports, reports) {
+		t.Errorf("got  %+v\nwant %+v", scan.Reports, reports)
+	}
+}
+
+func TestSensorLogAddsColumns(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{LogDir: dir})
+
+	// The file starts without a humidity column, then gets one
+	humidity, raw := 45.5, 17.5
+	reports := []SensorData{
+		{Timestamp: mustTime(t, "2025-11-17T10:00:00Z"), Node: "1",
+			BatteryV: 3.8, TempF: 63},
+		{Timestamp: mustTime(t, "2025-11-17T10:01:00Z"), Node: "2",
+			BatteryV: 3.8, TempF: 64, Humidity: &humidity},
+		{Timestamp: mustTime(t, "2025-11-17T10:02:00Z"), Node: "1",
+			BatteryV: 3.8, TempF: 63},
+		{Timestamp: mustTime(t, "2025-11-17T10:03:00Z"), Node: "3",
+			BatteryV: 3.8, TempF: 64, RawTemp: &raw},
+	}
+	logFile := CurrentLogFile{}
+	for _, sd := range reports {
+		if err := logFile.WriteReport(sd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logFile.Close()
+
+	scan, err := scanSensorLog(filepath.Join(dir, "2025-11-17-UTC.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scan.SchemaErr != nil || len(scan.BadRows) > 0 {
+		t.Fatalf("schema error %v, bad rows %v", scan.SchemaErr,
+			scan.BadRows)
+	}
+	if want := currentSensorLogSchema(reports); !reflect.DeepEqual(
+		scan.Schema.Columns, want.Columns) {
+
+		t.Errorf("got columns %v, want %v", scan.Schema.Columns, want.Columns)
+	}
+	for i := range scan.Reports {
+		scan.Reports[i].Timestamp = scan.Reports[i].Timestamp.UTC()
+	}
+	if !reflect.DeepEqual(scan.Reports, reports) {
+		t.Errorf("got  %+v\nwant %+v", scan.Reports, reports)
+	}
+}
+
+func TestParseSensorLogBadRows(t *testing.T) {
+	data := currentSensorLogSchema(nil).HeaderLines() +
+		"2025-11-17T10:00:00Z,1,-122,-14.0,3.80,63,LORA,38734ca6\n" +
+		"not a timestamp,1,-122,-14.0,3.80,63,LORA,38734ca6\n" +
+		"2025-11-17T10:05:00Z,1,-122,-14.0,3.80\n" +
+		"2025-11-17T10:10:00Z,2,-63,0.0,3.7"
+	scan := parseSensorLog([]byte(data))
+	if scan.SchemaErr != nil {
+		t.Fatal(scan.SchemaErr)
+	}
+	if len(scan.Reports) != 1 || len(scan.BadRows) != 3 || !scan.Torn {
+		t.Errorf("got %d reports, %d bad rows, torn=%v; want 1, 3, true",
+			len(scan.Reports), len(scan.BadRows), scan.Torn)
+	}
+}
+
+func TestLoggerFinalFlush(t *testing.T) {
+	t.Cleanup(func() { loggerHealth = LoggerHealth{OK: true} })
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	reports := []SensorData{
+		{Timestamp: now, Node: "1", RSSI: "-60", SNR: "1.0", BatteryV: 3.8,
+			TempF: 70},
+		{Timestamp: now.Add(time.Minute), Node: "2", RSSI: "-70",
+			SNR: "2.0", BatteryV: 3.9, TempF: 60},
+	}
+	// Run the logger with a file where the log directory should be, so
+	// writes fail, then fix it or not before the input channel closes
+	run := func(fixed bool) (logDir string, logs string) {
+		t.Helper()
+		logDir = filepath.Join(t.TempDir(), "logs")
+		if err := os.WriteFile(logDir, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		useTestConfig(t, ServerConfig{LogDir: logDir})
+		buf := captureLog(t)
+		in := make(chan SensorData)
+		done := make(chan struct{})
+		go func() {
+			StartLogger(in)
+			close(done)
+		}()
+		for _, sd := range reports {
+			in <- sd
+		}
+		if fixed {
+			if err := os.Remove(logDir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(in)
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for logger to exit")
+		}
+		return logDir, buf.String()
+	}
+
+	// The buffered reports get written on the way out
+	logDir, logs := run(true)
+	scan, err := scanSensorLog(filepath.Join(logDir, "2025-11-17-UTC.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scan.Reports) != 2 {
+		t.Errorf("got %d logged reports, want 2\n%s", len(scan.Reports), logs)
+	}
+
+	// If that fails too, the log says how many got lost
+	_, logs = run(false)
+	if want := "2 buffered reports lost"; !strings.Contains(logs, want) {
+		t.Errorf("log is missing %q:\n%s", want, logs)
+	}
+}
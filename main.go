@@ -4,11 +4,13 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
 	"os/signal"
 	"regexp"
@@ -19,8 +21,29 @@ import (
 	"time"
 )
 
-// Global variable to hold the histories map
-var histories NodeHistories
+// Default days of CSV logs to check and load at startup (3 days covers the
+// default 36 hour history window)
+const defaultStartupLoadDays = 3
+
+// Shutdown time limits. After the serial input stops, outputs get up to
+// shutdownFlushTimeout to write what they have, then the IRC bots and web
+// server get up to shutdownStopTimeout to stop. If shutdown still isn't done
+// after shutdownTimeout (e.g. something is stuck), the process exits anyway.
+const (
+	shutdownFlushTimeout = 10 * time.Second
+	shutdownStopTimeout  = 3 * time.Second
+	shutdownTimeout      = 20 * time.Second
+)
+
+// Global store of sensor node report histories. Read it with Snapshot() (or
+// Read() from the main goroutine).
+var histories *HistoryStore
+
+// Global time-series store (nil if it failed to open)
+var sensorStore *Store
+
+// Global SQLite database (nil if the sqlite storage backend is not enabled)
+var sqliteDB *SQLiteDB
 
 // Global cache struct to hold the chart PNG data
 type ChartCache struct {
@@ -40,42 +63,14 @@ var sensorReportRE = regexp.MustCompile(
 		`([^,]+),\s*` + // Timestamp (uint32)
 		`([^,]+),\s*` + // Battery voltage (float)
 		`([^,]+),\s*` + // Temperature F (float)
-		`([^,]+)`) // Monotonic increasing timestamp check: "OK" or "DUP"
+		`([^,]+)` + // Monotonic increasing timestamp check: "OK" or "DUP"
+		`(?:,\s*([^,]+))?`) // Relative humidity % (optional float)
 
 // Type for managing sensor report histories of multiple sensor nodes
 type NodeHistories map[string]*ReportHistory
 
-// Struct type for server config loaded from config.json
-type ServerConfig struct {
-	Server  string `json:"server"`
-	Nick    string `json:"nick"`
-	Channel string `json:"channel"`
-	Node1   string `json:"node1"` // Chart legend text for nodeID=1
-	Node2   string `json:"node2"` // Chart legend text for nodeID=2
-	Node3   string `json:"node3"` // Chart legend text for nodeID=3
-}
-
-// Global config struct
-var cfg ServerConfig
-
-// Load server config file into the global config struct
-func LoadServerConfig(path string) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	dec := json.NewDecoder(f)
-
-	if err := dec.Decode(&cfg); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// Regenerate the chart and store the PNG bytes in the cache
+// Regenerate the chart from a snapshot of the histories and store the bytes
+// in the cache
 func regenerateChart(histories NodeHistories) {
 	// Generate the new chart PNG bytes
 	chartBytes, err := GenerateTemperatureChart(histories)
@@ -90,6 +85,43 @@ func regenerateChart(histories NodeHistories) {
 	chartCache.mu.Unlock()
 }
 
+// Read one daily sensor log file (or its compressed copy), calling `fn` for
+// each record that parses correctly. Columns get matched up by the file's
+// header, so files from any schema version work. Bad records get logged and
+// skipped.
+func readSensorLogFile(path string, fn func(SensorData)) error {
+	// Open the log file (or its compressed copy)
+	file, err := openSensorLog(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	log.Printf("INFO: Loading %s", path)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	// Parse the header and data rows
+	// CAUTION: This attempts to continue after parsing errors
+	scan := parseSensorLog(data)
+	if scan.SchemaErr != nil {
+		log.Printf("WARN: %s: %v", path, scan.SchemaErr)
+		// If the header is bad, none of the rows can be read. Skip the file.
+		return nil
+	}
+	for _, bad := range scan.BadRows {
+		// Skip rows that don't fully parse rather than adding partial values
+		// to the history
+		log.Printf("WARN: Skipping CSV record %s:%d: %v", path, bad.Line,
+			bad.Err)
+	}
+	for _, sd := range scan.Reports {
+		fn(sd)
+	}
+	return nil
+}
+
 // Read sensor log files to get reports from the past `days` number of days
 func ReadSensorLogHistoryDays(days int) (NodeHistories, error) {
 	if days < 0 {
@@ -106,74 +138,230 @@ func ReadSensorLogHistoryDays(days int) (NodeHistories, error) {
 				"ERROR: Generating file path for %d days ago: %v", i, err)
 		}
 
-		// Open the log file
-		file, err := os.Open(path)
+		err = readSensorLogFile(path, func(sd SensorData) {
+			// Ensure history exists for this node
+			h, exists := histories[sd.Node]
+			if !exists {
+				h = &ReportHistory{}
+				histories[sd.Node] = h
+			}
+
+			// Add the data to the history for this node
+			h.AddReport(sd.Report())
+		})
 		if err != nil {
 			// This is fine. For example, maybe there is only the current
 			// day's sensor data available.
 			log.Printf("WARN: %v", err)
-			continue
-		}
-		reader := csv.NewReader(file)
-		log.Printf("INFO: Loading %s", path)
-
-		// Skip CSV header row
-		if _, err := reader.Read(); err != nil {
-			log.Printf("WARN: Reading CSV header row: %v", err)
-			// If the file is empty, that's fine. Skip this file.
-			file.Close()
-			continue
 		}
+	}
 
-		// Parse CSV data rows
-		// CAUTION: This attempts to continue after parsing errors
-		for {
-			record, err := reader.Read()
-			if err == io.EOF {
-				break
+	return histories, nil
+}
+
+// Fill in the daily temperature ranges for growing degree days for the
+// growing season, from the season start up to (but not including) the last
+// `skipDays` days, which the history loader covers. This reads from the same
+// place as the history loader: the SQLite database, the time-series store,
+// or the CSV logs. Reports that both of them read don't get counted twice,
+// since a day's range only keeps the low and high.
+func LoadSeasonDays(histories NodeHistories, skipDays int) {
+	today := localDayStart(clock.Now())
+	start := cfg.GDD.SeasonStart(today)
+	days := int(math.Round(today.Sub(start).Hours() / 24))
+	if days <= skipDays {
+		return
+	}
+	end := today.AddDate(0, 0, 1-skipDays)
+	addDay := func(node string, t time.Time, tempF float64) {
+		h, exists := histories[node]
+		if !exists {
+			h = &ReportHistory{}
+			histories[node] = h
+		}
+		h.addDay(t, tempF)
+	}
+	switch {
+	case sqliteDB != nil:
+		log.Printf("INFO: Loading growing season temperature ranges from " +
+			"SQLite")
+		rows, err := sqliteDB.queryReports("", start, end)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+			return
+		}
+		for _, row := range rows {
+			t, err := time.Parse(time.RFC3339, row.Timestamp)
+			if err == nil && row.TempF != nil {
+				addDay(row.Node, t, *row.TempF)
 			}
+		}
+	case sensorStore != nil:
+		log.Printf("INFO: Loading growing season temperature ranges from " +
+			"store")
+		for _, node := range sensorStore.Nodes() {
+			samples, err := sensorStore.QueryRaw(node, start, end)
 			if err != nil {
-				log.Printf("WARN: Reading CSV record: %v", err)
-				continue
+				log.Printf("WARN: %v", err)
+				return
 			}
-
-			// Parse record (format: Timestamp,Node,RSSI,SNR,BatteryV,TempF)
-			timestamp, err := time.Parse(time.RFC3339, record[0])
-			if err != nil {
-				log.Printf("WARN: Parsing timestamp: %v", err)
-
+			for _, sample := range samples {
+				if !math.IsNaN(sample.Values[0]) {
+					addDay(node, sample.Time, sample.Values[0])
+				}
 			}
-			node := record[1]
-			// ignore: rssi := record[2]
-			// ignore: snr := record[3]
-			batteryV, err := strconv.ParseFloat(record[4], 64)
+		}
+	default:
+		log.Printf("INFO: Loading growing season temperature ranges from " +
+			"CSV logs")
+		for i := days; i >= skipDays; i-- {
+			path, err := getLogFilePathForTodayPlus(-i)
 			if err != nil {
-				log.Printf("WARN: Parsing batteryV: %v", err)
+				log.Printf("WARN: Generating file path for %d days ago: %v",
+					i, err)
+				return
 			}
-			tempF, err := strconv.ParseFloat(record[5], 64)
-			if err != nil {
-				log.Printf("WARN: Parsing tempF: %v", err)
+			err = readSensorLogFile(path, func(sd SensorData) {
+				addDay(sd.Node, sd.Timestamp, sd.TempF)
+			})
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("WARN: %v", err)
 			}
+		}
+	}
+}
 
-			// Ensure history exists for this node
-			h, exists := histories[node]
-			if !exists {
-				h = &ReportHistory{}
-				histories[node] = h
-			}
+// Parse a sensor report line and calibrate its readings. Bad and duplicate
+// reports get logged, and return false.
+func parseSensorReport(report string) (SensorData, bool) {
+	matches := sensorReportRE.FindStringSubmatch(report)
+	if matches == nil {
+		log.Printf("WARN: SENSOR: Bad report format: %s", report)
+		return SensorData{}, false
+	}
 
-			// Add the data to the history for this node
-			h.Add(timestamp, batteryV, tempF)
+	protocol := matches[1]
+	rssi := matches[2]
+	snr := matches[3]
+	node := matches[4]
+	nodeTime := matches[5]
+	okdup := matches[8]
+	if okdup != "OK" {
+		log.Printf("INFO: SENSOR: Duplicate: %s", report)
+		return SensorData{}, false
+	}
+	batteryV, err := strconv.ParseFloat(matches[6], 64)
+	if err != nil {
+		log.Printf("WARN: SENSOR: Bad battery voltage: %s", matches[6])
+		return SensorData{}, false
+	}
+	tempF, err := strconv.ParseFloat(matches[7], 64)
+	if err != nil {
+		log.Printf("WARN: SENSOR: Bad temperature F: %s", matches[7])
+		return SensorData{}, false
+	}
+	// Humidity is optional, so a bad value doesn't lose the report
+	var humidity *float64
+	if matches[9] != "" {
+		rh, err := strconv.ParseFloat(strings.TrimSpace(matches[9]), 64)
+		if err != nil {
+			log.Printf("WARN: SENSOR: Bad humidity: %s", matches[9])
+		} else {
+			humidity = &rh
 		}
-		// Close this log file
-		file.Close()
 	}
 
-	return histories, nil
+	sensorData := SensorData{
+		Timestamp: clock.Now(),
+		Node:      node,
+		RSSI:      rssi,
+		SNR:       snr,
+		BatteryV:  batteryV,
+		TempF:     tempF,
+		Protocol:  protocol,
+		NodeTime:  nodeTime,
+		Humidity:  humidity,
+	}
+	sensorData.Calibrate(cfg.Calibration[node])
+	// Check humidity in the hub's unit, since calibration can convert it
+	if rh := sensorData.Humidity; rh != nil && (*rh < 0 || *rh > 100) {
+		log.Printf("WARN: SENSOR: Bad humidity: %s", matches[9])
+		sensorData.Humidity, sensorData.RawHumidity = nil, nil
+	}
+	return sensorData, true
 }
 
-// Format an IRC summary message for the most recent report of nodes 1 and 2
-func FormatReportSummary(histories NodeHistories) string {
+// Render IRC messages for a new report from `node` and add them to each IRC
+// bot's queue (see IRCTarget.Format for node="" behavior)
+func sendIRCReports(bots []*ircBot, histories NodeHistories, node string) {
+	for _, b := range bots {
+		if msg, ok := b.target.Format(histories, node); ok {
+			b.queue.Push(msg)
+		}
+	}
+}
+
+// Sleep for duration d, or until ctx is canceled. Returns false if canceled.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Wait for a wait group, giving up after timeout. Returns false on timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Reload the config file (after a SIGHUP) and apply the settings that can
+// change without a restart: node names and colors, alert thresholds, and IRC
+// targets. If the new config has errors, the old config stays in effect.
+// Returns the updated list of IRC bots (new bots get added to `wg`).
+func reloadServerConfig(ctx context.Context, wg *sync.WaitGroup, path string,
+	bots []*ircBot) []*ircBot {
+
+	log.Printf("INFO: Reloading config from %s", path)
+	next, err := ReadServerConfig(path)
+	if err != nil {
+		log.Printf("ERROR: Config reload failed; keeping old config: %v", err)
+		return bots
+	}
+	if changed := cfg.restartSettings(next); len(changed) > 0 {
+		log.Printf("WARN: Config reload: restart to apply changes to: %s",
+			strings.Join(changed, ", "))
+	}
+	cfgMu.Lock()
+	cfg.applyReloadable(next)
+	cfgMu.Unlock()
+	bots = reloadIRCBots(ctx, wg, bots, cfg.IRC, histories.Snapshot(snapStats))
+
+	// Redraw the chart with the new node names and colors
+	regenerateChart(histories.Snapshot(snapReports))
+	log.Printf("INFO: Config reloaded")
+	return bots
+}
+
+// Format an IRC summary message for the most recent report of nodes 1 to 3,
+// with the min/max over `window` (the history_hours window if there's no
+// such window)
+func FormatReportSummary(histories NodeHistories, window string) string {
 	lines := []string{}
 
 	for _, nodeID := range []string{"1", "2", "3"} {
@@ -185,11 +373,15 @@ func FormatReportSummary(histories NodeHistories) string {
 		}
 		last := h.Reports[len(h.Reports)-1]
 		// Format timestamp like "Nov15 05:30", and be sure to use local time
-		localTimestamp := last.Timestamp.In(time.Local)
+		localTimestamp := last.Timestamp.In(cfg.Location())
 		timestampStr := localTimestamp.Format("02Jan 15:04")
+		minTempF, maxTempF := h.MinTempF, h.MaxTempF
+		if w := h.Window(window); w != nil {
+			minTempF, maxTempF = w.MinTempF, w.MaxTempF
+		}
 		lines = append(lines,
 			fmt.Sprintf("/%.0f %.0f %.0f %.0f/  %s",
-				last.TempF, 100*last.BatteryV, h.MinTempF, h.MaxTempF,
+				last.TempF, 100*last.BatteryV, minTempF, maxTempF,
 				timestampStr))
 	}
 
@@ -197,8 +389,9 @@ func FormatReportSummary(histories NodeHistories) string {
 	return "!pre " + strings.Join(lines, "")
 }
 
-// main() reads serial sensor reports, maintains a 36-hour rolling history per
-// node, and sends report summaries by IRC (sets topic of configured channel).
+// main() reads serial sensor reports, maintains a rolling history per node
+// (36 hours by default), and sends report summaries by IRC (sets topic of
+// configured channel, or sends messages for each configured IRC target).
 // Example sensor reports (expected format of USB serial stream):
 //
 //	LORA: -122, -14.0, 1, 38734ca6, 3.80, 63, DUP
@@ -217,145 +410,331 @@ func FormatReportSummary(histories NodeHistories) string {
 //	66 376 66 93
 //	  2  Nov16 23:43
 func main() {
+	configPath := flag.String("config", defaultConfigPath,
+		"path of the config file")
+	printConfig := flag.Bool("print-config", false,
+		"print the config after applying environment and flag overrides")
+	registerConfigFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, toolsUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Show the effective config (with secrets hidden) instead of running
+	if *printConfig {
+		c, err := ReadServerConfig(*configPath)
+		if err == nil {
+			var data []byte
+			if data, err = formatConfig(c); err == nil {
+				fmt.Printf("%s\n", data)
+				return
+			}
+		}
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Run a command line tool instead of the server if there is a command
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Arg(0), flag.Args()[1:], *configPath))
+	}
+
 	log.Printf("INFO: Starting serial-sensor-hub")
 
 	// Load configuration file into global config struct
-	err := LoadServerConfig("config.json")
+	err := LoadServerConfig(*configPath)
 	if err != nil {
 		log.Fatalf("ERROR: Failed to load server config: %v", err)
 	}
+	clock = cfg.NewClock()
+	if _, ok := clock.(systemClock); !ok {
+		log.Printf("INFO: Using simulated clock starting at %s",
+			clock.Now().Format(time.RFC3339))
+	}
 
 	// Channels
 	sensorChan := make(chan string, 32)
-	reportChan := make(chan string, 32)
-	sensorLogChan := make(chan SensorData, 32)
+	reloadChan := make(chan struct{}, 1) // SIGHUP config reload requests
+
+	// Buses for handing reports and webhook events to the outputs, each of
+	// which subscribes with its own queue (see bus.go)
+	reportBus := &EventBus[SensorData]{}
+	webhookBus := &EventBus[WebhookEvent]{}
+
+	// Repair torn rows left by power cuts, report on log file integrity, then
+	// apply log retention and compression policies
+	CheckSensorLogs(cfg.StartupLoadDays)
+	MaintainSensorLogs()
+
+	// Open the time-series store, filling it from the CSV logs the first time
+	sensorStore, err = OpenStore(cfg.StoreDir)
+	if err != nil {
+		log.Printf("ERROR: Opening time-series store: %v", err)
+		sensorStore = nil
+	} else if sensorStore.Empty() {
+		if err := BackfillStore(sensorStore); err != nil {
+			log.Printf("ERROR: Backfilling time-series store: %v", err)
+		}
+	}
+
+	// Open the SQLite database if enabled, filling it from the CSV logs the
+	// first time
+	if storageEnabled(storageSQLite) {
+		sqliteDB, err = OpenSQLite(cfg.SQLitePath)
+		if err != nil {
+			log.Printf("ERROR: Opening SQLite database: %v", err)
+			sqliteDB = nil
+		} else if empty, err := sqliteDB.Empty(); err != nil {
+			log.Printf("ERROR: Checking SQLite database: %v", err)
+		} else if empty {
+			if err := BackfillSQLite(sqliteDB); err != nil {
+				log.Printf("ERROR: Backfilling SQLite database: %v", err)
+			}
+		}
+	}
 
-	// Try to initialize sensor node report history from recent log files.
-	// Node histories get used to compute 36-hour rolling min/max temperatures.
-	histories, err := ReadSensorLogHistoryDays(3) // 3 days should be enough
+	// Try to initialize sensor node report history from the SQLite database
+	// or time-series store, or from recent log files if neither is available.
+	// Node histories get used to compute rolling min/max temperatures.
+	var loaded NodeHistories
+	loadDays := int(cfg.RetentionWindow()/(24*time.Hour)) + 1
+	if sqliteDB != nil {
+		log.Printf("INFO: Loading sensor node report history from SQLite")
+		loaded, err = sqliteDB.LoadHistories(
+			clock.Now().Add(-cfg.RetentionWindow()))
+	} else if sensorStore != nil {
+		log.Printf("INFO: Loading sensor node report history from store")
+		loaded, err = sensorStore.LoadHistories(
+			clock.Now().Add(-cfg.RetentionWindow()))
+	} else {
+		// Load enough days to cover the longest window
+		loadDays = max(cfg.StartupLoadDays, loadDays)
+		loaded, err = ReadSensorLogHistoryDays(loadDays)
+	}
 	if err != nil {
 		// Loading the old log data failed, so start from a clean slate
 		log.Print(err)
-		histories = make(NodeHistories)
-	} else {
+		loaded = nil
+	}
+	// Growing degree days need the temperature ranges of the whole season
+	if loaded == nil {
+		loaded = make(NodeHistories)
+	}
+	LoadSeasonDays(loaded, loadDays)
+	histories = NewHistoryStore(loaded)
+	if err == nil {
 		// Loading log data worked, so count how much we got
-		totalReports := 0
-		totalNodes := len(histories)
-		for _, history := range histories {
-			totalReports += len(history.Reports)
-		}
+		totalNodes, totalReports := histories.Counts()
 		log.Printf("INFO: Sensor Log Summary: %d nodes, %d reports",
 			totalNodes, totalReports)
 	}
 
 	// Generate initial chart from historical sensor data
-	regenerateChart(histories)
+	regenerateChart(histories.Snapshot(snapReports))
 
-	// Shutdown context for clean exit (in case of Ctrl-C or whatever)
+	// Shutdown contexts for clean exit (in case of Ctrl-C or whatever).
+	// Shutdown happens in order: stopInput() stops the serial input, then
+	// once the reports already read have been handled and the outputs have
+	// flushed, cancel() stops the IRC bots, chart ticker, and web server.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel() // call cancel if main() exits normally
+	inputCtx, stopInput := context.WithCancel(ctx)
+	var outputs sync.WaitGroup  // Goroutines that write reports somewhere
+	var services sync.WaitGroup // IRC bots, chart ticker, and web server
 
-	// Prepare to call cancel() in the event of Ctrl-C / SIGTERM or SIGHUP
+	// Prepare to shut down in the event of Ctrl-C / SIGTERM, or to reload the
+	// config file for SIGHUP
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		s := <-sig
+		for s == syscall.SIGHUP {
+			// Ask the main loop to reload (unless a reload is pending)
+			select {
+			case reloadChan <- struct{}{}:
+			default:
+			}
+			s = <-sig
+		}
 		log.Printf("INFO: received signal '%s'; shutting down...", s)
-		cancel()
-		close(sensorChan)
-		close(reportChan)
-		close(sensorLogChan)
+		// The serial monitor closes sensorChan when it stops, which ends the
+		// fanout loop below, and main() takes it from there
+		stopInput()
+		time.AfterFunc(shutdownTimeout, func() {
+			log.Printf("ERROR: Shutdown is taking too long; exiting now")
+			os.Exit(1)
+		})
+		// Exit right away for a second Ctrl-C / SIGTERM
+		for s := range sig {
+			if s != syscall.SIGHUP {
+				log.Printf("INFO: received signal '%s'; exiting now", s)
+				os.Exit(1)
+			}
+		}
 	}()
 
-	// Start ticker to keep chart updated if sensors reports are absent
-	chartTicker := time.NewTicker(5 * time.Minute)
-	go func() {
+	// Start the chart goroutine, which redraws the chart for new reports and
+	// on a timer to keep it updated if sensor reports are absent. Reports
+	// that arrive during a redraw get coalesced into one more redraw.
+	chartReports := reportBus.Subscribe("chart",
+		queueConfig("chart", overflowCoalesce))
+	chartTicker := time.NewTicker(
+		time.Duration(cfg.ChartInterval) * time.Second)
+	services.Go(func() {
+		defer chartTicker.Stop()
 		for {
 			select {
 			case <-chartTicker.C:
-				regenerateChart(histories)
+				regenerateChart(histories.Snapshot(snapReports))
+			case _, ok := <-chartReports:
+				if !ok {
+					chartReports = nil
+					continue
+				}
+				regenerateChart(histories.Snapshot(snapReports))
 			case <-ctx.Done():
 				log.Printf("DEBUG: chartTicker got <-ctx.Done()")
 				return
 			}
 		}
-	}()
-
-	// Start IRC bot goroutine (takes several seconds to connect and join)
-	go IRCBot(ctx, &cfg, reportChan)
+	})
 
-	// Send summary of logged sensor reports for nodes 1 and 2 by IRC
-	if len(histories) > 0 {
-		// First allow time for IRC connect/register/join finish
-		time.Sleep(6 * time.Second)
-		// Okay, now send it
-		summary := FormatReportSummary(histories)
-		reportChan <- summary
+	// Start IRC bot goroutines (takes several seconds to connect and join)
+	bots := make([]*ircBot, len(cfg.IRC)) // one per IRC target
+	for i := range cfg.IRC {
+		bots[i] = startIRCBot(ctx, &services, &cfg.IRC[i])
 	}
 
-	// Start serial port sensor monitor, sensor data logger, and web server
-	go SerialConnect(ctx, sensorChan)
-	go StartLogger(sensorLogChan)
-	go StartWebServer(ctx)
-
-	// Start sensorChan fanout to sensor log and reportChan channel
-	for report := range sensorChan {
-		log.Printf("SENSOR: %s", report)
+	// Queue summary of logged sensor reports by IRC. The IRC bots hold on to
+	// this until they have finished connecting and joining their channels.
+	if nodes, _ := histories.Counts(); nodes > 0 {
+		histories.Read(func(h NodeHistories) { sendIRCReports(bots, h, "") })
+	}
 
-		matches := sensorReportRE.FindStringSubmatch(report)
-		if matches == nil {
-			log.Printf("WARN: SENSOR: Bad report format: %s", report)
-			continue
+	// Start serial port sensor monitor (or simulated sensor nodes), sensor
+	// data logger, other outputs, and web server. Outputs stop when their
+	// input channel gets closed.
+	switch {
+	case cfg.Simulate.Nodes > 0 && cfg.Simulate.PTY:
+		path, err := SimulatePty(inputCtx, &cfg.Simulate)
+		if err != nil {
+			log.Fatalf("ERROR: Starting simulated sensor nodes: %v", err)
 		}
+		serialPortPatterns = []string{path}
+		go SerialConnect(inputCtx, sensorChan)
+	case cfg.Simulate.Nodes > 0:
+		go Simulate(inputCtx, &cfg.Simulate, sensorChan)
+	default:
+		go SerialConnect(inputCtx, sensorChan)
+	}
+	services.Go(func() { StartWebServer(ctx) })
+	if storageEnabled(storageCSV) {
+		// Count reports dropped by the logger's queue in the logger health
+		q := NewEventQueue[SensorData]("logger",
+			queueConfig("logger", overflowDropOldest))
+		q.onDrop = loggerHealth.AddDropped
+		in := reportBus.SubscribeQueue(q)
+		outputs.Go(func() { StartLogger(in) })
+	}
+	if sqliteDB != nil {
+		in := reportBus.Subscribe("sqlite",
+			queueConfig("sqlite", overflowDropOldest))
+		outputs.Go(func() { StartSQLite(sqliteDB, in) })
+	}
+	if cfg.MQTT.Broker != "" {
+		in := reportBus.Subscribe("mqtt",
+			queueConfig("mqtt", overflowDropOldest))
+		outputs.Go(func() { StartMQTT(ctx, &cfg.MQTT, in) })
+	}
+	if len(cfg.Webhooks) > 0 {
+		in := webhookBus.Subscribe("webhooks",
+			queueConfig("webhooks", overflowDropOldest))
+		outputs.Go(func() {
+			StartWebhooks(ctx, cfg.Webhooks, cfg.WebhookQueueDir, in)
+		})
+	}
+	if sensorStore != nil {
+		in := reportBus.Subscribe("store",
+			queueConfig("store", overflowDropOldest))
+		outputs.Go(func() { StartStore(sensorStore, in) })
+	}
+	if cfg.InfluxDB.URL != "" || cfg.InfluxDB.UDP != "" {
+		in := reportBus.Subscribe("influxdb",
+			queueConfig("influxdb", overflowDropOldest))
+		outputs.Go(func() { StartInflux(ctx, &cfg.InfluxDB, in) })
+	}
+	if cfg.Graphite.Addr != "" {
+		in := reportBus.Subscribe("graphite",
+			queueConfig("graphite", overflowDropOldest))
+		outputs.Go(func() { StartGraphite(ctx, &cfg.Graphite, in) })
+	}
 
-		rssi := matches[2]
-		snr := matches[3]
-		node := matches[4]
-		okdup := matches[8]
-		if okdup != "OK" {
-			log.Printf("INFO: SENSOR: Duplicate: %s", report)
-			continue
-		}
-		batteryV, err := strconv.ParseFloat(matches[6], 64)
-		if err != nil {
-			log.Printf("WARN: SENSOR: Bad battery voltage: %s", matches[6])
+	// Alert state of each node for threshold crossing alerts
+	alerts := AlertTracker{}
+
+	// Start sensorChan fanout to the IRC bots and the report buses. Config
+	// reloads happen here too, between reports, so the reloaded settings
+	// don't change in the middle of handling a report.
+FanoutLoop:
+	for {
+		var report string
+		select {
+		case <-reloadChan:
+			bots = reloadServerConfig(ctx, &services, *configPath, bots)
 			continue
+		case r, ok := <-sensorChan:
+			if !ok {
+				break FanoutLoop
+			}
+			report = r
 		}
-		tempF, err := strconv.ParseFloat(matches[7], 64)
-		if err != nil {
-			log.Printf("WARN: SENSOR: Bad temperature F: %s", matches[7])
+		log.Printf("SENSOR: %s", report)
+
+		sensorData, ok := parseSensorReport(report)
+		if !ok {
 			continue
 		}
-
-		// Ensure history exists for this node
-		h, exists := histories[node]
-		if !exists {
-			h = &ReportHistory{}
-			histories[node] = h
+		node := sensorData.Node
+
+		// Add the report to the node's rolling history and recompute min/max
+		histories.Add(node, sensorData.Report())
+
+		// Queue messages about the new report for interested IRC targets.
+		// This goroutine is the only one that adds reports, so reading the
+		// histories in place is quicker than copying them for every report.
+		histories.Read(func(h NodeHistories) {
+			sendIRCReports(bots, h, node)
+		})
+
+		// Publish the report to the outputs (CSV log, databases, MQTT,
+		// metrics, webhooks, and chart). This doesn't wait for slow outputs
+		// unless their queue uses the block policy.
+		reportBus.Publish(sensorData)
+		webhookBus.Publish(NewReportEvent(sensorData))
+
+		// Check alert thresholds and send alerts to webhooks
+		if alert, ok := alerts.Check(sensorData, cfg.Thresholds); ok {
+			log.Printf("ALERT: %s", alert.Message())
+			webhookBus.Publish(NewAlertEvent(alert))
 		}
+	}
 
-		// Add report to node's rolling 36h history and recompute min/max
-		timestamp := time.Now()
-		h.Add(timestamp, batteryV, tempF)
-
-		// Send summary of latest reports for nodes 1 and 2 by IRC
-		summary := FormatReportSummary(histories)
-		reportChan <- summary
-
-		// Log the report to disk
-		sensorData := SensorData{
-			Timestamp: timestamp,
-			Node:      node,
-			RSSI:      rssi,
-			SNR:       snr,
-			BatteryV:  batteryV,
-			TempF:     tempF,
-		}
-		sensorLogChan <- sensorData
+	// The serial input has stopped and its last reports have been handled.
+	// Close the buses (main is the only publisher) so each output gets what
+	// is left in its queue, writes it, and exits. The CSV logger syncs and
+	// closes its file.
+	log.Printf("INFO: Serial input stopped; flushing outputs")
+	reportBus.Close()
+	webhookBus.Close()
+	if !waitTimeout(&outputs, shutdownFlushTimeout) {
+		log.Printf("WARN: Outputs did not finish flushing in time")
+	}
 
-		// Update chart for web server
-		regenerateChart(histories)
+	// Then stop the IRC bots (which send QUIT), chart ticker, and web server
+	cancel()
+	if !waitTimeout(&services, shutdownStopTimeout) {
+		log.Printf("WARN: IRC bots or web server did not stop in time")
 	}
-	log.Printf("DEBUG: end of main(); shutting down in 5 seconds...")
-	time.Sleep(5 * time.Second)
+	log.Printf("INFO: Shutdown complete")
 }
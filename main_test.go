@@ -0,0 +1,92 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestSensorReportRE(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string // Match groups 1-9, or nil for no match
+	}{
+		{"LORA: -122, -14.0, 1, 38734ca6, 3.80, 63, DUP",
+			[]string{"LORA", "-122", "-14.0", "1", "38734ca6", "3.80", "63",
+				"DUP", ""}},
+		{"ESPNOW: -63, 0.0, 2, 38734b3c, 3.80, 64, OK",
+			[]string{"ESPNOW", "-63", "0.0", "2", "38734b3c", "3.80", "64",
+				"OK", ""}},
+		// Humidity is optional
+		{"ESPNOW: -63, 0.0, 2, 38734b3c, 3.80, 64, OK, 45.5",
+			[]string{"ESPNOW", "-63", "0.0", "2", "38734b3c", "3.80", "64",
+				"OK", "45.5"}},
+		// Spaces after the separators are optional
+		{"LORA:-90,7.5,3,0000ffff,4.12,71.5,OK",
+			[]string{"LORA", "-90", "7.5", "3", "0000ffff", "4.12", "71.5",
+				"OK", ""}},
+		// Unknown protocol, missing fields, and junk don't match
+		{"WIFI: -63, 0.0, 2, 38734b3c, 3.80, 64, OK", nil},
+		{"ESPNOW: -63, 0.0, 2, 38734b3c, 3.80, 64", nil},
+		{"  LORA: -122, -14.0, 1, 38734ca6, 3.80, 63, OK", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		m := sensorReportRE.FindStringSubmatch(tt.line)
+		if tt.want == nil {
+			if m != nil {
+				t.Errorf("%q: got match %q, want no match", tt.line, m[1:])
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%q: got no match, want %q", tt.line, tt.want)
+			continue
+		}
+		if !slices.Equal(m[1:], tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.line, m[1:], tt.want)
+		}
+	}
+}
+
+func TestParseSensorReport(t *testing.T) {
+	offset := map[string]Calibration{metricHumidity: {Offset: -3}}
+	fraction := map[string]Calibration{metricHumidity: {Unit: "fraction"}}
+	useTestConfig(t, ServerConfig{
+		Calibration: map[string]map[string]Calibration{
+			"1": offset, "2": fraction}})
+	useFakeClock(t, mustTime(t, "2025-11-17T10:00:00Z"))
+	tests := []struct {
+		line     string
+		humidity float64 // NaN for none
+	}{
+		// The humidity range gets checked after calibration, so readings
+		// outside 0..100 that calibrate into it are fine
+		{"LORA: -90, 7.5, 1, 0000ffff, 4.12, 71.5, OK, 101", 98},
+		{"LORA: -90, 7.5, 2, 0000ffff, 4.12, 71.5, OK, 0.455", 45.5},
+		{"LORA: -90, 7.5, 2, 0000ffff, 4.12, 71.5, OK, 45.5", math.NaN()},
+		{"LORA: -90, 7.5, 3, 0000ffff, 4.12, 71.5, OK, 150", math.NaN()},
+		{"LORA: -90, 7.5, 3, 0000ffff, 4.12, 71.5, OK, 45.5", 45.5},
+	}
+	for _, tt := range tests {
+		sd, ok := parseSensorReport(tt.line)
+		if !ok || sd.TempF != 71.5 || sd.BatteryV != 4.12 {
+			t.Errorf("%q: got %+v, %v", tt.line, sd, ok)
+			continue
+		}
+		if got := sd.Report().Humidity; math.Abs(got-tt.humidity) > 1e-9 ||
+			math.IsNaN(got) != math.IsNaN(tt.humidity) {
+			t.Errorf("%q: got humidity %v, want %v", tt.line, got,
+				tt.humidity)
+		}
+		if sd.Humidity == nil && sd.RawHumidity != nil {
+			t.Errorf("%q: got raw humidity without humidity", tt.line)
+		}
+	}
+	if _, ok := parseSensorReport("LORA: -90, 7.5, 3, 0000ffff, 4.12, " +
+		"71.5, DUP"); ok {
+		t.Errorf("duplicate report didn't fail")
+	}
+}
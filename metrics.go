@@ -0,0 +1,334 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings for the optional InfluxDB sink from the "influxdb" section of
+// config.json. Set either url (HTTP write API) or udp (UDP listener).
+type InfluxConfig struct {
+	// HTTP write API URL, for example:
+	//   InfluxDB 1.x: http://host:8086/write?db=sensors
+	//   InfluxDB 2.x: http://host:8086/api/v2/write?org=home&bucket=sensors
+	URL           string `json:"url"`
+	UDP           string `json:"udp"`            // UDP "host:port"
+	Token         string `json:"token"`          // Optional API token
+	Measurement   string `json:"measurement"`    // Default "sensor"
+	BatchSize     int    `json:"batch_size"`     // Default 100 lines
+	FlushInterval int    `json:"flush_interval"` // Seconds (default 10)
+}
+
+// Settings for the optional Graphite sink from the "graphite" section of
+// config.json
+type GraphiteConfig struct {
+	Addr          string `json:"addr"`           // Carbon TCP "host:port"
+	Prefix        string `json:"prefix"`         // Default "sensorhub"
+	BatchSize     int    `json:"batch_size"`     // Default 100 lines
+	FlushInterval int    `json:"flush_interval"` // Seconds (default 10)
+}
+
+// Maximum lines buffered by a sink during an outage. When the buffer is full,
+// the oldest lines get dropped. At 4 lines per report this is about a week
+// of data for 3 nodes reporting every minute.
+const metricsMaxBuffered = 100000
+
+// Check InfluxDB settings and fill in defaults
+func (c *InfluxConfig) Prepare() error {
+	if c.URL != "" && c.UDP != "" {
+		return fmt.Errorf("influxdb: set url or udp, not both")
+	}
+	if c.Measurement == "" {
+		c.Measurement = "sensor"
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = 10
+	}
+	return nil
+}
+
+// Fill in defaults for unset Graphite settings
+func (c *GraphiteConfig) Prepare() {
+	if c.Prefix == "" {
+		c.Prefix = "sensorhub"
+	}
+	c.Prefix = strings.TrimSuffix(c.Prefix, ".")
+	if c.BatchSize <= 0 {
+		c.BatchSize = 100
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = 10
+	}
+}
+
+// Escape commas, spaces, and equals signs for line protocol tags
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, `=`, `\=`)
+
+// Format a sensor report as one line of InfluxDB line protocol, like:
+//
+//	sensor,node=2,name=Greenhouse temp_f=64,battery_v=3.8,rssi=-63 1763...
+func influxLine(measurement string, d SensorData) string {
+	var b strings.Builder
+	b.WriteString(influxTagEscaper.Replace(measurement))
+	b.WriteString(",node=" + influxTagEscaper.Replace(d.Node))
+	if name := nodeName(d.Node); name != "" {
+		b.WriteString(",name=" + influxTagEscaper.Replace(name))
+	}
+	fmt.Fprintf(&b, " temp_f=%g,battery_v=%g", d.TempF, d.BatteryV)
+	if rssi, err := strconv.ParseFloat(d.RSSI, 64); err == nil {
+		fmt.Fprintf(&b, ",rssi=%g", rssi)
+	}
+	if snr, err := strconv.ParseFloat(d.SNR, 64); err == nil {
+		fmt.Fprintf(&b, ",snr=%g", snr)
+	}
+	fmt.Fprintf(&b, " %d", d.Timestamp.UnixNano())
+	return b.String()
+}
+
+// Characters not allowed in Graphite metric path components
+var graphiteUnsafeRE = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Format a sensor report as Graphite plaintext lines, like:
+//
+//	sensorhub.node2.temp_f 64 1763424000
+func graphiteLines(prefix string, d SensorData) []string {
+	path := prefix + ".node" + graphiteUnsafeRE.ReplaceAllString(d.Node, "_")
+	ts := d.Timestamp.Unix()
+	lines := []string{
+		fmt.Sprintf("%s.temp_f %g %d", path, d.TempF, ts),
+		fmt.Sprintf("%s.battery_v %g %d", path, d.BatteryV, ts),
+	}
+	if rssi, err := strconv.ParseFloat(d.RSSI, 64); err == nil {
+		lines = append(lines, fmt.Sprintf("%s.rssi %g %d", path, rssi, ts))
+	}
+	if snr, err := strconv.ParseFloat(d.SNR, 64); err == nil {
+		lines = append(lines, fmt.Sprintf("%s.snr %g %d", path, snr, ts))
+	}
+	return lines
+}
+
+// Error for batches that the server rejected as invalid (retrying won't help)
+type metricsRejectedError struct {
+	err error
+}
+
+func (e metricsRejectedError) Error() string {
+	return e.err.Error()
+}
+
+// Batching sink for line based text protocols. Lines get buffered and written
+// in batches of up to batchSize lines every flushInterval (or sooner if a
+// batch fills up). During outages, lines stay buffered (up to a limit) and
+// writes get retried with backoff.
+type lineSink struct {
+	name          string
+	batchSize     int
+	flushInterval time.Duration
+	format        func(d SensorData) []string
+	write         func(ctx context.Context, lines []string) error
+}
+
+// Run the sink until ctx is canceled or the input channel is closed
+func (s *lineSink) Run(ctx context.Context, in <-chan SensorData) {
+	// These are for keeping track of write retry backoff delay
+	baseDelay := 3 * time.Second
+	maxDelay := 10 * time.Minute
+	retryDelay := baseDelay
+	var retryAt time.Time
+
+	buffer := []string{}
+	dropped := 0
+
+	// Write buffered lines in batches until empty or a write fails
+	flush := func() {
+		if time.Now().Before(retryAt) {
+			return
+		}
+		for len(buffer) > 0 {
+			n := min(len(buffer), s.batchSize)
+			err := s.write(ctx, buffer[:n])
+			if _, ok := err.(metricsRejectedError); ok {
+				log.Printf("WARN: %s rejected %d lines: %v", s.name, n, err)
+			} else if err != nil {
+				log.Printf("WARN: %s write failed (%d lines buffered): %v",
+					s.name, len(buffer), err)
+				retryAt = time.Now().Add(retryDelay)
+				retryDelay = ircNextBackoff(retryDelay, maxDelay)
+				return
+			}
+			buffer = buffer[n:]
+		}
+		if dropped > 0 {
+			log.Printf("WARN: %s dropped %d lines during outage", s.name,
+				dropped)
+			dropped = 0
+		}
+		retryDelay = baseDelay
+		// Let go of the old backing array once it's been drained
+		buffer = []string{}
+	}
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("DEBUG: %s got <-ctx.Done()", s.name)
+			return
+		case d, ok := <-in:
+			if !ok {
+				// Last chance to write what's buffered (unless backing off)
+				flush()
+				if len(buffer) > 0 {
+					log.Printf("WARN: %s exiting with %d lines not written",
+						s.name, len(buffer))
+				}
+				return
+			}
+			buffer = append(buffer, s.format(d)...)
+			if extra := len(buffer) - metricsMaxBuffered; extra > 0 {
+				buffer = buffer[extra:]
+				dropped += extra
+			}
+			if len(buffer) >= s.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Write a batch of line protocol to the InfluxDB HTTP write API
+func influxWriteHTTP(ctx context.Context, client *http.Client,
+	c *InfluxConfig, lines []string) error {
+
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL,
+		strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		// Malformed line protocol won't get better by retrying
+		return metricsRejectedError{fmt.Errorf("HTTP status %d",
+			resp.StatusCode)}
+	default:
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+}
+
+// Write a batch of line protocol as UDP datagrams, packing as many lines as
+// will fit in each datagram
+func influxWriteUDP(addr string, lines []string) error {
+	const maxDatagram = 1400 // Stay under typical Ethernet MTU
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > maxDatagram {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line + "\n")
+	}
+	if buf.Len() > 0 {
+		_, err = conn.Write(buf.Bytes())
+	}
+	return err
+}
+
+// Write sensor reports to InfluxDB as line protocol
+func StartInflux(ctx context.Context, c *InfluxConfig, in <-chan SensorData) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	sink := lineSink{
+		name:          "InfluxDB",
+		batchSize:     c.BatchSize,
+		flushInterval: time.Duration(c.FlushInterval) * time.Second,
+		format: func(d SensorData) []string {
+			return []string{influxLine(c.Measurement, d)}
+		},
+		write: func(ctx context.Context, lines []string) error {
+			if c.UDP != "" {
+				return influxWriteUDP(c.UDP, lines)
+			}
+			return influxWriteHTTP(ctx, client, c, lines)
+		},
+	}
+	if c.UDP != "" {
+		log.Printf("INFO: InfluxDB sink writing to udp://%s", c.UDP)
+	} else {
+		log.Printf("INFO: InfluxDB sink writing to %s", c.URL)
+	}
+	sink.Run(ctx, in)
+}
+
+// Write sensor reports to Graphite (carbon) using the plaintext protocol
+func StartGraphite(ctx context.Context, c *GraphiteConfig,
+	in <-chan SensorData) {
+
+	// Keep the TCP connection open between batches, reconnecting on error
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	sink := lineSink{
+		name:          "Graphite",
+		batchSize:     c.BatchSize,
+		flushInterval: time.Duration(c.FlushInterval) * time.Second,
+		format: func(d SensorData) []string {
+			return graphiteLines(c.Prefix, d)
+		},
+		write: func(ctx context.Context, lines []string) error {
+			if conn == nil {
+				var err error
+				conn, err = net.DialTimeout("tcp", c.Addr, 10*time.Second)
+				if err != nil {
+					return err
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			body := strings.Join(lines, "\n") + "\n"
+			if _, err := conn.Write([]byte(body)); err != nil {
+				conn.Close()
+				conn = nil
+				return err
+			}
+			return nil
+		},
+	}
+	log.Printf("INFO: Graphite sink writing to %s", c.Addr)
+	sink.Run(ctx, in)
+}
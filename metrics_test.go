@@ -0,0 +1,324 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Timestamp for metrics test reports (2025-11-18T00:00:00Z)
+var metricsTestTime = time.Unix(1763424000, 0)
+
+func TestInfluxLine(t *testing.T) {
+	useTestConfig(t, ServerConfig{Node1: "Back Yard,East=1",
+		Node2: "Greenhouse"})
+	tests := []struct {
+		name        string
+		measurement string
+		d           SensorData
+		want        string
+	}{
+		{"named node", "sensor",
+			SensorData{Node: "2", RSSI: "-63", SNR: "2.5", BatteryV: 3.8,
+				TempF: 64},
+			"sensor,node=2,name=Greenhouse " +
+				"temp_f=64,battery_v=3.8,rssi=-63,snr=2.5 " +
+				"1763424000000000000"},
+		{"escaped name", "sensor",
+			SensorData{Node: "1", RSSI: "-70", SNR: "-1", BatteryV: 4,
+				TempF: 70.5},
+			`sensor,node=1,name=Back\ Yard\,East\=1 ` +
+				"temp_f=70.5,battery_v=4,rssi=-70,snr=-1 " +
+				"1763424000000000000"},
+		{"escaped measurement and node", "my sensor",
+			SensorData{Node: "a,b=c", RSSI: "-80", SNR: "0", BatteryV: 3.7,
+				TempF: 50},
+			`my\ sensor,node=a\,b\=c ` +
+				"temp_f=50,battery_v=3.7,rssi=-80,snr=0 " +
+				"1763424000000000000"},
+		{"non-numeric RSSI and SNR", "sensor",
+			SensorData{Node: "4", RSSI: "n/a", SNR: "", BatteryV: 3.6,
+				TempF: 40},
+			"sensor,node=4 temp_f=40,battery_v=3.6 1763424000000000000"},
+		{"non-numeric SNR", "sensor",
+			SensorData{Node: "4", RSSI: "-90", SNR: "DUP", BatteryV: 3.6,
+				TempF: 40},
+			"sensor,node=4 temp_f=40,battery_v=3.6,rssi=-90 " +
+				"1763424000000000000"},
+	}
+	for _, tt := range tests {
+		tt.d.Timestamp = metricsTestTime
+		if got := influxLine(tt.measurement, tt.d); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGraphiteLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		d      SensorData
+		want   []string
+	}{
+		{"all fields", "sensorhub",
+			SensorData{Node: "2", RSSI: "-63", SNR: "2.5", BatteryV: 3.8,
+				TempF: 64},
+			[]string{
+				"sensorhub.node2.temp_f 64 1763424000",
+				"sensorhub.node2.battery_v 3.8 1763424000",
+				"sensorhub.node2.rssi -63 1763424000",
+				"sensorhub.node2.snr 2.5 1763424000",
+			}},
+		{"sanitized node", "home.hub",
+			SensorData{Node: "a.b c/d", RSSI: "-70", SNR: "1", BatteryV: 4,
+				TempF: 70.5},
+			[]string{
+				"home.hub.nodea_b_c_d.temp_f 70.5 1763424000",
+				"home.hub.nodea_b_c_d.battery_v 4 1763424000",
+				"home.hub.nodea_b_c_d.rssi -70 1763424000",
+				"home.hub.nodea_b_c_d.snr 1 1763424000",
+			}},
+		{"non-numeric RSSI and SNR", "sensorhub",
+			SensorData{Node: "4", RSSI: "n/a", SNR: "", BatteryV: 3.6,
+				TempF: 40},
+			[]string{
+				"sensorhub.node4.temp_f 40 1763424000",
+				"sensorhub.node4.battery_v 3.6 1763424000",
+			}},
+	}
+	for _, tt := range tests {
+		tt.d.Timestamp = metricsTestTime
+		if got := graphiteLines(tt.prefix, tt.d); !slices.Equal(got,
+			tt.want) {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Run a line sink with one line per report (the node ID) and the given
+// write function, sending it reports for `nodes` and then closing its input
+func runTestSink(t *testing.T, batchSize int, nodes []string,
+	write func(lines []string) error) {
+
+	t.Helper()
+	sink := lineSink{
+		name:          "test",
+		batchSize:     batchSize,
+		flushInterval: time.Hour,
+		format:        func(d SensorData) []string { return []string{d.Node} },
+		write: func(ctx context.Context, lines []string) error {
+			return write(slices.Clone(lines))
+		},
+	}
+	in := make(chan SensorData)
+	done := make(chan struct{})
+	go func() {
+		sink.Run(context.Background(), in)
+		close(done)
+	}()
+	for _, node := range nodes {
+		in <- SensorData{Node: node}
+	}
+	close(in)
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for sink to exit")
+	}
+}
+
+func TestLineSinkBatches(t *testing.T) {
+	// Full batches get written as they fill up, and the rest on exit
+	var batches [][]string
+	runTestSink(t, 3, strings.Split("1234567", ""), func(lines []string) error {
+		batches = append(batches, lines)
+		return nil
+	})
+	want := [][]string{{"1", "2", "3"}, {"4", "5", "6"}, {"7"}}
+	if !slices.EqualFunc(batches, want, slices.Equal) {
+		t.Errorf("got batches %q, want %q", batches, want)
+	}
+}
+
+func TestLineSinkErrors(t *testing.T) {
+	// A rejected batch gets dropped, and the next one gets written without
+	// waiting
+	var batches [][]string
+	runTestSink(t, 2, strings.Split("1234", ""), func(lines []string) error {
+		batches = append(batches, lines)
+		if len(batches) == 1 {
+			return metricsRejectedError{errors.New("HTTP status 400")}
+		}
+		return nil
+	})
+	want := [][]string{{"1", "2"}, {"3", "4"}}
+	if !slices.EqualFunc(batches, want, slices.Equal) {
+		t.Errorf("rejected: got batches %q, want %q", batches, want)
+	}
+
+	// A failed write keeps the lines buffered and backs off, so there are no
+	// more write attempts before the retry delay (not even on exit)
+	batches = nil
+	runTestSink(t, 2, strings.Split("123456", ""), func(lines []string) error {
+		batches = append(batches, lines)
+		return errors.New("connection refused")
+	})
+	want = [][]string{{"1", "2"}}
+	if !slices.EqualFunc(batches, want, slices.Equal) {
+		t.Errorf("transient: got batches %q, want %q", batches, want)
+	}
+}
+
+func TestGraphiteListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c := &GraphiteConfig{Addr: ln.Addr().String(), Prefix: "hub."}
+	c.Prepare()
+	in := make(chan SensorData, 2)
+	done := make(chan struct{})
+	go func() {
+		StartGraphite(context.Background(), c, in)
+		close(done)
+	}()
+	reports := []SensorData{
+		{Timestamp: metricsTestTime, Node: "1", RSSI: "-60", SNR: "1.5",
+			BatteryV: 3.8, TempF: 65},
+		{Timestamp: metricsTestTime.Add(time.Minute), Node: "2",
+			RSSI: "-70", SNR: "n/a", BatteryV: 3.9, TempF: 55},
+	}
+	for _, d := range reports {
+		in <- d
+	}
+	close(in)
+
+	// Both reports go out in one batch when the sink exits
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	var want []string
+	for _, d := range reports {
+		want = append(want, graphiteLines("hub", d)...)
+	}
+	r := bufio.NewReader(conn)
+	for _, line := range want {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != line+"\n" {
+			t.Errorf("got %q, want %q", got, line)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for Graphite sink to exit")
+	}
+}
+
+func TestInfluxHTTPListener(t *testing.T) {
+	type request struct {
+		auth string
+		body string
+	}
+	requests := make(chan request, 4)
+	statuses := []int{http.StatusBadRequest, http.StatusNoContent}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			status := statuses[0]
+			statuses = statuses[1:]
+			w.WriteHeader(status)
+			requests <- request{r.Header.Get("Authorization"), string(body)}
+		}))
+	defer srv.Close()
+
+	c := &InfluxConfig{URL: srv.URL + "/write?db=sensors", Token: "secret",
+		BatchSize: 1}
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan SensorData)
+	done := make(chan struct{})
+	go func() {
+		StartInflux(context.Background(), c, in)
+		close(done)
+	}()
+
+	// The first report gets rejected (and dropped), and the second one still
+	// gets written right away
+	reports := []SensorData{
+		{Timestamp: metricsTestTime, Node: "1", RSSI: "-60", SNR: "1.5",
+			BatteryV: 3.8, TempF: 65},
+		{Timestamp: metricsTestTime.Add(time.Minute), Node: "2",
+			RSSI: "-70", SNR: "2", BatteryV: 3.9, TempF: 55},
+	}
+	for _, d := range reports {
+		in <- d
+		select {
+		case req := <-requests:
+			if req.auth != "Token secret" {
+				t.Errorf("got Authorization %q", req.auth)
+			}
+			if want := influxLine("sensor", d) + "\n"; req.body != want {
+				t.Errorf("got body %q, want %q", req.body, want)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for InfluxDB write")
+		}
+	}
+	close(in)
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for InfluxDB sink to exit")
+	}
+	if len(requests) > 0 {
+		t.Errorf("got %d extra requests", len(requests))
+	}
+}
+
+func TestInfluxUDPListener(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c := &InfluxConfig{UDP: pc.LocalAddr().String(), Measurement: "hub"}
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan SensorData, 1)
+	d := SensorData{Timestamp: metricsTestTime, Node: "3", RSSI: "-50",
+		SNR: "4", BatteryV: 4.1, TempF: 72}
+	in <- d
+	close(in)
+	StartInflux(context.Background(), c, in)
+
+	pc.SetReadDeadline(time.Now().Add(testTimeout))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), influxLine("hub", d)+"\n"; got != want {
+		t.Errorf("got datagram %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,483 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings for the optional MQTT publisher loaded from the "mqtt" section of
+// config.json. Leaving broker empty disables MQTT.
+type MQTTConfig struct {
+	Broker          string `json:"broker"`           // Broker "host:port"
+	ClientID        string `json:"client_id"`        // Default "sensorhub"
+	Username        string `json:"username"`         // Optional
+	Password        string `json:"password"`         // Optional
+	TopicPrefix     string `json:"topic_prefix"`     // Default "sensorhub"
+	KeepAlive       int    `json:"keepalive"`        // Seconds (default 60)
+	Discovery       bool   `json:"discovery"`        // Home Assistant configs
+	DiscoveryPrefix string `json:"discovery_prefix"` // "homeassistant"
+	QoS             int    `json:"qos"`              // 0 (default) or 1
+}
+
+// MQTT 3.1.1 control packet types (high nibble of fixed header byte)
+const (
+	mqttConnect    = 0x10
+	mqttConnAck    = 0x20
+	mqttPublish    = 0x30
+	mqttPubAck     = 0x40
+	mqttPingReq    = 0xC0
+	mqttPingResp   = 0xD0
+	mqttDisconnect = 0xE0
+)
+
+// Delay before connecting to the broker, which is also the starting delay for
+// reconnect backoff (tests make this shorter)
+var mqttConnectDelay = 3 * time.Second
+
+// Check MQTT settings and fill in defaults
+func (c *MQTTConfig) Prepare() error {
+	if c.ClientID == "" {
+		c.ClientID = "sensorhub"
+	}
+	if c.TopicPrefix == "" {
+		c.TopicPrefix = "sensorhub"
+	}
+	c.TopicPrefix = strings.TrimSuffix(c.TopicPrefix, "/")
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = 60
+	}
+	if c.DiscoveryPrefix == "" {
+		c.DiscoveryPrefix = "homeassistant"
+	}
+	if c.QoS != 0 && c.QoS != 1 {
+		return fmt.Errorf("qos: expected 0 or 1, got %d", c.QoS)
+	}
+	return nil
+}
+
+// Topic for hub availability ("online" or "offline", also used for LWT)
+func (c *MQTTConfig) availabilityTopic() string {
+	return c.TopicPrefix + "/status"
+}
+
+// Topic for the retained JSON state of one node
+func (c *MQTTConfig) stateTopic(node string) string {
+	return c.TopicPrefix + "/node/" + node + "/state"
+}
+
+// Encode MQTT variable length "remaining length" field
+func mqttEncodeLength(n int) []byte {
+	var buf []byte
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			return buf
+		}
+	}
+}
+
+// Encode MQTT UTF-8 string with 2-byte length prefix
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// Build a complete MQTT control packet from a fixed header byte and body
+func mqttPacket(header byte, body []byte) []byte {
+	pkt := append([]byte{header}, mqttEncodeLength(len(body))...)
+	return append(pkt, body...)
+}
+
+// Read one MQTT control packet, returning its fixed header byte and body
+func mqttReadPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	header, err = r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body = make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// Build CONNECT packet with clean session and a retained "offline" LWT
+func mqttConnectPacket(c *MQTTConfig) []byte {
+	// Connect flags: clean session, will flag, will retain, and will QoS
+	flags := byte(0x02|0x04|0x20) | byte(c.QoS)<<3
+	if c.Username != "" {
+		flags |= 0x80
+		if c.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := mqttString("MQTT")
+	body = append(body, 4, flags) // protocol level 4 is MQTT 3.1.1
+	body = append(body, byte(c.KeepAlive>>8), byte(c.KeepAlive))
+	body = append(body, mqttString(c.ClientID)...)
+	body = append(body, mqttString(c.availabilityTopic())...)
+	body = append(body, mqttString("offline")...)
+	if c.Username != "" {
+		body = append(body, mqttString(c.Username)...)
+		if c.Password != "" {
+			body = append(body, mqttString(c.Password)...)
+		}
+	}
+	return mqttPacket(mqttConnect, body)
+}
+
+// Build a PUBLISH packet. QoS 1 packets need a nonzero packet ID, which the
+// broker's PUBACK refers to.
+func mqttPublishPacket(topic string, payload []byte, retain bool, qos int,
+	id uint16) []byte {
+
+	header := byte(mqttPublish) | byte(qos)<<1
+	if retain {
+		header |= 0x01
+	}
+	body := mqttString(topic)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+	return mqttPacket(header, body)
+}
+
+// Connect to the broker and wait for a successful CONNACK
+func mqttDial(c *MQTTConfig) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", c.Broker, 10*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(mqttConnectPacket(c)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, body, err := mqttReadPacket(r)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if header&0xF0 != mqttConnAck || len(body) != 2 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected CONNACK, got 0x%02x", header)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("connection refused, return code %d",
+			body[1])
+	}
+	return conn, r, nil
+}
+
+// JSON payload for a node's state topic
+type mqttState struct {
+	Timestamp string  `json:"timestamp"`
+	Node      string  `json:"node"`
+	TempF     float64 `json:"temp_f"`
+	BatteryV  float64 `json:"battery_v"`
+	RSSI      float64 `json:"rssi"`
+	SNR       float64 `json:"snr"`
+}
+
+// Build the retained state topic payload for one sensor report
+func mqttStatePayload(d SensorData) []byte {
+	// RSSI and SNR are logged as strings, but numbers work better for MQTT
+	rssi, _ := strconv.ParseFloat(d.RSSI, 64)
+	snr, _ := strconv.ParseFloat(d.SNR, 64)
+	payload, _ := json.Marshal(mqttState{
+		Timestamp: d.Timestamp.UTC().Format(time.RFC3339),
+		Node:      d.Node,
+		TempF:     d.TempF,
+		BatteryV:  d.BatteryV,
+		RSSI:      rssi,
+		SNR:       snr,
+	})
+	return payload
+}
+
+// Build Home Assistant MQTT discovery topics and configs for one node. Each
+// node shows up as a device with temperature, battery, and signal sensors.
+func mqttDiscoveryConfigs(c *MQTTConfig, node string) map[string][]byte {
+	name := nodeName(node)
+	if name == "" {
+		name = "Sensor node " + node
+	}
+	device := map[string]any{
+		"identifiers": []string{c.ClientID + "_node" + node},
+		"name":        name,
+		"model":       "Serial sensor node",
+	}
+	sensors := []struct {
+		key, label, class, unit string
+	}{
+		{"temp_f", "Temperature", "temperature", "°F"},
+		{"battery_v", "Battery", "voltage", "V"},
+		{"rssi", "RSSI", "signal_strength", "dBm"},
+	}
+	configs := make(map[string][]byte)
+	for _, s := range sensors {
+		uniqueID := fmt.Sprintf("%s_node%s_%s", c.ClientID, node, s.key)
+		topic := fmt.Sprintf("%s/sensor/%s/config", c.DiscoveryPrefix,
+			uniqueID)
+		payload, _ := json.Marshal(map[string]any{
+			"name":                s.label,
+			"unique_id":           uniqueID,
+			"state_topic":         c.stateTopic(node),
+			"value_template":      "{{ value_json." + s.key + " }}",
+			"device_class":        s.class,
+			"unit_of_measurement": s.unit,
+			"state_class":         "measurement",
+			"availability_topic":  c.availabilityTopic(),
+			"device":              device,
+		})
+		configs[topic] = payload
+	}
+	return configs
+}
+
+// Publish sensor reports from the input channel to an MQTT broker. Latest
+// report for each node is remembered so it can be re-published (retained)
+// after reconnecting. The input channel keeps getting drained while the
+// broker is unreachable so a broker outage never blocks the caller.
+//
+// With QoS 1, the broker acknowledges each publish with a PUBACK. Publishes
+// that go unacknowledged for the keepalive interval mean the connection is
+// stuck, so the publisher reconnects (and publishes the latest values again).
+func StartMQTT(ctx context.Context, c *MQTTConfig, in <-chan SensorData) {
+	// These are for keeping track of connection retry backoff delay
+	baseDelay := mqttConnectDelay
+	maxDelay := 10 * time.Minute
+	connDelay := baseDelay
+
+	// Most recent report for each node
+	latest := make(map[string]SensorData)
+
+	// Packet IDs of unacknowledged QoS 1 publishes and when they got sent
+	var nextID uint16
+	pending := make(map[uint16]time.Time)
+
+	// Closed to stop the current connection's reader goroutine
+	var stopReader chan struct{}
+	defer func() {
+		if stopReader != nil {
+			close(stopReader)
+		}
+	}()
+
+	// Send one packet, closing the connection on error
+	var conn net.Conn
+	send := func(pkt []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := conn.Write(pkt)
+		if err != nil {
+			log.Printf("WARN: MQTT send error: %v", err)
+		}
+		return err
+	}
+
+	// Publish a retained message at the configured QoS
+	publish := func(topic string, payload []byte) error {
+		var id uint16
+		if c.QoS > 0 {
+			nextID++
+			if nextID == 0 {
+				nextID = 1 // 0 isn't a valid packet ID
+			}
+			id = nextID
+			pending[id] = time.Now()
+		}
+		return send(mqttPublishPacket(topic, payload, true, c.QoS, id))
+	}
+
+	// Publish a node's state (and its discovery configs if enabled)
+	publishNode := func(d SensorData, discovered map[string]bool) error {
+		if c.Discovery && !discovered[d.Node] {
+			for topic, payload := range mqttDiscoveryConfigs(c, d.Node) {
+				if err := publish(topic, payload); err != nil {
+					return err
+				}
+			}
+			discovered[d.Node] = true
+		}
+		return publish(c.stateTopic(d.Node), mqttStatePayload(d))
+	}
+
+ConnectLoop:
+	for {
+		if conn != nil {
+			log.Printf("INFO: Closing MQTT connection")
+			conn.Close()
+			conn = nil
+		}
+		if stopReader != nil {
+			close(stopReader)
+			stopReader = nil
+		}
+		// Everything gets published again after reconnecting
+		clear(pending)
+
+		// Wait before connecting, but keep draining the input channel
+		delay := time.NewTimer(connDelay)
+	WaitLoop:
+		for {
+			select {
+			case <-ctx.Done():
+				delay.Stop()
+				log.Printf("DEBUG: MQTT ConnectLoop got <-ctx.Done()")
+				return
+			case d, ok := <-in:
+				if !ok {
+					delay.Stop()
+					return
+				}
+				latest[d.Node] = d
+			case <-delay.C:
+				break WaitLoop
+			}
+		}
+
+		// Connect
+		log.Printf("INFO: MQTT Connecting to %s", c.Broker)
+		var r *bufio.Reader
+		var err error
+		conn, r, err = mqttDial(c)
+		if err != nil {
+			log.Printf("WARN: MQTT connection failed: %v", err)
+			connDelay = ircNextBackoff(connDelay, maxDelay)
+			continue ConnectLoop
+		}
+		connDelay = baseDelay
+		log.Printf("INFO: MQTT connected to %s", c.Broker)
+
+		// Announce availability and re-publish latest values
+		if err := publish(c.availabilityTopic(), []byte("online")); err != nil {
+			continue ConnectLoop
+		}
+		discovered := make(map[string]bool)
+		for _, d := range latest {
+			if err := publishNode(d, discovered); err != nil {
+				continue ConnectLoop
+			}
+		}
+
+		// Reader goroutine watches for PINGRESP, PUBACK, and connection
+		// errors
+		pingResp := make(chan struct{}, 1)
+		pubAck := make(chan uint16, 16)
+		readErr := make(chan error, 1)
+		stopReader = make(chan struct{})
+		go func(r *bufio.Reader, stop <-chan struct{}) {
+			for {
+				header, body, err := mqttReadPacket(r)
+				if err != nil {
+					readErr <- err
+					return
+				}
+				switch {
+				case header&0xF0 == mqttPingResp:
+					select {
+					case pingResp <- struct{}{}:
+					default:
+					}
+				case header&0xF0 == mqttPubAck && len(body) == 2:
+					select {
+					case pubAck <- uint16(body[0])<<8 | uint16(body[1]):
+					case <-stop:
+						return
+					}
+				}
+			}
+		}(r, stopReader)
+
+		// Keep alive by sending PINGREQ at half the keepalive interval
+		keepAlive := time.Duration(c.KeepAlive) * time.Second
+		pingTicker := time.NewTicker(keepAlive / 2)
+		lastPong := time.Now()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Printf("DEBUG: MQTT publisher got <-ctx.Done()")
+				pingTicker.Stop()
+				// Clean disconnect means the broker won't send the LWT, so
+				// publish offline status explicitly first
+				publish(c.availabilityTopic(), []byte("offline"))
+				send(mqttPacket(mqttDisconnect, nil))
+				conn.Close()
+				return
+			case d, ok := <-in:
+				if !ok {
+					pingTicker.Stop()
+					publish(c.availabilityTopic(), []byte("offline"))
+					send(mqttPacket(mqttDisconnect, nil))
+					conn.Close()
+					return
+				}
+				latest[d.Node] = d
+				if err := publishNode(d, discovered); err != nil {
+					pingTicker.Stop()
+					continue ConnectLoop
+				}
+			case <-pingResp:
+				lastPong = time.Now()
+			case id := <-pubAck:
+				delete(pending, id)
+			case <-pingTicker.C:
+				if time.Since(lastPong) > keepAlive+keepAlive/2 {
+					log.Printf("WARN: MQTT broker stopped responding")
+					pingTicker.Stop()
+					continue ConnectLoop
+				}
+				for _, sent := range pending {
+					if time.Since(sent) > keepAlive {
+						log.Printf("WARN: MQTT broker stopped " +
+							"acknowledging publishes")
+						pingTicker.Stop()
+						continue ConnectLoop
+					}
+				}
+				if err := send(mqttPacket(mqttPingReq, nil)); err != nil {
+					pingTicker.Stop()
+					continue ConnectLoop
+				}
+			case err := <-readErr:
+				log.Printf("WARN: MQTT connection lost: %v", err)
+				pingTicker.Stop()
+				continue ConnectLoop
+			}
+		}
+	}
+}
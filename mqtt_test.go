@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// One client connection to an in-process MQTT broker stand-in
+type fakeMQTTConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Start listening for MQTT connections on a free localhost port. Connections
+// come out of the returned channel.
+func newFakeMQTTBroker(t *testing.T) (string, <-chan *fakeMQTTConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan *fakeMQTTConn, 4)
+	var mu sync.Mutex
+	open := []net.Conn{}
+	t.Cleanup(func() {
+		ln.Close()
+		mu.Lock()
+		for _, conn := range open {
+			conn.Close()
+		}
+		mu.Unlock()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			open = append(open, conn)
+			mu.Unlock()
+			conns <- &fakeMQTTConn{conn: conn, r: bufio.NewReader(conn)}
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+// Wait for the next client connection
+func acceptMQTT(t *testing.T, conns <-chan *fakeMQTTConn) *fakeMQTTConn {
+	t.Helper()
+	select {
+	case c := <-conns:
+		return c
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for MQTT connection")
+		return nil
+	}
+}
+
+// Read the next packet from the client
+func (c *fakeMQTTConn) Read(t *testing.T) (byte, []byte) {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	header, body, err := mqttReadPacket(c.r)
+	if err != nil {
+		t.Fatalf("reading MQTT packet: %v", err)
+	}
+	return header, body
+}
+
+// Check the client's CONNECT and accept it
+func (c *fakeMQTTConn) Connect(t *testing.T, clientID string) {
+	t.Helper()
+	header, body := c.Read(t)
+	want := append(mqttString("MQTT"), 4)
+	if header != mqttConnect || !bytes.HasPrefix(body, want) {
+		t.Fatalf("got packet 0x%02x %q, want CONNECT", header, body)
+	}
+	// Clean session and a retained QoS 1 will
+	if flags := body[len(want)]; flags != 0x02|0x04|0x08|0x20 {
+		t.Errorf("got connect flags 0x%02x", flags)
+	}
+	if id := mqttString(clientID); !bytes.Equal(body[10:10+len(id)], id) {
+		t.Errorf("got client ID %q, want %q", body[10:], clientID)
+	}
+	c.conn.Write([]byte{mqttConnAck, 2, 0, 0})
+}
+
+// Check that the next packet is a retained QoS 1 PUBLISH to `topic`,
+// acknowledge it, and return its payload
+func (c *fakeMQTTConn) ExpectPublish(t *testing.T, topic string) []byte {
+	t.Helper()
+	header, body := c.Read(t)
+	if header != mqttPublish|0x02|0x01 {
+		t.Fatalf("got packet 0x%02x, want retained QoS 1 PUBLISH", header)
+	}
+	n := int(body[0])<<8 | int(body[1])
+	if got := string(body[2 : 2+n]); got != topic {
+		t.Fatalf("got topic %q, want %q", got, topic)
+	}
+	id := body[2+n : 4+n]
+	if id[0] == 0 && id[1] == 0 {
+		t.Errorf("got packet ID 0")
+	}
+	c.conn.Write(append([]byte{mqttPubAck, 2}, id...))
+	return body[4+n:]
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	old := mqttConnectDelay
+	mqttConnectDelay = 10 * time.Millisecond
+	t.Cleanup(func() { mqttConnectDelay = old })
+	useTestConfig(t, ServerConfig{})
+
+	addr, conns := newFakeMQTTBroker(t)
+	c := &MQTTConfig{Broker: addr, ClientID: "hub", QoS: 1}
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	in := make(chan SensorData, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() { StartMQTT(ctx, c, in) })
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	// Connect, then publish availability and a report
+	broker := acceptMQTT(t, conns)
+	broker.Connect(t, "hub")
+	if got := broker.ExpectPublish(t, "sensorhub/status"); string(got) !=
+		"online" {
+		t.Errorf("got status %q, want online", got)
+	}
+	in <- SensorData{Timestamp: mustTime(t, "2025-11-17T10:00:00Z"),
+		Node: "2", RSSI: "-63", SNR: "0.0", BatteryV: 3.8, TempF: 64}
+	var state mqttState
+	payload := broker.ExpectPublish(t, "sensorhub/node/2/state")
+	if err := json.Unmarshal(payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Node != "2" || state.TempF != 64 || state.RSSI != -63 {
+		t.Errorf("got state %+v", state)
+	}
+
+	// After the broker drops the connection, the publisher reconnects and
+	// publishes the latest values again
+	broker.conn.Close()
+	broker = acceptMQTT(t, conns)
+	broker.Connect(t, "hub")
+	broker.ExpectPublish(t, "sensorhub/status")
+	payload = broker.ExpectPublish(t, "sensorhub/node/2/state")
+	if err := json.Unmarshal(payload, &state); err != nil || state.TempF != 64 {
+		t.Errorf("got state %s after reconnecting", payload)
+	}
+
+	// Shutting down publishes offline status, then disconnects
+	cancel()
+	if got := broker.ExpectPublish(t, "sensorhub/status"); string(got) !=
+		"offline" {
+		t.Errorf("got status %q, want offline", got)
+	}
+	if header, _ := broker.Read(t); header != mqttDisconnect {
+		t.Errorf("got packet 0x%02x, want DISCONNECT", header)
+	}
+
+	if err := (&MQTTConfig{QoS: 2}).Prepare(); err == nil {
+		t.Errorf("QoS 2 didn't fail")
+	}
+}
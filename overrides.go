@@ -0,0 +1,326 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every config setting can also come from an environment variable or a
+// command line flag, which makes per-host tweaks possible without editing
+// config.json. Flags win over environment variables, which win over the file.
+// Names come from the JSON setting names, for example:
+//
+//	"log_dir"            SSH_LOG_DIR=/data       -log_dir /data
+//	"mqtt": {"broker"}   SSH_MQTT_BROKER=pi:1883 -mqtt.broker pi:1883
+//	"irc": [{"server"}]  SSH_IRC_1_SERVER=pi:6667 -set irc.1.server=pi:6667
+//	"thresholds": {"2"}  SSH_THRESHOLDS_2_LOW_F=40 -set thresholds.2.low_f=40
+//
+// List indexes can be left out to mean the first item (SSH_IRC_SERVER is the
+// server of the first IRC target). Whole lists, maps, and sections take JSON
+// (SSH_IRC='[{...}]'), except lists of strings, which can also be comma
+// separated (SSH_STORAGE=csv,sqlite).
+
+// Prefix of environment variables for config settings
+const configEnvPrefix = "SSH_"
+
+// One setting override from an environment variable or command line flag
+type configOverride struct {
+	source string   // Variable or flag name for error messages
+	path   []string // JSON setting names, like ["mqtt", "broker"]
+	value  string
+}
+
+// Overrides from command line flags, in command line order
+var flagOverrides []configOverride
+
+// Setting names that hold secrets, which -print-config hides
+var configSecrets = map[string]bool{
+	"password": true,
+	"token":    true,
+	"secret":   true,
+	"headers":  true,
+}
+
+// Find the struct field with the given JSON name. Returns ok=false if there
+// isn't one.
+func configField(t reflect.Type, name string) (index int, ok bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.IsExported() && tag != "" && tag != "-" && tag == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Add a command line flag for each setting. Settings inside sections (like
+// mqtt) get dotted names (like -mqtt.broker). Settings inside lists and maps
+// can be set with -set.
+func registerConfigFlags(flags *flag.FlagSet) {
+	var register func(t reflect.Type, prefix []string)
+	register = func(t reflect.Type, prefix []string) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			path := append(append([]string{}, prefix...), name)
+			if f.Type.Kind() == reflect.Struct {
+				register(f.Type, path)
+				continue
+			}
+			flagName := strings.Join(path, ".")
+			usage := fmt.Sprintf("set %s (env %s)", flagName,
+				configEnvName(path))
+			switch {
+			case f.Type == reflect.TypeOf([]string{}):
+				usage = fmt.Sprintf("set %s as a comma separated list "+
+					"(env %s)", flagName, configEnvName(path))
+			case f.Type.Kind() == reflect.Slice || f.Type.Kind() == reflect.Map:
+				usage = fmt.Sprintf("set %s as JSON (env %s)", flagName,
+					configEnvName(path))
+			}
+			set := func(value string) error {
+				flagOverrides = append(flagOverrides,
+					configOverride{"-" + flagName, path, value})
+				return nil
+			}
+			if f.Type.Kind() == reflect.Bool {
+				// Bool settings can be turned on with just -name
+				flags.BoolFunc(flagName, usage, set)
+			} else {
+				flags.Func(flagName, usage, set)
+			}
+		}
+	}
+	register(reflect.TypeOf(ServerConfig{}), nil)
+
+	flags.Func("set", "set any `setting=value`, like irc.1.nick=bot2",
+		func(arg string) error {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return fmt.Errorf("expected setting=value")
+			}
+			flagOverrides = append(flagOverrides, configOverride{
+				"-set " + name, strings.Split(name, "."), value})
+			return nil
+		})
+}
+
+// Environment variable name for a setting path
+func configEnvName(path []string) string {
+	return configEnvPrefix + strings.ToUpper(strings.Join(path, "_"))
+}
+
+// Match the lowercase words of an environment variable name (after the
+// prefix) to a setting path. Setting names have underscores too, so this
+// tries the longest name first. Returns nil if there is no match.
+func configEnvPath(t reflect.Type, words []string) []string {
+	if len(words) == 0 {
+		return []string{}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		for n := len(words); n > 0; n-- {
+			name := strings.Join(words[:n], "_")
+			i, ok := configField(t, name)
+			if !ok {
+				continue
+			}
+			if rest := configEnvPath(t.Field(i).Type, words[n:]); rest != nil {
+				return append([]string{name}, rest...)
+			}
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Struct {
+			break
+		}
+		if _, err := strconv.Atoi(words[0]); err == nil {
+			if rest := configEnvPath(t.Elem(), words[1:]); rest != nil {
+				return append([]string{words[0]}, rest...)
+			}
+			break
+		}
+		return configEnvPath(t.Elem(), words)
+	case reflect.Map:
+		if rest := configEnvPath(t.Elem(), words[1:]); rest != nil {
+			return append([]string{words[0]}, rest...)
+		}
+	}
+	return nil
+}
+
+// Collect overrides from SSH_* environment variables, sorted by name so list
+// items get added in order. Variables that don't match a setting get ignored,
+// since SSH_ is also used by ssh (e.g. SSH_CONNECTION).
+func envOverrides() []configOverride {
+	overrides := []configOverride{}
+	t := reflect.TypeOf(ServerConfig{})
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, configEnvPrefix)
+		if !ok || rest == "" {
+			continue
+		}
+		path := configEnvPath(t, strings.Split(strings.ToLower(rest), "_"))
+		if len(path) > 0 {
+			overrides = append(overrides, configOverride{name, path, value})
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].source < overrides[j].source
+	})
+	return overrides
+}
+
+// Apply environment and flag overrides to a config, in that order
+func (c *ServerConfig) applyOverrides() error {
+	for _, o := range append(envOverrides(), flagOverrides...) {
+		err := setConfigValue(reflect.ValueOf(c).Elem(), o.path, o.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", o.source, err)
+		}
+	}
+	return nil
+}
+
+// Set the setting at `path` inside `v` from text. Missing list items up to
+// the index and missing map entries get created.
+func setConfigValue(v reflect.Value, path []string, text string) error {
+	if len(path) == 0 {
+		return setConfigText(v, text)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		i, ok := configField(v.Type(), path[0])
+		if !ok {
+			return fmt.Errorf("unknown setting %q", path[0])
+		}
+		return setConfigValue(v.Field(i), path[1:], text)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			break
+		}
+		i, err := strconv.Atoi(path[0])
+		if err != nil {
+			i = 0 // Index left out means the first item
+		} else {
+			path = path[1:]
+		}
+		if i < 0 || i > v.Len() {
+			return fmt.Errorf("list index %d out of range (%d items)", i,
+				v.Len())
+		}
+		if i == v.Len() {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		}
+		return setConfigValue(v.Index(i), path, text)
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.ValueOf(path[0])
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if old := v.MapIndex(key); old.IsValid() {
+			elem.Set(old)
+		}
+		if err := setConfigValue(elem, path[1:], text); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	}
+	return fmt.Errorf("%q is not a setting section, list, or map", path[0])
+}
+
+// Parse text into one setting value
+func setConfigText(v reflect.Value, text string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", text)
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", text)
+		}
+		v.SetInt(int64(n))
+		return nil
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", text)
+		}
+		v.SetFloat(f)
+		return nil
+	case reflect.Slice:
+		trimmed := strings.TrimSpace(text)
+		if v.Type().Elem().Kind() == reflect.String &&
+			!strings.HasPrefix(trimmed, "[") {
+			// Comma separated list of strings
+			list := []string{}
+			for _, s := range strings.Split(trimmed, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+			v.Set(reflect.ValueOf(list))
+			return nil
+		}
+	}
+	// Everything else (lists, maps, sections, optional numbers) is JSON
+	p := reflect.New(v.Type())
+	if err := json.Unmarshal([]byte(text), p.Interface()); err != nil {
+		return fmt.Errorf("bad JSON value: %v", err)
+	}
+	v.Set(p.Elem())
+	return nil
+}
+
+// Format a config as indented JSON with secrets hidden (for -print-config)
+func formatConfig(c *ServerConfig) ([]byte, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	var hide func(node any)
+	hide = func(node any) {
+		switch n := node.(type) {
+		case map[string]any:
+			for k, v := range n {
+				if configSecrets[k] && v != nil && v != "" {
+					n[k] = "********"
+				} else {
+					hide(v)
+				}
+			}
+		case []any:
+			for _, v := range n {
+				hide(v)
+			}
+		}
+	}
+	hide(tree)
+	return json.MarshalIndent(tree, "", "  ")
+}
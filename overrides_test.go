@@ -0,0 +1,185 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"flag"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Parse command line flags for config settings for the rest of the test
+func useConfigFlags(t *testing.T, args ...string) {
+	t.Helper()
+	old := flagOverrides
+	flagOverrides = nil
+	t.Cleanup(func() { flagOverrides = old })
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	registerConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	useConfigFlags(t)
+	for name, value := range map[string]string{
+		"SSH_LOG_DIR":            "/data/logs",
+		"SSH_LOG_COMPRESS":       "true",
+		"SSH_HISTORY_HOURS":      "48",
+		"SSH_CLOCK_SPEED":        "2.5",
+		"SSH_STORAGE":            "csv, sqlite",
+		"SSH_WINDOWS":            `["1h","7d"]`,
+		"SSH_MQTT_BROKER":        "pi:1883",
+		"SSH_MQTT_KEEPALIVE":     "30",
+		"SSH_IRC_SERVER":         "pi:6667",
+		"SSH_IRC_1_NICK":         "bot2",
+		"SSH_NODE_COLORS":        `{"1":"teal"}`,
+		"SSH_THRESHOLDS_2_LOW_F": "40",
+		"SSH_CONNECTION":         "10.0.0.2 22 10.0.0.1 22",
+	} {
+		t.Setenv(name, value)
+	}
+	c := ServerConfig{IRC: []IRCTarget{{Nick: "bot1"}}}
+	if err := c.applyOverrides(); err != nil {
+		t.Fatal(err)
+	}
+	if c.LogDir != "/data/logs" || !c.LogCompress || c.HistoryHours != 48 {
+		t.Errorf("got log_dir %q, log_compress %v, history_hours %d",
+			c.LogDir, c.LogCompress, c.HistoryHours)
+	}
+	if c.ClockSpeed == nil || *c.ClockSpeed != 2.5 {
+		t.Errorf("got clock_speed %v", c.ClockSpeed)
+	}
+	if !slices.Equal(c.Storage, []string{"csv", "sqlite"}) ||
+		!slices.Equal(c.Windows, []string{"1h", "7d"}) {
+		t.Errorf("got storage %q, windows %q", c.Storage, c.Windows)
+	}
+	if c.MQTT.Broker != "pi:1883" || c.MQTT.KeepAlive != 30 {
+		t.Errorf("got mqtt %+v", c.MQTT)
+	}
+	// SSH_IRC_SERVER is the first target's server, and SSH_IRC_1_NICK adds a
+	// second target
+	if len(c.IRC) != 2 || c.IRC[0].Server != "pi:6667" ||
+		c.IRC[0].Nick != "bot1" || c.IRC[1].Nick != "bot2" {
+		t.Errorf("got irc %+v", c.IRC)
+	}
+	if c.NodeColors["1"] != "teal" {
+		t.Errorf("got node_colors %v", c.NodeColors)
+	}
+	if low := c.Thresholds["2"].LowF; low == nil || *low != 40 {
+		t.Errorf("got thresholds %+v", c.Thresholds)
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	// Flags win over environment variables, which win over the file
+	path := writeTestConfig(t, t.TempDir(), `{
+  "log_dir": "file-logs",
+  "store_dir": "file-store",
+  "sqlite_path": "file.db",
+  "mqtt": {"broker": "file:1883", "qos": 1}
+}`)
+	t.Setenv("SSH_LOG_DIR", "env-logs")
+	t.Setenv("SSH_STORE_DIR", "env-store")
+	t.Setenv("SSH_MQTT_BROKER", "env:1883")
+	useConfigFlags(t, "-log_dir", "flag-logs", "-set",
+		"mqtt.broker=flag:1883")
+	c, err := ReadServerConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogDir != "flag-logs" || c.StoreDir != "env-store" ||
+		c.SQLitePath != "file.db" {
+		t.Errorf("got log_dir %q, store_dir %q, sqlite_path %q", c.LogDir,
+			c.StoreDir, c.SQLitePath)
+	}
+	if c.MQTT.Broker != "flag:1883" || c.MQTT.QoS != 1 {
+		t.Errorf("got mqtt %+v", c.MQTT)
+	}
+}
+
+func TestOverrideErrors(t *testing.T) {
+	tests := []struct {
+		env, value string
+		flags      []string
+		want       string
+	}{
+		{"SSH_HISTORY_HOURS", "many", nil,
+			`SSH_HISTORY_HOURS: expected an integer, got "many"`},
+		{"SSH_LOG_COMPRESS", "yes please", nil,
+			`SSH_LOG_COMPRESS: expected true or false, got "yes please"`},
+		{"SSH_CLOCK_SPEED", "fast", nil,
+			"SSH_CLOCK_SPEED: bad JSON value: invalid character 's' in " +
+				"literal false (expecting 'l')"},
+		{"SSH_NODE_COLORS", "teal", nil,
+			"SSH_NODE_COLORS: bad JSON value: invalid character 'e' in " +
+				"literal true (expecting 'r')"},
+		{"", "", []string{"-mqtt.qos", "one"},
+			`-mqtt.qos: expected an integer, got "one"`},
+		{"", "", []string{"-set", "irc.2.nick=bot3"},
+			"-set irc.2.nick: list index 2 out of range (0 items)"},
+		{"", "", []string{"-set", "nodes=1"},
+			`-set nodes: unknown setting "nodes"`},
+		{"", "", []string{"-set", "log_dir.x=1"},
+			`-set log_dir.x: "x" is not a setting section, list, or map`},
+	}
+	for _, tt := range tests {
+		source, _, _ := strings.Cut(tt.want, ":")
+		t.Run(source, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(tt.env, tt.value)
+			}
+			useConfigFlags(t, tt.flags...)
+			c := ServerConfig{}
+			err := c.applyOverrides()
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatConfigSecrets(t *testing.T) {
+	c := &ServerConfig{
+		MQTT: MQTTConfig{Broker: "pi:1883", Username: "hub",
+			Password: "hunter2"},
+		Webhooks: []WebhookConfig{
+			{URL: "https://example.com/hook", Secret: "s3cret",
+				Headers: map[string]string{"Authorization": "Bearer abc"}},
+			{URL: "https://example.com/open"},
+		},
+		InfluxDB: InfluxConfig{URL: "http://pi:8086/write?db=hub",
+			Token: "influx-token"},
+	}
+	data, err := formatConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, secret := range []string{"hunter2", "s3cret", "Bearer abc",
+		"influx-token"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("print-config shows secret %q:\n%s", secret, out)
+		}
+	}
+	for _, want := range []string{
+		`"password": "********"`,
+		`"secret": "********"`,
+		`"headers": "********"`,
+		`"token": "********"`,
+		`"username": "hub"`,
+		`"url": "https://example.com/hook"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("print-config is missing %s:\n%s", want, out)
+		}
+	}
+	// Unset secrets stay empty, so they don't look set
+	if n := strings.Count(out, "********"); n != 4 {
+		t.Errorf("got %d hidden values, want 4:\n%s", n, out)
+	}
+}
@@ -0,0 +1,42 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Open a pseudo terminal to stand in for the USB serial device. Returns the
+// controller side, which gets written to, and the path of the terminal side
+// (like /dev/pts/3), which serialMonitor can read like a serial port.
+func openPty() (*os.File, string, error) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	ioctl := func(req uintptr, arg unsafe.Pointer) error {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), req,
+			uintptr(arg))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+	var n uint32
+	if err := ioctl(syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		ptmx.Close()
+		return nil, "", fmt.Errorf("getting pty number: %v", err)
+	}
+	var unlock int32
+	if err := ioctl(syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		ptmx.Close()
+		return nil, "", fmt.Errorf("unlocking pty: %v", err)
+	}
+	return ptmx, fmt.Sprintf("/dev/pts/%d", n), nil
+}
@@ -0,0 +1,16 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Pseudo terminals are only supported on Linux
+func openPty() (*os.File, string, error) {
+	return nil, "", errors.New("pty is only supported on Linux")
+}
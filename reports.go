@@ -3,6 +3,10 @@
 package main
 
 import (
+	"math"
+	"slices"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -11,52 +15,327 @@ type Report struct {
 	Timestamp time.Time
 	TempF     float64
 	BatteryV  float64
+	Humidity  float64 // Relative humidity % (NaN if not measured)
 }
 
-// 36-hour rolling history of reports for one sensor node
+// Default hours of reports to keep in the rolling history
+const defaultHistoryHours = 36
+
+// Default limit on the number of reports kept per node, to bound memory if a
+// node reports much faster than expected
+const defaultHistoryMaxReports = 20000
+
+// Rate of change is measured over this much time before the newest report,
+// and needs at least rateMinSpan of reports to be meaningful
+const (
+	rateWindow  = time.Hour
+	rateMinSpan = 10 * time.Minute
+)
+
+// Rolling history of reports for one sensor node, with statistics for each
+// of the configured windows (see HistoryWindows). Reports get kept for the
+// longest window. Statistics get updated incrementally as reports are added
+// and pruned, so adding a report takes amortized O(1) time per window
+// however many reports the windows hold.
 type ReportHistory struct {
-	Reports  []Report
-	MinTempF float64
-	MaxTempF float64
+	Reports []Report // Reports in the longest window, oldest first
+	// Statistics for the history_hours window (36 hours by default)
+	MinTempF    float64
+	MaxTempF    float64
+	MeanTempF   float64
+	StdDevTempF float64
+	// Temperature change in °F per hour over the last hour (0 if there
+	// isn't enough data)
+	RateFPerHour float64
+	// Min and max since midnight in the display timezone (0 if no reports)
+	TodayMinTempF float64
+	TodayMaxTempF float64
+	// Statistics for every window, today first, then shortest to longest
+	Windows []WindowStats
+	// Temperature ranges by local day, oldest first, for growing degree
+	// days (these go back further than Reports)
+	Days []DayRange
+
+	buf      []Report  // Backing array, with pruned reports before off
+	off      int       // Index of Reports[0] in buf
+	first    int       // Sequence number of Reports[0]
+	rateFrom int       // Sequence number of the oldest report in rate
+	history  int       // Index of the history_hours window in Windows
+	dayEnd   time.Time // End of the last day in Days
+}
+
+// Get the start of the day (local midnight in the display timezone) that
+// time `t` falls on. On DST change days, this is still the real start of the
+// day, even if midnight doesn't exist or a day is 23 or 25 hours long.
+func localDayStart(t time.Time) time.Time {
+	loc := cfg.Location()
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// Get the temperature of the report with sequence number `seq`
+func (h *ReportHistory) tempF(seq int) float64 {
+	return h.Reports[seq-h.first].TempF
 }
 
-// Add a new report and prune anything older than 36 hours.
-// Also recomputes min and max temperatures after pruning.
+// Set up the windows the first time a report gets added
+func (h *ReportHistory) initWindows() {
+	history := windowName(cfg.HistoryWindow())
+	for _, w := range cfg.HistoryWindows() {
+		if w.name == history {
+			h.history = len(h.Windows)
+		}
+		h.Windows = append(h.Windows,
+			WindowStats{Name: w.name, d: w.d, start: h.first})
+	}
+}
+
+// Add a new report without humidity (see AddReport)
 func (h *ReportHistory) Add(timestamp time.Time, batteryV, tempF float64) {
-	// Build and append the new report
-	r := Report{
+	h.AddReport(Report{
 		Timestamp: timestamp,
 		TempF:     tempF,
 		BatteryV:  batteryV,
+		Humidity:  math.NaN(),
+	})
+}
+
+// Add a new report, prune anything older than the longest window (or beyond
+// the history_max_reports limit), then update the statistics
+func (h *ReportHistory) AddReport(r Report) {
+	if h.Windows == nil {
+		h.initWindows()
+	}
+	h.push(r)
+	h.addDay(r.Timestamp, r.TempF)
+
+	// Prune reports older than all the windows, and the oldest reports if
+	// there are too many
+	now := clock.Now()
+	cutoff := now.Add(-cfg.RetentionWindow())
+	if today := h.Windows[0].cutoff(now); today.Before(cutoff) {
+		cutoff = today
 	}
-	h.Reports = append(h.Reports, r)
+	n := max(0, len(h.Reports)-cfg.HistoryLimit())
+	for n < len(h.Reports) && h.Reports[n].Timestamp.Before(cutoff) {
+		n++
+	}
+	for i := range h.Windows {
+		h.Windows[i].advance(h, h.first+n, now)
+	}
+	h.drop(n)
 
-	// Prune reports older than 36 hours
-	cutoff := time.Now().Add(-36 * time.Hour)
-	i := 0
-	for i < len(h.Reports) && h.Reports[i].Timestamp.Before(cutoff) {
-		i++
+	histWin := &h.Windows[h.history]
+	h.MinTempF, h.MaxTempF = histWin.MinTempF, histWin.MaxTempF
+	h.MeanTempF, h.StdDevTempF = histWin.MeanTempF, histWin.StdDevTempF
+	today := &h.Windows[0]
+	h.TodayMinTempF, h.TodayMaxTempF = today.MinTempF, today.MaxTempF
+	h.RateFPerHour = 0
+	if len(h.Reports) > 0 {
+		h.updateRate()
 	}
-	if i > 0 {
-		h.Reports = h.Reports[i:]
+}
+
+// Append a report, and add it to the windows
+func (h *ReportHistory) push(r Report) {
+	// Reuse the backing array once pruned reports fill half of it, rather
+	// than letting append move the window to a bigger array
+	if len(h.buf) == cap(h.buf) && h.off > 0 && h.off >= len(h.buf)/2 {
+		n := copy(h.buf, h.buf[h.off:])
+		h.buf = h.buf[:n]
+		h.off = 0
+		h.Reports = h.buf
+		for i := range h.Windows {
+			h.Windows[i].resum(h)
+		}
 	}
+	h.buf = append(h.buf, r)
+	h.Reports = h.buf[h.off:]
+	seq := h.first + len(h.Reports) - 1
+	for i := range h.Windows {
+		h.Windows[i].push(h, seq, r.TempF)
+	}
+}
 
-	// Recompute min/max after prune
+// Remove the oldest `n` reports (after the windows have moved past them)
+func (h *ReportHistory) drop(n int) {
+	h.first += n
+	h.off += n
+	h.Reports = h.buf[h.off:]
 	if len(h.Reports) == 0 {
-		h.MinTempF = 0
-		h.MaxTempF = 0
-		return
-	}
-	min := h.Reports[0].TempF
-	max := h.Reports[0].TempF
-	for _, r := range h.Reports[1:] {
-		if r.TempF < min {
-			min = r.TempF
+		// Empty, so start over at the beginning of the backing array
+		h.buf, h.off = h.buf[:0], 0
+	}
+}
+
+// Update the rate of change from the reports in the last rateWindow
+func (h *ReportHistory) updateRate() {
+	last := h.Reports[len(h.Reports)-1]
+	start := last.Timestamp.Add(-rateWindow)
+	h.rateFrom = max(h.rateFrom, h.first)
+	for h.Reports[h.rateFrom-h.first].Timestamp.Before(start) {
+		h.rateFrom++
+	}
+	from := h.Reports[h.rateFrom-h.first]
+	span := last.Timestamp.Sub(from.Timestamp)
+	if span >= rateMinSpan {
+		h.RateFPerHour = (last.TempF - from.TempF) / span.Hours()
+	}
+}
+
+// Get the statistics for a window by name, however it's written (like "1d"
+// for "24h"). Returns nil if there is no such window.
+func (h *ReportHistory) Window(name string) *WindowStats {
+	w, err := parseWindow(name)
+	if err != nil {
+		return nil
+	}
+	for i := range h.Windows {
+		if h.Windows[i].Name == w.name {
+			return &h.Windows[i]
 		}
-		if r.TempF > max {
-			max = r.TempF
+	}
+	return nil
+}
+
+// Get the p-th percentile (0 to 100) of the temperatures in the
+// history_hours window, to the nearest degree (0 if there are no reports)
+func (h *ReportHistory) PercentileTempF(p float64) float64 {
+	if h.Windows == nil {
+		return 0
+	}
+	return h.Windows[h.history].PercentileTempF(p)
+}
+
+// Get a deep copy of the history, which doesn't share anything with it
+func (h *ReportHistory) Clone() *ReportHistory {
+	c := *h
+	c.buf = slices.Clone(h.Reports)
+	c.off = 0
+	c.Reports = c.buf
+	c.Windows = slices.Clone(h.Windows)
+	c.Days = slices.Clone(h.Days)
+	for i := range c.Windows {
+		c.Windows[i].minQ = slices.Clone(c.Windows[i].minQ)
+		c.Windows[i].maxQ = slices.Clone(c.Windows[i].maxQ)
+	}
+	return &c
+}
+
+// Get a copy of the history for reading, with only the parts in `parts`. The
+// copy doesn't share anything that changes with the history, but it also
+// leaves out what adding reports needs, so reports can't be added to it.
+func (h *ReportHistory) readCopy(parts snapshotParts,
+	since time.Time) *ReportHistory {
+
+	c := &ReportHistory{RateFPerHour: h.RateFPerHour}
+	if parts&snapReports != 0 {
+		i, _ := slices.BinarySearchFunc(h.Reports, since,
+			func(r Report, t time.Time) int { return r.Timestamp.Compare(t) })
+		i = min(i, max(0, len(h.Reports)-1))
+		c.Reports = slices.Clone(h.Reports[i:])
+	} else if n := len(h.Reports); n > 0 {
+		c.Reports = []Report{h.Reports[n-1]}
+	}
+	if parts&snapStats != 0 {
+		c.MinTempF, c.MaxTempF = h.MinTempF, h.MaxTempF
+		c.MeanTempF, c.StdDevTempF = h.MeanTempF, h.StdDevTempF
+		c.TodayMinTempF, c.TodayMaxTempF = h.TodayMinTempF, h.TodayMaxTempF
+		c.history = h.history
+		c.Windows = slices.Clone(h.Windows)
+		for i := range c.Windows {
+			c.Windows[i].minQ, c.Windows[i].maxQ = nil, nil
 		}
+		c.Days = slices.Clone(h.Days)
+	}
+	return c
+}
+
+// Parts of the histories to copy in a snapshot (the latest report of each
+// node always gets copied)
+type snapshotParts int
+
+const (
+	snapReports snapshotParts = 1 << iota // Reports in the chart's window
+	snapStats                             // Window statistics and daily ranges
+)
+
+// Concurrency-safe store of the node report histories. The main goroutine
+// adds reports, and other goroutines (chart ticker, web server) read copies
+// from Snapshot, so nobody ever reads a history while it's being changed.
+// The main goroutine itself can read the histories in place with Read.
+type HistoryStore struct {
+	mu        sync.RWMutex
+	histories NodeHistories
+}
+
+// Make a history store starting with `histories`, which the store takes
+// ownership of (nil means start empty)
+func NewHistoryStore(histories NodeHistories) *HistoryStore {
+	if histories == nil {
+		histories = make(NodeHistories)
+	}
+	return &HistoryStore{histories: histories}
+}
+
+// Add a report to a node's history, creating the history if needed
+func (s *HistoryStore) Add(node string, r Report) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, exists := s.histories[node]
+	if !exists {
+		h = &ReportHistory{}
+		s.histories[node] = h
+	}
+	h.AddReport(r)
+}
+
+// Get copies of the histories (or just those of `nodes`, if any) with the
+// parts the caller needs, which are safe to read without locking and don't
+// change when new reports arrive. Reports go back as far as the chart's
+// history_hours window.
+func (s *HistoryStore) Snapshot(parts snapshotParts,
+	nodes ...string) NodeHistories {
+
+	since := clock.Now().Add(-cfg.HistoryWindow())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snapshot := make(NodeHistories, len(s.histories))
+	for node, h := range s.histories {
+		if len(nodes) == 0 || slices.Contains(nodes, node) {
+			snapshot[node] = h.readCopy(parts, since)
+		}
+	}
+	return snapshot
+}
+
+// Call `f` with the histories themselves, which it must only read and not
+// keep. Unlike Snapshot, this doesn't copy anything, but it holds up adding
+// reports until `f` returns.
+func (s *HistoryStore) Read(f func(NodeHistories)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f(s.histories)
+}
+
+// List the node IDs that have a history, sorted
+func (s *HistoryStore) Nodes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nodes := make([]string, 0, len(s.histories))
+	for node := range s.histories {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Count the nodes and reports in the histories
+func (s *HistoryStore) Counts() (nodes, reports int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, h := range s.histories {
+		reports += len(h.Reports)
 	}
-	h.MinTempF = min
-	h.MaxTempF = max
+	return len(s.histories), reports
 }
@@ -0,0 +1,318 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReportHistoryAddPrunes(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC"})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	fake := useFakeClock(t, now)
+
+	h := &ReportHistory{}
+	// 40, 30, and 20 hours ago, then now
+	for _, hoursAgo := range []int{40, 30, 20, 0} {
+		ts := now.Add(-time.Duration(hoursAgo) * time.Hour)
+		h.Add(ts, 3.8, float64(50+hoursAgo))
+	}
+	// The report from 40 hours ago is outside the 36 hour window
+	if len(h.Reports) != 3 {
+		t.Fatalf("got %d reports, want 3", len(h.Reports))
+	}
+	if h.MinTempF != 50 || h.MaxTempF != 80 {
+		t.Errorf("got min/max %v/%v, want 50/80", h.MinTempF, h.MaxTempF)
+	}
+
+	// Another 10 hours later, the 30 hour old report falls out too
+	fake.Advance(10 * time.Hour)
+	h.Add(fake.Now(), 3.8, 60)
+	if len(h.Reports) != 3 {
+		t.Fatalf("got %d reports, want 3", len(h.Reports))
+	}
+	if h.MinTempF != 50 || h.MaxTempF != 70 {
+		t.Errorf("got min/max %v/%v, want 50/70", h.MinTempF, h.MaxTempF)
+	}
+
+	// Shorter windows cover only the most recent reports
+	fake.Advance(time.Minute)
+	h.Add(fake.Now(), 3.8, 65)
+	for _, tt := range []struct {
+		window   string
+		min, max float64
+		count    int
+	}{{"1h", 60, 65, 2}, {"1d", 50, 65, 3}, {"36h", 50, 70, 4}} {
+		w := h.Window(tt.window)
+		if w == nil {
+			t.Errorf("no %s window", tt.window)
+		} else if w.MinTempF != tt.min || w.MaxTempF != tt.max ||
+			w.Count != tt.count {
+			t.Errorf("%s window: got min/max %v/%v of %d reports, "+
+				"want %v/%v of %d", tt.window, w.MinTempF, w.MaxTempF,
+				w.Count, tt.min, tt.max, tt.count)
+		}
+	}
+}
+
+func TestReportHistoryToday(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "America/Chicago"})
+	// 6am in Chicago, so midnight was 6 hours ago
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	useFakeClock(t, now)
+
+	h := &ReportHistory{}
+	h.Add(now.Add(-8*time.Hour), 3.8, 30) // Yesterday evening
+	h.Add(now.Add(-5*time.Hour), 3.8, 40)
+	h.Add(now, 3.8, 45)
+	if h.TodayMinTempF != 40 || h.TodayMaxTempF != 45 {
+		t.Errorf("got today min/max %v/%v, want 40/45", h.TodayMinTempF,
+			h.TodayMaxTempF)
+	}
+	if h.MinTempF != 30 || h.MaxTempF != 45 {
+		t.Errorf("got min/max %v/%v, want 30/45", h.MinTempF, h.MaxTempF)
+	}
+}
+
+func TestReportHistoryStats(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC", HistoryHours: 2,
+		HistoryMaxReports: 50, Windows: []string{"30m", "4h"}})
+	fake := useFakeClock(t, mustTime(t, "2025-11-17T00:00:00Z"))
+
+	// Random reports at uneven intervals, so the windows are sometimes
+	// limited by time and sometimes by history_max_reports
+	rng := rand.New(rand.NewSource(1))
+	h := &ReportHistory{}
+	for i := range 2000 {
+		fake.Advance(time.Duration(rng.Intn(300)) * time.Second)
+		h.Add(fake.Now(), 3.8, math.Round(600*rng.Float64())/10)
+		if len(h.Reports) > 50 || len(h.Reports) == 0 {
+			t.Fatalf("report %d: got %d reports", i, len(h.Reports))
+		}
+		names := []string{}
+		for _, w := range h.Windows {
+			names = append(names, w.Name)
+		}
+		if !slices.Equal(names, []string{"today", "30m", "2h", "4h"}) {
+			t.Fatalf("got windows %v", names)
+		}
+
+		// Compare against the stats worked out the slow way
+		for _, w := range h.Windows {
+			cutoff := w.cutoff(fake.Now())
+			want := []float64{}
+			for _, r := range h.Reports {
+				if !r.Timestamp.Before(cutoff) {
+					want = append(want, r.TempF)
+				}
+			}
+			if len(want) != w.Count {
+				t.Fatalf("report %d, %s: got %d reports, want %d", i,
+					w.Name, w.Count, len(want))
+			}
+			if len(want) == 0 {
+				continue
+			}
+			mean, sumSq := 0.0, 0.0
+			for _, v := range want {
+				mean += v / float64(len(want))
+			}
+			for _, v := range want {
+				sumSq += (v - mean) * (v - mean)
+			}
+			stdDev := math.Sqrt(sumSq / float64(len(want)))
+			if w.MinTempF != slices.Min(want) ||
+				w.MaxTempF != slices.Max(want) {
+				t.Fatalf("report %d, %s: got min/max %v/%v, want %v/%v", i,
+					w.Name, w.MinTempF, w.MaxTempF, slices.Min(want),
+					slices.Max(want))
+			}
+			// Standard deviations near 0 magnify rounding errors, but
+			// that's still well beyond the 0.1°F the hub displays
+			if math.Abs(w.MeanTempF-mean) > 1e-6 ||
+				math.Abs(w.StdDevTempF-stdDev) > 1e-4 {
+				t.Fatalf("report %d, %s: got mean/stddev %v/%v, want %v/%v",
+					i, w.Name, w.MeanTempF, w.StdDevTempF, mean, stdDev)
+			}
+		}
+		if w := h.Window("2h"); h.MinTempF != w.MinTempF ||
+			h.MeanTempF != w.MeanTempF {
+			t.Fatalf("report %d: history_hours stats don't match", i)
+		}
+	}
+
+	// Memory stays bounded however many reports go through the windows
+	if c := cap(h.buf); c > 4*50 {
+		t.Errorf("backing array grew to %d reports", c)
+	}
+}
+
+func TestReportHistoryPercentileAndRate(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC"})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	fake := useFakeClock(t, now)
+
+	h := &ReportHistory{}
+	if h.PercentileTempF(50) != 0 {
+		t.Errorf("empty history has a median")
+	}
+	// 50°F two hours ago, then 60°F to 70°F over the last hour
+	h.Add(now.Add(-2*time.Hour), 3.8, 50)
+	h.Add(now.Add(-time.Hour), 3.8, 60)
+	h.Add(now.Add(-30*time.Minute), 3.8, 64)
+	h.Add(now, 3.8, 70)
+	if h.RateFPerHour != 10 {
+		t.Errorf("got rate %v°F/h, want 10", h.RateFPerHour)
+	}
+	tests := []struct{ p, want float64 }{
+		{0, 50}, {50, 64}, {100, 70}, {-5, 50}, {200, 70},
+	}
+	for _, tt := range tests {
+		if got := h.PercentileTempF(tt.p); got != tt.want {
+			t.Errorf("PercentileTempF(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+
+	// A report only a few minutes after the rest isn't enough for a rate
+	fake.Advance(2 * time.Hour)
+	h.Add(fake.Now().Add(-5*time.Minute), 3.8, 70)
+	h.Add(fake.Now(), 3.8, 72)
+	if h.RateFPerHour != 0 {
+		t.Errorf("got rate %v°F/h from 5 minutes of reports", h.RateFPerHour)
+	}
+
+	// Clones don't share anything with the original
+	c := h.Clone()
+	h.Add(fake.Now(), 3.8, 20)
+	if c.MinTempF == 20 || len(c.Reports) == len(h.Reports) ||
+		c.PercentileTempF(0) == 20 {
+		t.Errorf("clone changed when the original did")
+	}
+}
+
+func TestHistoryStoreSnapshot(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC", HistoryHours: 2,
+		Windows: []string{"4h"}})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	useFakeClock(t, now)
+	s := NewHistoryStore(nil)
+	for _, r := range []struct {
+		node  string
+		ago   time.Duration
+		tempF float64
+	}{
+		{"1", 3 * time.Hour, 40}, {"1", time.Hour, 50}, {"1", 0, 60},
+		{"2", 3 * time.Hour, 70},
+	} {
+		s.Add(r.node, Report{Timestamp: now.Add(-r.ago), TempF: r.tempF,
+			Humidity: math.NaN()})
+	}
+
+	// The chart gets reports in the history_hours window (or at least the
+	// latest), but no statistics
+	chart := s.Snapshot(snapReports)
+	if len(chart["1"].Reports) != 2 || len(chart["2"].Reports) != 1 ||
+		chart["1"].Windows != nil || chart["1"].Days != nil {
+		t.Errorf("got chart snapshot %+v", chart)
+	}
+
+	// Statistics come with only the latest report
+	stats := s.Snapshot(snapStats, "1")
+	h := stats["1"]
+	if len(stats) != 1 || len(h.Reports) != 1 || h.Reports[0].TempF != 60 {
+		t.Fatalf("got stats snapshot %+v", stats)
+	}
+	if w := h.Window("4h"); w == nil || w.MinTempF != 40 ||
+		w.PercentileTempF(50) != 50 || h.MaxTempF != 60 {
+		t.Errorf("got windows %+v", h.Windows)
+	}
+
+	// Snapshots don't change when reports get added
+	s.Add("1", Report{Timestamp: now, TempF: 20, Humidity: math.NaN()})
+	if h.Window("4h").MinTempF != 40 || len(h.Days) != 1 ||
+		h.Days[0].MinTempF != 40 {
+		t.Errorf("snapshot changed when the store did")
+	}
+	s.Read(func(histories NodeHistories) {
+		if histories["1"].MinTempF != 20 {
+			t.Errorf("got min %v from Read, want 20", histories["1"].MinTempF)
+		}
+	})
+}
+
+// Adding reports from many nodes and formatting IRC messages about them, the
+// way the main goroutine does for each report
+func BenchmarkHistoryStoreIngest(b *testing.B) {
+	useTestConfig(b, ServerConfig{Timezone: "UTC", IRC: []IRCTarget{{
+		Server: "irc.test:6667", Nick: "hub", Channels: []string{"#test"},
+		Mode: ircModeMessage}}})
+	fake := useFakeClock(b, time.Date(2025, 11, 17, 0, 0, 0, 0, time.UTC))
+	s := NewHistoryStore(nil)
+	rng := rand.New(rand.NewSource(1))
+	i := 0
+	for b.Loop() {
+		fake.Advance(100 * time.Millisecond)
+		node := strconv.Itoa(i % 200)
+		i++
+		s.Add(node, Report{Timestamp: fake.Now(), BatteryV: 3.8,
+			TempF: 40 + 30*rng.Float64(), Humidity: math.NaN()})
+		s.Read(func(h NodeHistories) { cfg.IRC[0].Format(h, node) })
+	}
+}
+
+func BenchmarkReportHistoryAdd(b *testing.B) {
+	useTestConfig(b, ServerConfig{Timezone: "UTC", HistoryHours: 24 * 7})
+	fake := useFakeClock(b, time.Date(2025, 11, 17, 0, 0, 0, 0, time.UTC))
+
+	// A week of reports every 30 seconds fills the window
+	h := &ReportHistory{}
+	rng := rand.New(rand.NewSource(1))
+	for b.Loop() {
+		fake.Advance(30 * time.Second)
+		h.Add(fake.Now(), 3.8, 40+30*rng.Float64())
+	}
+}
+
+func TestLocalDayStartDST(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "America/Chicago"})
+	tests := []struct{ t, want string }{
+		// Day before the fall DST change (CDT)
+		{"2025-11-01T20:00:00Z", "2025-11-01T00:00:00-05:00"},
+		// Fall DST change day is 25 hours long and starts in CDT
+		{"2025-11-03T05:30:00Z", "2025-11-02T00:00:00-05:00"},
+		// Spring DST change day is 23 hours long and starts in CST
+		{"2025-03-09T12:00:00Z", "2025-03-09T00:00:00-06:00"},
+	}
+	for _, tt := range tests {
+		got := localDayStart(mustTime(t, tt.t))
+		if want := mustTime(t, tt.want); !got.Equal(want) {
+			t.Errorf("localDayStart(%s) = %v, want %v", tt.t, got, want)
+		}
+	}
+}
+
+func TestFormatReportSummary(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC"})
+	now := mustTime(t, "2025-11-16T23:43:00Z")
+	useFakeClock(t, now)
+
+	histories := NodeHistories{"1": {}, "2": {}}
+	histories["1"].Add(now.Add(-2*time.Hour), 3.70, 86)
+	histories["1"].Add(now, 3.68, 63)
+	histories["2"].Add(now.Add(-24*time.Hour), 3.76, 66.4)
+
+	want := "!pre /63 368 63 86/  16Nov 23:43" +
+		"/66 376 66 66/  15Nov 23:43/--/--"
+	if got := FormatReportSummary(histories, ""); got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	got := FormatReportSummary(NodeHistories{}, "")
+	if want := "!pre /--/--/--/--/--/--"; got != want {
+		t.Errorf("empty histories: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Default sensor log directory (relative to the working directory)
+const defaultLogDir = "sensor-logs"
+
+// What to do with log files older than log_retention_days
+const (
+	retentionDelete  = "delete"  // Delete old log files
+	retentionArchive = "archive" // Move old log files to log_archive_dir
+)
+
+// Matches daily log file names (e.g. "2025-11-17-UTC.csv" or ".csv.gz", or
+// "2025-11-17-local.csv" for files named by local day). Match groups are the
+// day name ("2025-11-17-UTC"), date, zone suffix, and ".gz" suffix.
+var logFileNameRE = regexp.MustCompile(
+	`^((\d{4}-\d{2}-\d{2})-(UTC|local))\.csv(\.gz)?$`)
+
+// List the day names (like "2025-11-17-UTC", oldest first) that have a log
+// file (.csv or .csv.gz) in the log directory. A missing log directory has no
+// days.
+func listSensorLogDays(logDir string) ([]string, error) {
+	entries, err := os.ReadDir(logDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	days := []string{}
+	for _, e := range entries {
+		m := logFileNameRE.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		if len(days) == 0 || days[len(days)-1] != m[1] {
+			days = append(days, m[1])
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// Get the archive directory for old log files from the "log_archive_dir"
+// config setting. Default is an archive directory inside the log directory.
+func getSensorLogArchiveDir(logDir string) (string, error) {
+	if cfg.LogArchiveDir == "" {
+		return filepath.Join(logDir, "archive"), nil
+	}
+	if filepath.IsAbs(cfg.LogArchiveDir) {
+		return cfg.LogArchiveDir, nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cwd, cfg.LogArchiveDir), nil
+}
+
+// Write file data to a temporary file, fsync it, then rename it into place
+// so readers never see a partially written file
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Compress a completed day's log file to .csv.gz and remove the original. If
+// a .csv.gz already exists for that day (e.g. a late report arrived after the
+// day was compressed), the reports of both files get merged. The files could
+// have different schema versions, so merged files get rewritten in the
+// current schema.
+func compressSensorLog(path string) error {
+	gzPath := path + ".gz"
+	if _, err := os.Stat(gzPath); err == nil {
+		reports := []SensorData{}
+		for _, p := range []string{gzPath, path} {
+			scan, err := scanSensorLog(p)
+			if err != nil {
+				return err
+			}
+			if scan.SchemaErr != nil || len(scan.BadRows) > 0 {
+				// Don't lose the bad rows by rewriting the file
+				return fmt.Errorf("%s has bad rows (see verify command)", p)
+			}
+			if err := scan.Schema.CheckRewrite(); err != nil {
+				return fmt.Errorf("%s: %v", p, err)
+			}
+			reports = append(reports, scan.Reports...)
+		}
+		sort.SliceStable(reports, func(i, j int) bool {
+			return reports[i].Timestamp.Before(reports[j].Timestamp)
+		})
+		if err := writeSensorLog(gzPath, encodeSensorLog(reports)); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+
+	csvData, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := writeSensorLog(gzPath, csvData); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Move a file, falling back to copy and delete across filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	err = writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, bufio.NewReader(in))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Apply log retention and compression policies to the sensor log directory.
+// Log files older than log_retention_days get deleted or archived, and log
+// files for completed UTC days get gzip compressed if log_compress is set.
+// Today's log file is never touched.
+func MaintainSensorLogs() {
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		// Missing log directory is fine (nothing logged yet)
+		if !os.IsNotExist(err) {
+			log.Printf("WARN: Log maintenance: %v", err)
+		}
+		return
+	}
+
+	// Today's date for UTC and local day log files
+	now := clock.Now()
+	today := map[string]string{
+		"UTC":   now.UTC().Format("2006-01-02"),
+		"local": now.In(cfg.Location()).Format("2006-01-02"),
+	}
+	cutoff := ""
+	if cfg.LogRetentionDays > 0 {
+		cutoff = now.UTC().AddDate(0, 0, -cfg.LogRetentionDays).
+			Format("2006-01-02")
+	}
+
+	for _, e := range entries {
+		m := logFileNameRE.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		day := m[2]
+		path := filepath.Join(logDir, e.Name())
+
+		// Retention: dates in YYYY-MM-DD format sort chronologically
+		if cutoff != "" && day < cutoff {
+			if cfg.LogRetentionAction == retentionArchive {
+				archiveDir, err := getSensorLogArchiveDir(logDir)
+				if err == nil {
+					err = os.MkdirAll(archiveDir, 0755)
+				}
+				if err == nil {
+					err = moveFile(path,
+						filepath.Join(archiveDir, e.Name()))
+				}
+				if err != nil {
+					log.Printf("WARN: Archiving %s: %v", path, err)
+				} else {
+					log.Printf("INFO: Archived %s", path)
+				}
+			} else {
+				if err := os.Remove(path); err != nil {
+					log.Printf("WARN: Deleting %s: %v", path, err)
+				} else {
+					log.Printf("INFO: Deleted %s", path)
+				}
+			}
+			continue
+		}
+
+		// Compression of completed days
+		if cfg.LogCompress && m[4] == "" && day < today[m[3]] {
+			if err := compressSensorLog(path); err != nil {
+				log.Printf("WARN: Compressing %s: %v", path, err)
+			} else {
+				log.Printf("INFO: Compressed %s", path)
+			}
+		}
+	}
+}
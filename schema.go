@@ -0,0 +1,387 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSV log files are self-describing. The first line is a schema version
+// marker, the second line is a header naming the columns, and rows get parsed
+// by column name, so old and new files load side by side. For example:
+//
+//	#schema=2
+//	Timestamp,Node,RSSI,SNR,BatteryV,TempF,Protocol,NodeTime
+//	2025-11-17T05:30:00Z,2,-63,0.0,3.80,64,ESPNOW,38734b3c
+//
+// Version 1 files (from before there was a marker) start with the header
+// "Timestamp,Node,RSSI,SNR,BatteryV,TempF". Unknown columns get ignored, so
+// adding a column is not a breaking change. Bump the version when the meaning
+// of an existing column changes.
+
+// Current schema version
+const sensorLogSchemaVersion = 2
+
+// Prefix of the schema version marker line
+const sensorLogVersionPrefix = "#schema="
+
+// Column names
+const (
+	colTimestamp = "Timestamp" // RFC3339 UTC time the hub got the report
+	colNode      = "Node"      // Node ID
+	colRSSI      = "RSSI"      // Radio signal strength (dBm)
+	colSNR       = "SNR"       // Radio signal to noise ratio (dB)
+	colBatteryV  = "BatteryV"  // Node battery voltage
+	colTempF     = "TempF"     // Temperature °F
+	colProtocol  = "Protocol"  // Radio protocol: ESPNOW or LORA
+	colNodeTime  = "NodeTime"  // Node's own timestamp counter (hex)
+	colGateway   = "Gateway"   // Gateway that relayed the report
+	colHumidity  = "Humidity"  // Relative humidity %
+	// Readings as the node sent them, before unit conversion and
+	// calibration (only for calibrated measurements)
+	colRawTemp     = "RawTemp"
+	colRawBatteryV = "RawBatteryV"
+	colRawHumidity = "RawHumidity"
+)
+
+// Columns of version 1 log files
+var sensorLogColumnsV1 = []string{colTimestamp, colNode, colRSSI, colSNR,
+	colBatteryV, colTempF}
+
+// Columns written to new log files
+var sensorLogColumns = append(append([]string{}, sensorLogColumnsV1...),
+	colProtocol, colNodeTime)
+
+// Optional columns that get added to a log file only if some report in the
+// file has a value for them
+var sensorLogOptionalColumns = []string{colGateway, colHumidity, colRawTemp,
+	colRawBatteryV, colRawHumidity}
+
+// Columns every log file must have
+var sensorLogRequiredColumns = []string{colTimestamp, colNode, colBatteryV,
+	colTempF}
+
+// Column layout of one log file
+type sensorLogSchema struct {
+	Version int      // Schema version (0 if the file had no marker)
+	Columns []string // Column names in file order
+	index   map[string]int
+}
+
+// Build a schema from a header row. Version is the marker version, or 0 if
+// there was no marker.
+func newSensorLogSchema(version int, header []string) (*sensorLogSchema,
+	error) {
+
+	s := &sensorLogSchema{
+		Version: version,
+		Columns: header,
+		index:   make(map[string]int),
+	}
+	for i, name := range header {
+		s.index[strings.TrimSpace(name)] = i
+	}
+	for _, name := range sensorLogRequiredColumns {
+		if _, exists := s.index[name]; !exists {
+			return nil, fmt.Errorf("header is missing column %s", name)
+		}
+	}
+	if s.Version == 0 && strings.Join(header, ",") ==
+		strings.Join(sensorLogColumnsV1, ",") {
+		s.Version = 1
+	}
+	return s, nil
+}
+
+// Schema for new log files, including optional columns that have values in
+// any of `reports`
+func currentSensorLogSchema(reports []SensorData) *sensorLogSchema {
+	cols := append([]string{}, sensorLogColumns...)
+	for _, name := range sensorLogOptionalColumns {
+		for _, sd := range reports {
+			if sensorLogField(sd, name) != "" {
+				cols = append(cols, name)
+				break
+			}
+		}
+	}
+	s, _ := newSensorLogSchema(sensorLogSchemaVersion, cols)
+	return s
+}
+
+// Check that rewriting a file with this schema in the current schema won't
+// lose data from columns this version of the code doesn't know about
+func (s *sensorLogSchema) CheckRewrite() error {
+	if unknown := s.UnknownColumns(); len(unknown) > 0 {
+		return fmt.Errorf("unknown columns %v", unknown)
+	}
+	if s.Version > sensorLogSchemaVersion {
+		return fmt.Errorf("newer schema version %d", s.Version)
+	}
+	return nil
+}
+
+// Does the report have values for optional columns that the schema lacks?
+func (s *sensorLogSchema) MissingColumns(sd SensorData) bool {
+	for _, name := range sensorLogOptionalColumns {
+		if _, exists := s.index[name]; !exists &&
+			sensorLogField(sd, name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// List columns that this version of the code doesn't know about
+func (s *sensorLogSchema) UnknownColumns() []string {
+	known := make(map[string]bool)
+	for _, name := range sensorLogColumns {
+		known[name] = true
+	}
+	for _, name := range sensorLogOptionalColumns {
+		known[name] = true
+	}
+	unknown := []string{}
+	for _, name := range s.Columns {
+		if !known[strings.TrimSpace(name)] {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
+
+// Parse a schema version marker line like "#schema=2". Returns ok=false if
+// the line is not a marker.
+func parseSensorLogVersion(line string) (version int, ok bool, err error) {
+	if !strings.HasPrefix(line, sensorLogVersionPrefix) {
+		return 0, false, nil
+	}
+	version, err = strconv.Atoi(strings.TrimSpace(
+		strings.TrimPrefix(line, sensorLogVersionPrefix)))
+	if err != nil || version < 1 {
+		return 0, true, fmt.Errorf("bad schema marker: %q", line)
+	}
+	return version, true, nil
+}
+
+// Header lines (marker and column names) for this schema
+func (s *sensorLogSchema) HeaderLines() string {
+	return fmt.Sprintf("%s%d\n%s\n", sensorLogVersionPrefix, s.Version,
+		strings.Join(s.Columns, ","))
+}
+
+// Parse one CSV record according to the schema's column layout. Rows with
+// the wrong number of fields are rejected since they are usually torn or
+// corrupted.
+func (s *sensorLogSchema) Parse(record []string) (SensorData, error) {
+	if len(record) != len(s.Columns) {
+		return SensorData{}, fmt.Errorf("expected %d fields, got %d",
+			len(s.Columns), len(record))
+	}
+	get := func(name string) string {
+		if i, exists := s.index[name]; exists {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	timestamp, err := time.Parse(time.RFC3339, get(colTimestamp))
+	if err != nil {
+		return SensorData{}, fmt.Errorf("parsing timestamp: %v", err)
+	}
+	if get(colNode) == "" {
+		return SensorData{}, fmt.Errorf("missing node")
+	}
+	batteryV, err := strconv.ParseFloat(get(colBatteryV), 64)
+	if err != nil {
+		return SensorData{}, fmt.Errorf("parsing batteryV: %v", err)
+	}
+	tempF, err := strconv.ParseFloat(get(colTempF), 64)
+	if err != nil {
+		return SensorData{}, fmt.Errorf("parsing tempF: %v", err)
+	}
+	sd := SensorData{
+		Timestamp: timestamp,
+		Node:      get(colNode),
+		RSSI:      get(colRSSI),
+		SNR:       get(colSNR),
+		BatteryV:  batteryV,
+		TempF:     tempF,
+		Protocol:  get(colProtocol),
+		NodeTime:  get(colNodeTime),
+		Gateway:   get(colGateway),
+	}
+	if v := get(colHumidity); v != "" {
+		humidity, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return SensorData{}, fmt.Errorf("parsing humidity: %v", err)
+		}
+		sd.Humidity = &humidity
+	}
+	for _, raw := range []struct {
+		col string
+		v   **float64
+	}{
+		{colRawTemp, &sd.RawTemp},
+		{colRawBatteryV, &sd.RawBatteryV},
+		{colRawHumidity, &sd.RawHumidity},
+	} {
+		if v := get(raw.col); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return SensorData{}, fmt.Errorf("parsing %s: %v", raw.col,
+					err)
+			}
+			*raw.v = &f
+		}
+	}
+	return sd, nil
+}
+
+// Format one field of sensor data as it appears in a log file
+func sensorLogField(sd SensorData, name string) string {
+	switch name {
+	case colTimestamp:
+		return sd.Timestamp.UTC().Format(time.RFC3339)
+	case colNode:
+		return sd.Node
+	case colRSSI:
+		return sd.RSSI
+	case colSNR:
+		return sd.SNR
+	case colBatteryV:
+		return fmt.Sprintf("%.2f", sd.BatteryV)
+	case colTempF:
+		return fmt.Sprintf("%.0f", sd.TempF)
+	case colProtocol:
+		return sd.Protocol
+	case colNodeTime:
+		return sd.NodeTime
+	case colGateway:
+		return sd.Gateway
+	case colHumidity:
+		if sd.Humidity != nil {
+			return fmt.Sprintf("%.1f", *sd.Humidity)
+		}
+	case colRawTemp:
+		return formatRawReading(sd.RawTemp)
+	case colRawBatteryV:
+		return formatRawReading(sd.RawBatteryV)
+	case colRawHumidity:
+		return formatRawReading(sd.RawHumidity)
+	}
+	return ""
+}
+
+// Format a raw reading with all of its digits (or "" for nil), so
+// recalibrating from it loses nothing
+func formatRawReading(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// Format sensor data as the fields of one CSV record in the schema's column
+// layout. Columns this version of the code doesn't know about are left empty.
+func (s *sensorLogSchema) Record(sd SensorData) []string {
+	record := make([]string, len(s.Columns))
+	for i, name := range s.Columns {
+		record[i] = sensorLogField(sd, name)
+	}
+	return record
+}
+
+// Read the schema from the first lines of a log file. Returns the schema and
+// the number of lines it used (1 for a header alone, 2 with a marker).
+// Files with no header at all are assumed to be version 1.
+func readSensorLogSchema(lines []string) (*sensorLogSchema, int, error) {
+	if len(lines) == 0 {
+		return nil, 0, fmt.Errorf("empty file")
+	}
+	version, isMarker, err := parseSensorLogVersion(lines[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	if isMarker {
+		if len(lines) < 2 {
+			return nil, 1, fmt.Errorf("missing header after schema marker")
+		}
+		s, err := newSensorLogSchema(version, strings.Split(lines[1], ","))
+		return s, 2, err
+	}
+	// Data rows never have a field named "Timestamp", so that means header
+	header := strings.Split(lines[0], ",")
+	for _, name := range header {
+		if strings.TrimSpace(name) == colTimestamp {
+			s, err := newSensorLogSchema(0, header)
+			return s, 1, err
+		}
+	}
+	// No header, so the first line is data in the version 1 layout
+	s, err := newSensorLogSchema(1, sensorLogColumnsV1)
+	return s, 0, err
+}
+
+// One row of a log file that failed to parse
+type sensorLogBadRow struct {
+	Line int    // Line number, starting from 1
+	Text string // Raw text of the row
+	Err  error
+}
+
+// Contents of one log file (.csv or .csv.gz)
+type sensorLogScan struct {
+	Path      string
+	Schema    *sensorLogSchema // nil if the header is bad
+	SchemaErr error            // Problem with the marker or header
+	Reports   []SensorData
+	BadRows   []sensorLogBadRow
+	Torn      bool   // Last row has no trailing newline (e.g. power cut)
+	Data      []byte // Uncompressed file contents
+}
+
+// Parse the uncompressed contents of a log file one line at a time, so bad
+// rows can be reported with line numbers and saved with their original text
+func parseSensorLog(data []byte) *sensorLogScan {
+	scan := &sensorLogScan{Data: data}
+	trimmed := bytes.TrimRight(data, "\x00")
+	if len(trimmed) == 0 {
+		// Nothing to parse, so any schema works
+		scan.Schema = currentSensorLogSchema(nil)
+		return scan
+	}
+	scan.Torn = trimmed[len(trimmed)-1] != '\n'
+	lines := strings.Split(strings.TrimSuffix(string(trimmed), "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	schema, headerLines, schemaErr := readSensorLogSchema(lines)
+	scan.Schema, scan.SchemaErr = schema, schemaErr
+	for i := headerLines; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+		// Without a good header, none of the rows can be parsed
+		err := schemaErr
+		var record []string
+		if err == nil {
+			record, err = csv.NewReader(strings.NewReader(line)).Read()
+		}
+		if err == nil {
+			var sd SensorData
+			if sd, err = schema.Parse(record); err == nil {
+				scan.Reports = append(scan.Reports, sd)
+				continue
+			}
+		}
+		scan.BadRows = append(scan.BadRows,
+			sensorLogBadRow{Line: i + 1, Text: line, Err: err})
+	}
+	return scan
+}
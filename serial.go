@@ -16,6 +16,9 @@ import (
 	"time"
 )
 
+// Serial port device patterns (tests point this at a pty)
+var serialPortPatterns = []string{"/dev/ttyACM*", "/dev/cu.usbmodem*"}
+
 // Find a serial port device on /dev/ttyACM* or /dev/cu.usbmodem*. This is
 // meant to work with a CircuitPython board on macOS or Raspbian.
 //
@@ -25,10 +28,9 @@ import (
 // DTE-initiated calls using that device. Use the cu devices if you want to
 // avoid wasting time on debugging mysterious blocking I/O.
 func serialFindPort() (string, error) {
-	patterns := []string{"/dev/ttyACM*", "/dev/cu.usbmodem*"}
 	var possibles []string
 
-	for _, pattern := range patterns {
+	for _, pattern := range serialPortPatterns {
 		matches, err := filepath.Glob(pattern)
 		if err != nil {
 			return "", err
@@ -126,8 +128,10 @@ func serialMonitor(ctx context.Context, port string, out chan<- string) error {
 
 // Establish and maintain a serial connection to the serial sensor. If you
 // unplug the sensor temporarily, this should re-connect even the OS assigns
-// it to a new device file (e.g. ttyACM1 instead of ttyACM0).
+// it to a new device file (e.g. ttyACM1 instead of ttyACM0). Closes `out`
+// when ctx is canceled, since this is the only sender.
 func SerialConnect(ctx context.Context, out chan<- string) {
+	defer close(out)
 	for {
 		select {
 		case <-ctx.Done():
@@ -139,7 +143,7 @@ func SerialConnect(ctx context.Context, out chan<- string) {
 		// Find serial port device filename (e.g. /dev/ttyACM0, etc)
 		port, err := serialFindPort()
 		if err != nil {
-			time.Sleep(time.Second)
+			sleepCtx(ctx, time.Second)
 			continue
 		}
 
@@ -148,6 +152,6 @@ func SerialConnect(ctx context.Context, out chan<- string) {
 		if err := serialMonitor(ctx, port, out); err != nil {
 			log.Printf("INFO: %s disconnected: %v", port, err)
 		}
-		time.Sleep(time.Second)
+		sleepCtx(ctx, time.Second)
 	}
 }
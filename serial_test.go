@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSerialConnectPty(t *testing.T) {
+	ptmx, pts, err := openPty()
+	if err != nil {
+		t.Skipf("no pty support: %v", err)
+	}
+	defer ptmx.Close()
+
+	// Make the pty look like a CircuitPython board's /dev/ttyACM0
+	dir := t.TempDir()
+	if err := os.Symlink(pts, filepath.Join(dir, "ttyACM0")); err != nil {
+		t.Fatal(err)
+	}
+	old := serialPortPatterns
+	serialPortPatterns = []string{filepath.Join(dir, "ttyACM*")}
+	t.Cleanup(func() { serialPortPatterns = old })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan string, 8)
+	go SerialConnect(ctx, out)
+
+	// Boot messages and other lines that aren't reports get filtered out.
+	// Keep sending until the monitor has the port open and reads the report.
+	const report = "ESPNOW: -63, 0.0, 2, 38734b3c, 3.80, 64, OK"
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(testTimeout)
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+			fmt.Fprintf(ptmx, "code.py output:\r\n%s\r\n", report)
+		case line := <-out:
+			if line != report {
+				t.Fatalf("got %q, want %q", line, report)
+			}
+			done = true
+		case <-timeout:
+			t.Fatal("timed out waiting for report")
+		}
+	}
+
+	// Canceling stops the monitor, which closes `out`
+	cancel()
+	timeout = time.After(testTimeout)
+	for {
+		select {
+		case _, ok := <-out:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for SerialConnect to stop")
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Default seconds between reports from each simulated node
+const defaultSimulateInterval = 60
+
+// Settings for simulated sensor nodes, for demos and load testing without
+// hardware (disabled if nodes is 0)
+type SimulateConfig struct {
+	Nodes    int   `json:"nodes"`    // Number of simulated nodes
+	Interval int   `json:"interval"` // Seconds between reports from a node
+	PTY      bool  `json:"pty"`      // Send reports through a pty (Linux)
+	Seed     int64 `json:"seed"`     // Random seed (0 means pick one)
+}
+
+// Check simulation settings and fill in defaults
+func (c *SimulateConfig) Prepare() error {
+	if c.Nodes < 0 {
+		return fmt.Errorf("nodes must not be negative")
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultSimulateInterval
+	}
+	return nil
+}
+
+// One simulated sensor node
+type simNode struct {
+	id       string
+	protocol string  // "LORA" or "ESPNOW"
+	meanF    float64 // Daily mean temperature
+	swingF   float64 // Difference between the daily mean and peak
+	driftF   float64 // Slow random walk (weather) added to the curve
+	rssi     float64 // Typical signal strength
+	snr      float64 // Typical signal to noise ratio (LoRa only)
+	batteryV float64
+	drainV   float64   // Battery discharge per day
+	meanRH   float64   // Relative humidity % at the mean (0 if none)
+	last     time.Time // Time of the previous report
+	silent   int       // Reports left to skip in a dropout
+}
+
+// Generator of report lines for a set of simulated nodes
+type simulator struct {
+	rng   *rand.Rand
+	nodes []*simNode
+}
+
+// Make simulated nodes with IDs 1 to c.Nodes and random characteristics
+func newSimulator(c *SimulateConfig) *simulator {
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s := &simulator{rng: rand.New(rand.NewSource(seed))}
+	for i := range c.Nodes {
+		n := &simNode{
+			id:       fmt.Sprint(i + 1),
+			protocol: "LORA",
+			meanF:    40 + 35*s.rng.Float64(),
+			swingF:   5 + 15*s.rng.Float64(),
+			rssi:     -115 + 25*s.rng.Float64(),
+			snr:      -10 + 18*s.rng.Float64(),
+			batteryV: 3.7 + 0.5*s.rng.Float64(),
+			drainV:   0.01 + 0.03*s.rng.Float64(),
+		}
+		if s.rng.Float64() < 0.3 {
+			n.protocol = "ESPNOW"
+			n.rssi = -80 + 35*s.rng.Float64()
+			n.snr = 0
+		}
+		if s.rng.Float64() < 0.5 {
+			n.meanRH = 40 + 40*s.rng.Float64()
+		}
+		s.nodes = append(s.nodes, n)
+	}
+	return s
+}
+
+// Make the report lines for node `n` reporting at time `now`. That's usually
+// one line, but none for a dropout, or two when the gateway hears the report
+// twice (the second one is marked DUP). Nodes with a humidity sensor add it
+// to the end of the line.
+func (s *simulator) reports(n *simNode, now time.Time) []string {
+	// Battery runs down with time, and gets swapped when it gets low
+	if !n.last.IsZero() {
+		n.batteryV -= n.drainV * now.Sub(n.last).Hours() / 24
+	}
+	n.last = now
+	if n.batteryV < 3.35 {
+		n.batteryV = 4.2
+	}
+
+	// Dropouts: a missed report now and then, and rarely a long outage
+	switch {
+	case n.silent > 0:
+		n.silent--
+		return nil
+	case s.rng.Float64() < 0.002:
+		n.silent = 10 + s.rng.Intn(50)
+		return nil
+	case s.rng.Float64() < 0.03:
+		return nil
+	}
+
+	// Temperature follows a daily curve that peaks at 3pm local time
+	local := now.In(cfg.Location())
+	hour := float64(local.Hour()) + float64(local.Minute())/60
+	n.driftF = max(-5, min(5, n.driftF+0.2*s.rng.NormFloat64()))
+	tempF := n.meanF + n.swingF*math.Cos((hour-15)/24*2*math.Pi) +
+		n.driftF + 0.5*s.rng.NormFloat64()
+
+	rssi := math.Round(n.rssi + 3*s.rng.NormFloat64())
+	snr := 0.0
+	if n.protocol == "LORA" {
+		snr = n.snr + 1.5*s.rng.NormFloat64()
+	}
+	battery := n.batteryV + 0.01*s.rng.NormFloat64()
+	line := fmt.Sprintf("%s: %.0f, %.1f, %s, %08x, %.2f, %.0f, ",
+		n.protocol, rssi, snr, n.id, uint32(now.Unix()), battery, tempF)
+	// Relative humidity goes down as the air warms up
+	humidity := ""
+	if n.meanRH > 0 {
+		rh := n.meanRH - 2*(tempF-n.meanF) + 3*s.rng.NormFloat64()
+		humidity = fmt.Sprintf(", %.1f", max(5, min(100, rh)))
+	}
+	if s.rng.Float64() < 0.05 {
+		return []string{line + "OK" + humidity, line + "DUP" + humidity}
+	}
+	return []string{line + "OK" + humidity}
+}
+
+// Run the simulated nodes, passing each report line to `emit`, until ctx is
+// canceled or emit returns false. Reports from the nodes are spread evenly
+// over the report interval.
+func runSimulator(ctx context.Context, c *SimulateConfig,
+	emit func(line string) bool) {
+
+	s := newSimulator(c)
+	if len(s.nodes) == 0 {
+		return
+	}
+	step := time.Duration(c.Interval) * time.Second / time.Duration(
+		len(s.nodes))
+	ticker := time.NewTicker(max(step, time.Millisecond))
+	defer ticker.Stop()
+	for i := 0; ; i = (i + 1) % len(s.nodes) {
+		for _, line := range s.reports(s.nodes[i], clock.Now()) {
+			if !emit(line) {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send simulated report lines straight to `out`, in place of SerialConnect.
+// Closes `out` when ctx is canceled, since this is the only sender.
+func Simulate(ctx context.Context, c *SimulateConfig, out chan<- string) {
+	defer close(out)
+	log.Printf("INFO: Simulating %d sensor nodes", c.Nodes)
+	runSimulator(ctx, c, func(line string) bool {
+		select {
+		case out <- line:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	log.Printf("DEBUG: Simulate got <-ctx.Done()")
+}
+
+// Write simulated report lines to a pty, so SerialConnect can read them like
+// a real serial port. Returns the path of the pty once it's ready.
+func SimulatePty(ctx context.Context, c *SimulateConfig) (string, error) {
+	ptmx, path, err := openPty()
+	if err != nil {
+		return "", err
+	}
+	log.Printf("INFO: Simulating %d sensor nodes on %s", c.Nodes, path)
+	go func() {
+		// Closing the pty also ends a write that is waiting for a reader
+		<-ctx.Done()
+		ptmx.Close()
+	}()
+	go runSimulator(ctx, c, func(line string) bool {
+		_, err := fmt.Fprintf(ptmx, "%s\r\n", line)
+		return err == nil
+	})
+	return path, nil
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Run simulated nodes for a day of reports, one every 5 minutes
+func simulateDay(t *testing.T, c SimulateConfig) []string {
+	useTestConfig(t, ServerConfig{Timezone: "UTC", Simulate: c})
+	s := newSimulator(&cfg.Simulate)
+	start := mustTime(t, "2025-07-01T00:00:00Z")
+	lines := []string{}
+	for step := range 24 * 12 {
+		now := start.Add(time.Duration(step) * 5 * time.Minute)
+		for _, n := range s.nodes {
+			lines = append(lines, s.reports(n, now)...)
+		}
+	}
+	return lines
+}
+
+func TestSimulatorReports(t *testing.T) {
+	lines := simulateDay(t, SimulateConfig{Nodes: 20, Seed: 1})
+	nodes := map[string]int{}
+	dups, humid := 0, 0
+	for _, line := range lines {
+		m := sensorReportRE.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("bad report format: %q", line)
+		}
+		if m[8] == "DUP" {
+			dups++
+			continue
+		}
+		nodes[m[4]]++
+		batteryV, err1 := strconv.ParseFloat(m[6], 64)
+		tempF, err2 := strconv.ParseFloat(m[7], 64)
+		if err1 != nil || err2 != nil {
+			t.Fatalf("bad numbers: %q", line)
+		}
+		if batteryV < 3.3 || batteryV > 4.3 || tempF < 10 || tempF > 110 {
+			t.Errorf("implausible report: %q", line)
+		}
+		if m[9] != "" {
+			humid++
+			if rh, err := strconv.ParseFloat(m[9], 64); err != nil ||
+				rh < 5 || rh > 100 {
+				t.Errorf("implausible humidity: %q", line)
+			}
+		}
+	}
+	if len(nodes) != 20 {
+		t.Errorf("got reports from %d nodes, want 20", len(nodes))
+	}
+	// 288 reports per node per day, minus dropouts
+	reports := len(lines) - dups
+	if reports < 20*288*8/10 || reports == 20*288 {
+		t.Errorf("got %d reports, want most but not all of %d", reports,
+			20*288)
+	}
+	if dups == 0 {
+		t.Errorf("got no DUP reports")
+	}
+	if humid == 0 || humid == reports {
+		t.Errorf("got humidity in %d of %d reports, want some", humid,
+			reports)
+	}
+
+	// The same seed gives the same reports
+	again := simulateDay(t, SimulateConfig{Nodes: 20, Seed: 1})
+	if !slices.Equal(lines, again) {
+		t.Errorf("same seed gave different reports")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC"})
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan string)
+	go Simulate(ctx, &SimulateConfig{Nodes: 50, Interval: 1, Seed: 1}, out)
+
+	got := 0
+	timeout := time.After(testTimeout)
+	for got < 20 {
+		select {
+		case <-out:
+			got++
+		case <-timeout:
+			t.Fatalf("got %d reports before timing out", got)
+		}
+	}
+
+	// Canceling stops the simulation, which closes `out`
+	cancel()
+	for range out {
+	}
+}
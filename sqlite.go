@@ -0,0 +1,401 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Optional SQLite storage backend for sensor reports. This is for pulling
+// data out with SQL, like:
+//
+//	SELECT r.timestamp, r.node_id, m.value FROM reports r
+//	JOIN measurements m ON m.report_id = r.id
+//	WHERE m.name = 'temp_f' AND r.timestamp >= '2025-11-01';
+//
+// Go doesn't have SQLite in the standard library, so like with stty for the
+// serial port, this shells out to the OS provided sqlite3 CLI tool (apt
+// install sqlite3) rather than pulling in a driver dependency. Writes get
+// batched so there is about one sqlite3 process per incoming report at most.
+
+// Storage backends selectable with the "storage" config setting
+const (
+	storageCSV    = "csv"
+	storageSQLite = "sqlite"
+)
+
+// Default SQLite database path (relative to the working directory)
+const defaultSQLitePath = "sensor-hub.db"
+
+// Database schema. Timestamps are RFC3339 UTC strings, which sort
+// chronologically as text. Measurement names match the time-series store
+// (temp_f, battery_v, rssi, snr, humidity).
+const sqliteSchema = `
+PRAGMA journal_mode = WAL;
+CREATE TABLE IF NOT EXISTS nodes (
+	id   TEXT PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS reports (
+	id        INTEGER PRIMARY KEY,
+	node_id   TEXT NOT NULL REFERENCES nodes(id),
+	timestamp TEXT NOT NULL,
+	UNIQUE (node_id, timestamp)
+);
+CREATE INDEX IF NOT EXISTS reports_timestamp ON reports(timestamp);
+CREATE TABLE IF NOT EXISTS measurements (
+	report_id INTEGER NOT NULL REFERENCES reports(id),
+	name      TEXT NOT NULL,
+	value     REAL NOT NULL,
+	PRIMARY KEY (report_id, name)
+) WITHOUT ROWID;
+`
+
+// Schema version, kept in the database's user_version. Databases from before
+// version 1 didn't have humidity measurements.
+const sqliteVersion = 1
+
+// SQLite database accessed through the sqlite3 CLI
+type SQLiteDB struct {
+	path string
+}
+
+// Quote a string as an SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// Run sqlite3 on the database with an SQL script on stdin, returning stdout.
+// Extra args go before the database path (e.g. "-json").
+func (db *SQLiteDB) run(script string, args ...string) ([]byte, error) {
+	args = append(append([]string{"-bail", "-batch"}, args...), db.path)
+	cmd := exec.Command("sqlite3", args...)
+	// Wait up to 5 seconds if another process holds a lock on the database
+	cmd.Stdin = strings.NewReader(".timeout 5000\n" + script)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sqlite3: %v: %s", err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Run an SQL query, decoding the result rows into `rows` (pointer to slice
+// of structs with json tags matching the column names)
+func (db *SQLiteDB) query(sql string, rows any) error {
+	out, err := db.run(sql, "-json")
+	if err != nil {
+		return err
+	}
+	// sqlite3 prints nothing at all for an empty result
+	if len(bytes.TrimSpace(out)) == 0 {
+		out = []byte("[]")
+	}
+	return json.Unmarshal(out, rows)
+}
+
+// Open the SQLite database at `path`, creating it and its schema if needed.
+// Relative paths are relative to the working directory.
+func OpenSQLite(path string) (*SQLiteDB, error) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, fmt.Errorf("sqlite3 CLI not found: %v", err)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	db := &SQLiteDB{path: path}
+	if _, err := db.run(sqliteSchema); err != nil {
+		return nil, err
+	}
+	if err := db.migrate(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Upgrade the database to the current schema version
+func (db *SQLiteDB) migrate() error {
+	var rows []struct {
+		Version int `json:"user_version"`
+	}
+	if err := db.query("PRAGMA user_version;", &rows); err != nil {
+		return err
+	}
+	version := 0
+	if len(rows) > 0 {
+		version = rows[0].Version
+	}
+	if version > sqliteVersion {
+		return fmt.Errorf("SQLite schema version %d is newer than this "+
+			"program supports (%d)", version, sqliteVersion)
+	}
+	if version == sqliteVersion {
+		return nil
+	}
+	if version < 1 {
+		// Add humidity from the CSV logs to the reports that are already in
+		// the database. Inserting skips the measurements it already has.
+		empty, err := db.Empty()
+		if err != nil {
+			return err
+		}
+		if !empty {
+			log.Printf("INFO: Upgrading SQLite database to add humidity")
+			if err := BackfillSQLite(db); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := db.run(fmt.Sprintf("PRAGMA user_version = %d;", sqliteVersion))
+	return err
+}
+
+// Format the SQL statements to insert one report. Reports with the same node
+// and timestamp as an existing report get ignored, unless `replace` is set,
+// in which case their measurements get replaced.
+func sqliteInsertSQL(b *strings.Builder, d SensorData, replace bool) {
+	node := sqlQuote(d.Node)
+	ts := sqlQuote(d.Timestamp.UTC().Format(time.RFC3339))
+	fmt.Fprintf(b, "INSERT INTO nodes (id, name) VALUES (%s, %s) "+
+		"ON CONFLICT (id) DO UPDATE SET name = excluded.name;\n",
+		node, sqlQuote(nodeName(d.Node)))
+	fmt.Fprintf(b, "INSERT OR IGNORE INTO reports (node_id, timestamp) "+
+		"VALUES (%s, %s);\n", node, ts)
+	if replace {
+		fmt.Fprintf(b, "DELETE FROM measurements WHERE report_id = "+
+			"(SELECT id FROM reports WHERE node_id = %s AND "+
+			"timestamp = %s);\n", node, ts)
+	}
+	values := []string{}
+	sample := storeSampleFromSensorData(d)
+	for i, v := range sample.Values {
+		if !math.IsNaN(v) {
+			values = append(values, fmt.Sprintf("(%s, %s)",
+				sqlQuote(storeMeasurements[i]),
+				strconv.FormatFloat(v, 'g', -1, 64)))
+		}
+	}
+	fmt.Fprintf(b, "INSERT OR IGNORE INTO measurements "+
+		"(report_id, name, value) SELECT r.id, m.column1, m.column2 "+
+		"FROM reports r, (VALUES %s) m "+
+		"WHERE r.node_id = %s AND r.timestamp = %s;\n",
+		strings.Join(values, ", "), node, ts)
+}
+
+// Insert reports in one transaction
+func (db *SQLiteDB) Insert(reports []SensorData) error {
+	return db.insert(reports, false)
+}
+
+// Insert reports in one transaction, replacing the measurements of reports
+// that are already in the database (like recalibrated reports)
+func (db *SQLiteDB) Replace(reports []SensorData) error {
+	return db.insert(reports, true)
+}
+
+// Insert reports in one transaction (see sqliteInsertSQL for `replace`)
+func (db *SQLiteDB) insert(reports []SensorData, replace bool) error {
+	if len(reports) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("BEGIN;\n")
+	for _, d := range reports {
+		sqliteInsertSQL(&b, d, replace)
+	}
+	b.WriteString("COMMIT;\n")
+	_, err := db.run(b.String())
+	return err
+}
+
+// Is the database empty (no reports)?
+func (db *SQLiteDB) Empty() (bool, error) {
+	var rows []struct {
+		N int `json:"n"`
+	}
+	err := db.query("SELECT count(*) AS n FROM "+
+		"(SELECT 1 FROM reports LIMIT 1);", &rows)
+	if err != nil {
+		return false, err
+	}
+	return len(rows) == 0 || rows[0].N == 0, nil
+}
+
+// Row of a report query with the measurements pivoted into columns
+type sqliteReportRow struct {
+	Node      string   `json:"node"`
+	Timestamp string   `json:"timestamp"`
+	TempF     *float64 `json:"temp_f"`
+	BatteryV  *float64 `json:"battery_v"`
+	RSSI      *float64 `json:"rssi"`
+	SNR       *float64 `json:"snr"`
+	Humidity  *float64 `json:"humidity"`
+}
+
+// Query reports with from <= timestamp < to, oldest first. An empty node
+// means all nodes.
+func (db *SQLiteDB) queryReports(node string, from, to time.Time) (
+	[]sqliteReportRow, error) {
+
+	where := fmt.Sprintf("r.timestamp >= %s AND r.timestamp < %s",
+		sqlQuote(from.UTC().Format(time.RFC3339)),
+		sqlQuote(to.UTC().Format(time.RFC3339)))
+	if node != "" {
+		where += " AND r.node_id = " + sqlQuote(node)
+	}
+	sql := "SELECT r.node_id AS node, r.timestamp AS timestamp"
+	for _, name := range storeMeasurements {
+		sql += fmt.Sprintf(", max(CASE WHEN m.name = '%s' "+
+			"THEN m.value END) AS %s", name, name)
+	}
+	sql += " FROM reports r JOIN measurements m ON m.report_id = r.id" +
+		" WHERE " + where +
+		" GROUP BY r.id ORDER BY r.timestamp, r.node_id;"
+	rows := []sqliteReportRow{}
+	if err := db.query(sql, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Convert a report row to a sample (missing measurements are NaN)
+func (row sqliteReportRow) sample() (StoreSample, error) {
+	t, err := time.Parse(time.RFC3339, row.Timestamp)
+	if err != nil {
+		return StoreSample{}, fmt.Errorf("bad timestamp %q", row.Timestamp)
+	}
+	sample := StoreSample{Time: t}
+	for i, v := range []*float64{row.TempF, row.BatteryV, row.RSSI,
+		row.SNR, row.Humidity} {
+		sample.Values[i] = math.NaN()
+		if v != nil {
+			sample.Values[i] = *v
+		}
+	}
+	return sample, nil
+}
+
+// Get raw samples for a node with from <= time < to (same format as
+// Store.QueryRaw)
+func (db *SQLiteDB) QueryRaw(node string, from, to time.Time) (
+	[]StoreSample, error) {
+
+	rows, err := db.queryReports(node, from, to)
+	if err != nil {
+		return nil, err
+	}
+	samples := []StoreSample{}
+	for _, row := range rows {
+		sample, err := row.sample()
+		if err != nil {
+			log.Printf("WARN: SQLite: %v", err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// Build node histories from reports since time `since`
+func (db *SQLiteDB) LoadHistories(since time.Time) (NodeHistories, error) {
+	rows, err := db.queryReports("", since, clock.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	histories := make(NodeHistories)
+	for _, row := range rows {
+		sample, err := row.sample()
+		if err != nil || row.TempF == nil || row.BatteryV == nil {
+			continue
+		}
+		h, exists := histories[row.Node]
+		if !exists {
+			h = &ReportHistory{}
+			histories[row.Node] = h
+		}
+		h.AddReport(sample.Report())
+	}
+	return histories, nil
+}
+
+// Fill an empty database from all of the CSV log files, oldest first, with
+// one transaction per day
+func BackfillSQLite(db *SQLiteDB) error {
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		return err
+	}
+	days, err := listSensorLogDays(logDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: Backfilling SQLite database from %d days of CSV logs",
+		len(days))
+	total := 0
+	for _, day := range days {
+		reports, err := readSensorLogDay(logDir, day)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+			continue
+		}
+		if err := db.Insert(reports); err != nil {
+			return err
+		}
+		total += len(reports)
+	}
+	log.Printf("INFO: Backfilled %d reports", total)
+	return nil
+}
+
+// Write sensor reports from the input channel to the SQLite database. Reports
+// that arrive while a write is in progress get written together in the next
+// transaction. If a write fails, the reports stay pending and get retried
+// with the next report.
+func StartSQLite(db *SQLiteDB, in <-chan SensorData) {
+	log.Printf("INFO: SQLite backend writing to %s", db.path)
+	pending := []SensorData{}
+	for d := range in {
+		pending = append(pending, d)
+		// Collect any other reports that are already waiting
+	drain:
+		for {
+			select {
+			case d, ok := <-in:
+				if !ok {
+					break drain
+				}
+				pending = append(pending, d)
+			default:
+				break drain
+			}
+		}
+		if err := db.Insert(pending); err != nil {
+			log.Printf("ERROR: SQLite insert (%d reports pending): %v",
+				len(pending), err)
+			// Same memory limit as the CSV logger's retry buffer
+			if extra := len(pending) - loggerMaxBuffered; extra > 0 {
+				log.Printf("WARN: SQLite dropped %d reports", extra)
+				pending = pending[extra:]
+			}
+			continue
+		}
+		pending = []SensorData{}
+	}
+	if err := db.Insert(pending); err != nil {
+		log.Printf("ERROR: SQLite insert: %v", err)
+	}
+}
@@ -0,0 +1,923 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time-series store keeps an append-only binary file of raw reports for
+// each node, plus rollup files of per-bucket min/mean/max/count statistics at
+// 5-minute, hourly, and daily resolution. Layout of the store directory:
+//
+//	raw/<node>.dat        Raw report records, oldest first
+//	5m/<node>.dat         5-minute rollup records, oldest first
+//	1h/<node>.dat         Hourly rollup records, oldest first
+//	1d/<node>.dat         Daily rollup records, oldest first
+//	1d.zone               Timezone of the daily rollups' days
+//	version               Record format version
+//
+// Records are fixed size little-endian binary, so range queries can binary
+// search by time. Rollup files only hold completed buckets. The current
+// (still open) bucket for each resolution lives in memory and gets rebuilt
+// from the raw records at startup, so a crash never corrupts a rollup. Daily
+// buckets are days in the configured timezone, and get rebuilt from the raw
+// records when the timezone changes.
+
+// Measurements kept for each report, in record field order. New ones go on
+// the end, with a new storeVersion and a migration in migrateStore.
+var storeMeasurements = []string{"temp_f", "battery_v", "rssi", "snr",
+	"humidity"}
+
+// Number of measurements per record
+const storeNumMeasurements = 5
+
+// Record format version. Stores from before the version file are version 1,
+// which didn't have humidity.
+const storeVersion = 2
+
+// Rollup resolutions, shortest first
+var storeResolutions = []struct {
+	name string
+	size time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// Record sizes: raw is timestamp + values, rollup is bucket start + stats
+const (
+	storeRawSize    = 8 + 8*storeNumMeasurements
+	storeRollupSize = 8 + 32*storeNumMeasurements
+)
+
+// Default store directory (relative to the working directory)
+const defaultStoreDir = "sensor-store"
+
+// Error for reports older than the newest report already stored for a node
+var errStoreOutOfOrder = errors.New("report is older than latest stored")
+
+// One raw stored sample. Missing values (e.g. unparseable RSSI) are NaN.
+type StoreSample struct {
+	Time   time.Time
+	Values [storeNumMeasurements]float64
+}
+
+// Statistics of one measurement over one rollup bucket
+type RollupStat struct {
+	Count int64
+	Min   float64
+	Max   float64
+	Sum   float64
+}
+
+// Mean value of the measurement over the bucket
+func (s RollupStat) Mean() float64 {
+	if s.Count == 0 {
+		return math.NaN()
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// Add a value to the statistics (NaN means missing and gets skipped)
+func (s *RollupStat) Add(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+}
+
+// One rollup bucket with statistics for each measurement
+type Rollup struct {
+	Start time.Time
+	Stats [storeNumMeasurements]RollupStat
+}
+
+// Get a report of the bucket's mean values, for charting them like raw
+// reports. Derived metrics of it are of the means, which is close to the
+// mean of the derived metric over a bucket.
+func (r Rollup) Report() Report {
+	return Report{
+		Timestamp: r.Start,
+		TempF:     r.Stats[0].Mean(),
+		BatteryV:  r.Stats[1].Mean(),
+		Humidity:  r.Stats[4].Mean(),
+	}
+}
+
+// Rollup file and open bucket for one node at one resolution
+type rollupSeries struct {
+	size    time.Duration
+	loc     *time.Location // Timezone of daily buckets (nil if not daily)
+	file    *os.File
+	records int64   // Number of completed buckets in file
+	open    *Rollup // Bucket currently being accumulated (nil if none)
+}
+
+// Files and state for one node
+type storeNode struct {
+	raw        *os.File
+	rawRecords int64
+	lastTime   int64 // UnixMilli of newest raw record
+	rollups    []*rollupSeries
+	dirty      bool // Written since last sync
+}
+
+// Embedded append-only time-series store (safe for concurrent use)
+type Store struct {
+	dir    string
+	dayLoc *time.Location // Timezone of the daily rollups
+	nodes  map[string]*storeNode
+	mu     sync.Mutex
+}
+
+// Convert node ID to a safe file name
+func storeFileName(node string) string {
+	return url.PathEscape(node) + ".dat"
+}
+
+// Encode a raw sample record
+func encodeStoreSample(s StoreSample) []byte {
+	buf := make([]byte, storeRawSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(s.Time.UnixMilli()))
+	for i, v := range s.Values {
+		binary.LittleEndian.PutUint64(buf[8+8*i:], math.Float64bits(v))
+	}
+	return buf
+}
+
+// Decode a raw sample record
+func decodeStoreSample(buf []byte) StoreSample {
+	s := StoreSample{}
+	s.Time = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf[0:])))
+	for i := range s.Values {
+		s.Values[i] = math.Float64frombits(
+			binary.LittleEndian.Uint64(buf[8+8*i:]))
+	}
+	return s
+}
+
+// Encode a rollup record
+func encodeRollup(r *Rollup) []byte {
+	buf := make([]byte, storeRollupSize)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(r.Start.UnixMilli()))
+	for i, st := range r.Stats {
+		off := 8 + 32*i
+		binary.LittleEndian.PutUint64(buf[off:], uint64(st.Count))
+		binary.LittleEndian.PutUint64(buf[off+8:], math.Float64bits(st.Min))
+		binary.LittleEndian.PutUint64(buf[off+16:], math.Float64bits(st.Max))
+		binary.LittleEndian.PutUint64(buf[off+24:], math.Float64bits(st.Sum))
+	}
+	return buf
+}
+
+// Decode a rollup record
+func decodeRollup(buf []byte) Rollup {
+	r := Rollup{}
+	r.Start = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf[0:])))
+	for i := range r.Stats {
+		off := 8 + 32*i
+		r.Stats[i] = RollupStat{
+			Count: int64(binary.LittleEndian.Uint64(buf[off:])),
+			Min: math.Float64frombits(
+				binary.LittleEndian.Uint64(buf[off+8:])),
+			Max: math.Float64frombits(
+				binary.LittleEndian.Uint64(buf[off+16:])),
+			Sum: math.Float64frombits(
+				binary.LittleEndian.Uint64(buf[off+24:])),
+		}
+	}
+	return r
+}
+
+// Open a fixed-record file for appending, truncating any torn record at the
+// end. Returns the number of complete records.
+func openRecordFile(path string, size int64) (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if extra := stat.Size() % size; extra != 0 {
+		log.Printf("WARN: Store truncating %d byte torn record from %s",
+			extra, path)
+		if err := f.Truncate(stat.Size() - extra); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	return f, stat.Size() / size, nil
+}
+
+// Read record number `i` from a fixed-record file
+func readRecord(f *os.File, size int64, i int64) ([]byte, error) {
+	buf := make([]byte, size)
+	_, err := f.ReadAt(buf, i*size)
+	return buf, err
+}
+
+// Find the index of the first record with timestamp >= t (UnixMilli) in a
+// fixed-record file whose records start with a UnixMilli timestamp
+func searchRecords(f *os.File, size int64, n int64, t int64) (int64, error) {
+	var err error
+	i := sort.Search(int(n), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var buf []byte
+		buf, err = readRecord(f, size, int64(i))
+		if err != nil {
+			return true
+		}
+		return int64(binary.LittleEndian.Uint64(buf)) >= t
+	})
+	return int64(i), err
+}
+
+// Upgrade the store in `dir` to the current record format. Raw records get
+// widened with the new measurements missing (NaN), and the rollups get
+// rebuilt from them when the nodes get opened.
+//
+// This can stop partway (like if the power goes out) and start over. Each
+// <node>.dat gets widened into <node>.dat2 before the old file gets removed,
+// so a .dat2 file is always complete, and a .dat file that has one is old.
+// Once the version file says the new version, all the .dat2 files get
+// renamed back to .dat.
+func migrateStore(dir string) error {
+	versionPath := filepath.Join(dir, "version")
+	rawDir := filepath.Join(dir, "raw")
+	version := 1
+	buf, err := os.ReadFile(versionPath)
+	if err == nil {
+		version, err = strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return fmt.Errorf("store version: %v", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if version > storeVersion {
+		return fmt.Errorf("store version %d is newer than this program "+
+			"supports (%d)", version, storeVersion)
+	}
+	if version < storeVersion {
+		// Version 1 had 4 measurements
+		oldN := 4
+		paths, err := filepath.Glob(filepath.Join(rawDir, "*.dat"))
+		if err != nil {
+			return err
+		}
+		if len(paths) > 0 {
+			log.Printf("INFO: Upgrading time-series store from version %d "+
+				"to %d", version, storeVersion)
+		}
+		for _, path := range paths {
+			if _, err := os.Stat(path + "2"); errors.Is(err, fs.ErrNotExist) {
+				if err := widenStoreRecords(path, path+"2", oldN); err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+		for _, res := range storeResolutions {
+			if err := os.RemoveAll(filepath.Join(dir, res.name)); err != nil {
+				return err
+			}
+		}
+		if err := syncDir(rawDir); err != nil {
+			return err
+		}
+		err = writeFileAtomic(versionPath, func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "%d\n", storeVersion)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	paths, err := filepath.Glob(filepath.Join(rawDir, "*.dat2"))
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Rename(path, strings.TrimSuffix(path, "2")); err != nil {
+			return err
+		}
+	}
+	return syncDir(rawDir)
+}
+
+// Write a raw record file with `oldN` measurements per record from `src` to
+// `dst` at the current record size, filling in the new measurements with NaN
+func widenStoreRecords(src, dst string, oldN int) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	oldSize := 8 + 8*oldN
+	out := make([]byte, 0, len(data)/oldSize*storeRawSize)
+	for i := 0; i+oldSize <= len(data); i += oldSize {
+		out = append(out, data[i:i+oldSize]...)
+		for range storeNumMeasurements - oldN {
+			out = binary.LittleEndian.AppendUint64(out,
+				math.Float64bits(math.NaN()))
+		}
+	}
+	return writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := w.Write(out)
+		return err
+	})
+}
+
+// Flush directory entries (like renamed files) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Open (or create) the time-series store in `dir`
+func OpenStore(dir string) (*Store, error) {
+	s := &Store{dir: dir, dayLoc: cfg.Location(),
+		nodes: make(map[string]*storeNode)}
+	if err := os.MkdirAll(filepath.Join(dir, "raw"), 0755); err != nil {
+		return nil, err
+	}
+	if err := migrateStore(dir); err != nil {
+		return nil, err
+	}
+	if err := s.checkDayZone(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "raw"))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".dat")
+		if e.IsDir() || !ok {
+			continue
+		}
+		node, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		if _, err := s.openNode(node); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Remove the daily rollups if they're for days in a different timezone
+// (stores without a 1d.zone file have UTC days), so they get rebuilt from
+// the raw records
+func (s *Store) checkDayZone() error {
+	zonePath := filepath.Join(s.dir, "1d.zone")
+	zone := "UTC"
+	data, err := os.ReadFile(zonePath)
+	switch {
+	case err == nil:
+		zone = strings.TrimSpace(string(data))
+		if zone == s.dayLoc.String() {
+			return nil
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	if zone != s.dayLoc.String() {
+		dayDir := filepath.Join(s.dir, "1d")
+		if _, err := os.Stat(dayDir); err == nil {
+			log.Printf("INFO: Rebuilding daily rollups for timezone %s "+
+				"(was %s)", s.dayLoc, zone)
+		}
+		if err := os.RemoveAll(dayDir); err != nil {
+			return err
+		}
+		if err := syncDir(s.dir); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(zonePath, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s\n", s.dayLoc)
+		return err
+	})
+}
+
+// Open files for a node and rebuild its open rollup buckets from raw records
+func (s *Store) openNode(node string) (*storeNode, error) {
+	n := &storeNode{}
+	var err error
+	rawPath := filepath.Join(s.dir, "raw", storeFileName(node))
+	n.raw, n.rawRecords, err = openRecordFile(rawPath, storeRawSize)
+	if err != nil {
+		return nil, err
+	}
+	if n.rawRecords > 0 {
+		buf, err := readRecord(n.raw, storeRawSize, n.rawRecords-1)
+		if err != nil {
+			n.raw.Close()
+			return nil, err
+		}
+		n.lastTime = decodeStoreSample(buf).Time.UnixMilli()
+	}
+	closeAll := func() {
+		n.raw.Close()
+		for _, r := range n.rollups {
+			r.file.Close()
+		}
+	}
+
+	for _, res := range storeResolutions {
+		path := filepath.Join(s.dir, res.name, storeFileName(node))
+		f, records, err := openRecordFile(path, storeRollupSize)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		series := &rollupSeries{size: res.size, file: f, records: records}
+		if res.name == "1d" {
+			series.loc = s.dayLoc
+		}
+		n.rollups = append(n.rollups, series)
+
+		// Replay raw records newer than the last completed bucket
+		var from int64
+		if records > 0 {
+			buf, err := readRecord(f, storeRollupSize, records-1)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			from = series.next(decodeRollup(buf).Start).UnixMilli()
+		}
+		if err := n.replay(series, from); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	s.nodes[node] = n
+	return n, nil
+}
+
+// Add raw records with time >= `from` (UnixMilli) to a rollup series
+func (n *storeNode) replay(r *rollupSeries, from int64) error {
+	i, err := searchRecords(n.raw, storeRawSize, n.rawRecords, from)
+	if err != nil {
+		return err
+	}
+	for ; i < n.rawRecords; i++ {
+		buf, err := readRecord(n.raw, storeRawSize, i)
+		if err != nil {
+			return err
+		}
+		if err := r.add(decodeStoreSample(buf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the start of the bucket that time `t` falls in. Daily buckets start
+// at midnight in their timezone, and others are aligned to UTC.
+func (r *rollupSeries) start(t time.Time) time.Time {
+	if r.loc != nil {
+		t = t.In(r.loc)
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, r.loc)
+	}
+	return t.Truncate(r.size)
+}
+
+// Get the start of the bucket after the one starting at `start`. Daily
+// buckets can be 23 or 25 hours long across daylight saving time changes.
+func (r *rollupSeries) next(start time.Time) time.Time {
+	if r.loc != nil {
+		t := start.In(r.loc)
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, r.loc)
+	}
+	return start.Add(r.size)
+}
+
+// Add a sample to the rollup series, writing out the previous bucket if the
+// sample starts a new one
+func (r *rollupSeries) add(sample StoreSample) error {
+	start := r.start(sample.Time)
+	if r.open != nil && !r.open.Start.Equal(start) {
+		if _, err := r.file.WriteAt(encodeRollup(r.open),
+			r.records*storeRollupSize); err != nil {
+			return err
+		}
+		r.records++
+		r.open = nil
+	}
+	if r.open == nil {
+		r.open = &Rollup{Start: start}
+	}
+	for i, v := range sample.Values {
+		r.open.Stats[i].Add(v)
+	}
+	return nil
+}
+
+// Convert sensor data to a store sample
+func storeSampleFromSensorData(d SensorData) StoreSample {
+	parse := func(s string) float64 {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return v
+	}
+	humidity := math.NaN()
+	if d.Humidity != nil {
+		humidity = *d.Humidity
+	}
+	return StoreSample{
+		Time: d.Timestamp,
+		Values: [storeNumMeasurements]float64{
+			d.TempF, d.BatteryV, parse(d.RSSI), parse(d.SNR), humidity},
+	}
+}
+
+// Get the report to add to a node's rolling history
+func (sample StoreSample) Report() Report {
+	return Report{
+		Timestamp: sample.Time,
+		TempF:     sample.Values[0],
+		BatteryV:  sample.Values[1],
+		Humidity:  sample.Values[4],
+	}
+}
+
+// Add a sensor report to the store. Reports older than the node's newest
+// stored report are rejected with errStoreOutOfOrder.
+func (s *Store) Add(d SensorData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, exists := s.nodes[d.Node]
+	if !exists {
+		var err error
+		if n, err = s.openNode(d.Node); err != nil {
+			return err
+		}
+	}
+	sample := storeSampleFromSensorData(d)
+	ts := sample.Time.UnixMilli()
+	if n.rawRecords > 0 && ts < n.lastTime {
+		return errStoreOutOfOrder
+	}
+	if _, err := n.raw.WriteAt(encodeStoreSample(sample),
+		n.rawRecords*storeRawSize); err != nil {
+		return err
+	}
+	n.rawRecords++
+	n.lastTime = ts
+	n.dirty = true
+	for _, r := range n.rollups {
+		if err := r.add(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add reports to the store wherever they fall in time, unlike Add, which
+// only appends. A report from the same node in the same second as a stored
+// one replaces it (keeping its timestamp), since CSV logs and SQLite only
+// keep whole seconds. This is for recalibrated and imported reports.
+func (s *Store) Merge(reports []SensorData) error {
+	byNode := make(map[string][]StoreSample)
+	for _, d := range reports {
+		byNode[d.Node] = append(byNode[d.Node], storeSampleFromSensorData(d))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for node, samples := range byNode {
+		n, exists := s.nodes[node]
+		if !exists {
+			var err error
+			if n, err = s.openNode(node); err != nil {
+				return err
+			}
+		}
+		if err := n.merge(samples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge samples into a node's raw records by rewriting the records from the
+// earliest sample on, then rebuild the rollups from there
+func (n *storeNode) merge(samples []StoreSample) error {
+	slices.SortStableFunc(samples, func(a, b StoreSample) int {
+		return a.Time.Compare(b.Time)
+	})
+	from := samples[0].Time.Truncate(time.Second).UnixMilli()
+	i, err := searchRecords(n.raw, storeRawSize, n.rawRecords, from)
+	if err != nil {
+		return err
+	}
+	tail := []StoreSample{}
+	for j := i; j < n.rawRecords; j++ {
+		buf, err := readRecord(n.raw, storeRawSize, j)
+		if err != nil {
+			return err
+		}
+		tail = append(tail, decodeStoreSample(buf))
+	}
+	merged := make([]StoreSample, 0, len(tail)+len(samples))
+	for len(tail) > 0 && len(samples) > 0 {
+		switch {
+		case tail[0].Time.Unix() == samples[0].Time.Unix():
+			sample := samples[0]
+			sample.Time = tail[0].Time
+			merged = append(merged, sample)
+			tail, samples = tail[1:], samples[1:]
+		case tail[0].Time.Before(samples[0].Time):
+			merged = append(merged, tail[0])
+			tail = tail[1:]
+		default:
+			merged = append(merged, samples[0])
+			samples = samples[1:]
+		}
+	}
+	merged = append(append(merged, tail...), samples...)
+	buf := make([]byte, 0, len(merged)*storeRawSize)
+	for _, sample := range merged {
+		buf = append(buf, encodeStoreSample(sample)...)
+	}
+	if _, err := n.raw.WriteAt(buf, i*storeRawSize); err != nil {
+		return err
+	}
+	n.rawRecords = i + int64(len(merged))
+	n.lastTime = merged[len(merged)-1].Time.UnixMilli()
+	n.dirty = true
+
+	// Drop the buckets from the first changed one on, and rebuild them
+	for _, r := range n.rollups {
+		start := r.start(merged[0].Time)
+		if r.open != nil && r.open.Start.Before(start) {
+			start = r.open.Start
+		}
+		k, err := searchRecords(r.file, storeRollupSize, r.records,
+			start.UnixMilli())
+		if err != nil {
+			return err
+		}
+		if err := r.file.Truncate(k * storeRollupSize); err != nil {
+			return err
+		}
+		r.records = k
+		r.open = nil
+		if err := n.replay(r, start.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush written data to disk
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.nodes {
+		if !n.dirty {
+			continue
+		}
+		if err := n.raw.Sync(); err != nil {
+			return err
+		}
+		for _, r := range n.rollups {
+			if err := r.file.Sync(); err != nil {
+				return err
+			}
+		}
+		n.dirty = false
+	}
+	return nil
+}
+
+// Close all store files
+func (s *Store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.nodes {
+		n.raw.Close()
+		for _, r := range n.rollups {
+			r.file.Close()
+		}
+	}
+	s.nodes = make(map[string]*storeNode)
+}
+
+// Is the store empty (no nodes)?
+func (s *Store) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.nodes) == 0
+}
+
+// List node IDs in the store, sorted
+func (s *Store) Nodes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nodes := make([]string, 0, len(s.nodes))
+	for node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Get raw samples for a node with from <= time < to
+func (s *Store) QueryRaw(node string, from, to time.Time) (
+	[]StoreSample, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := []StoreSample{}
+	n, exists := s.nodes[node]
+	if !exists {
+		return samples, nil
+	}
+	i, err := searchRecords(n.raw, storeRawSize, n.rawRecords,
+		from.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	end := to.UnixMilli()
+	for ; i < n.rawRecords; i++ {
+		buf, err := readRecord(n.raw, storeRawSize, i)
+		if err != nil {
+			return nil, err
+		}
+		sample := decodeStoreSample(buf)
+		if sample.Time.UnixMilli() >= end {
+			break
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// Get rollup buckets for a node at resolution `res` ("5m", "1h", or "1d")
+// that overlap the time range from <= t < to. Includes the open (in progress)
+// bucket.
+func (s *Store) QueryRollups(node string, res string, from, to time.Time) (
+	[]Rollup, error) {
+
+	idx := -1
+	for i := range storeResolutions {
+		if storeResolutions[i].name == res {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("unknown resolution: %q", res)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rollups := []Rollup{}
+	n, exists := s.nodes[node]
+	if !exists {
+		return rollups, nil
+	}
+	r := n.rollups[idx]
+	from = r.start(from)
+	i, err := searchRecords(r.file, storeRollupSize, r.records,
+		from.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	for ; i < r.records; i++ {
+		buf, err := readRecord(r.file, storeRollupSize, i)
+		if err != nil {
+			return nil, err
+		}
+		rollup := decodeRollup(buf)
+		if !rollup.Start.Before(to) {
+			return rollups, nil
+		}
+		rollups = append(rollups, rollup)
+	}
+	if r.open != nil && !r.open.Start.Before(from) && r.open.Start.Before(to) {
+		rollups = append(rollups, *r.open)
+	}
+	return rollups, nil
+}
+
+// Build node histories from stored reports since time `since`
+func (s *Store) LoadHistories(since time.Time) (NodeHistories, error) {
+	histories := make(NodeHistories)
+	for _, node := range s.Nodes() {
+		samples, err := s.QueryRaw(node, since, clock.Now().Add(time.Hour))
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		h := &ReportHistory{}
+		for _, sample := range samples {
+			h.AddReport(sample.Report())
+		}
+		histories[node] = h
+	}
+	return histories, nil
+}
+
+// Fill an empty store from all of the CSV log files, oldest first. This can
+// take a while on a Pi with years of logs, but only happens once.
+func BackfillStore(s *Store) error {
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		return err
+	}
+	days, err := listSensorLogDays(logDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: Backfilling time-series store from %d days of CSV logs",
+		len(days))
+	total := 0
+	for _, day := range days {
+		reports, err := readSensorLogDay(logDir, day)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+			continue
+		}
+		for _, d := range reports {
+			if err := s.Add(d); err != nil && err != errStoreOutOfOrder {
+				return err
+			}
+		}
+		total += len(reports)
+	}
+	log.Printf("INFO: Backfilled %d reports", total)
+	return s.Sync()
+}
+
+// Add sensor reports from the input channel to the store, syncing to disk
+// every log_fsync_interval seconds
+func StartStore(s *Store, in <-chan SensorData) {
+	ticker := time.NewTicker(time.Duration(cfg.LogFsyncInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case d, ok := <-in:
+			if !ok {
+				if err := s.Sync(); err != nil {
+					log.Printf("ERROR: Store sync: %v", err)
+				}
+				return
+			}
+			if err := s.Add(d); err != nil {
+				log.Printf("WARN: Store add: %v", err)
+			}
+		case <-ticker.C:
+			if err := s.Sync(); err != nil {
+				log.Printf("ERROR: Store sync: %v", err)
+			}
+		}
+	}
+}
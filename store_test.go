@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreDailyRollupZone(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{Timezone: "UTC"})
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reports around the end of daylight saving time in Chicago, where
+	// 2025-11-02 is 25 hours long
+	for i, ts := range []string{
+		"2025-11-01T04:30:00Z", // Oct 31 23:30 CDT
+		"2025-11-01T05:30:00Z", // Nov 1 00:30 CDT
+		"2025-11-02T05:30:00Z", // Nov 2 00:30 CDT
+		"2025-11-03T05:30:00Z", // Nov 2 23:30 CST
+		"2025-11-03T06:30:00Z", // Nov 3 00:30 CST
+		"2025-11-04T12:00:00Z", // Nov 4 06:00 CST
+	} {
+		err := store.Add(SensorData{Timestamp: mustTime(t, ts), Node: "1",
+			TempF: float64(i + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Check the daily buckets' starts and temperature counts
+	type bucket struct {
+		start string
+		count int64
+	}
+	check := func(name string, want []bucket) {
+		t.Helper()
+		from := mustTime(t, "2025-10-30T00:00:00Z")
+		to := mustTime(t, "2025-11-06T00:00:00Z")
+		days, err := store.QueryRollups("1", "1d", from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(days) != len(want) {
+			t.Fatalf("%s: got %d days, want %d: %+v", name, len(days),
+				len(want), days)
+		}
+		for i, w := range want {
+			start := mustTime(t, w.start)
+			count := days[i].Stats[0].Count
+			if !days[i].Start.Equal(start) || count != w.count {
+				t.Errorf("%s: got day %v with %d reports, want %v with %d",
+					name, days[i].Start, count, start, w.count)
+			}
+		}
+	}
+	check("UTC", []bucket{
+		{"2025-11-01T00:00:00Z", 2},
+		{"2025-11-02T00:00:00Z", 1},
+		{"2025-11-03T00:00:00Z", 2},
+		{"2025-11-04T00:00:00Z", 1},
+	})
+	store.Close()
+
+	// Opening the store in another timezone rebuilds the daily rollups, and
+	// opening it again reuses them
+	useTestConfig(t, ServerConfig{Timezone: "America/Chicago"})
+	chicago := []bucket{
+		{"2025-10-31T00:00:00-05:00", 1},
+		{"2025-11-01T00:00:00-05:00", 1},
+		{"2025-11-02T00:00:00-05:00", 2},
+		{"2025-11-03T00:00:00-06:00", 1},
+		{"2025-11-04T00:00:00-06:00", 1},
+	}
+	for _, name := range []string{"rebuilt", "reopened"} {
+		if store, err = OpenStore(dir); err != nil {
+			t.Fatal(err)
+		}
+		check(name, chicago)
+		store.Close()
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "1d.zone"))
+	if err != nil || string(data) != "America/Chicago\n" {
+		t.Errorf("got 1d.zone %q, %v", data, err)
+	}
+
+	// Queries starting partway through a day include the whole day
+	if store, err = OpenStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	days, err := store.QueryRollups("1", "1d",
+		mustTime(t, "2025-11-02T20:00:00Z"),
+		mustTime(t, "2025-11-03T00:00:00Z"))
+	if err != nil || len(days) != 1 || days[0].Stats[0].Count != 2 {
+		t.Errorf("got %+v, %v", days, err)
+	}
+}
@@ -0,0 +1,814 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Command line tools for working with the CSV sensor logs. These run instead
+// of the server when the binary gets a subcommand, like:
+//
+//	serial-sensor-hub export --from 2025-11-01 --to 2025-12-01 > nov.csv
+//
+// Commands that rewrite log files (import, migrate, and recalibrate) should
+// only be used while the server is stopped, since the server appends to
+// today's file.
+
+// Export formats
+const (
+	exportCSV    = "csv"
+	exportJSON   = "json"
+	exportNDJSON = "ndjson"
+)
+
+// Read and parse every row of one log file. Unlike readSensorLogFile, this
+// reads exactly the file at `path` (gzip decompressing .gz files) and keeps
+// track of rows that fail to parse.
+func scanSensorLog(path string) (*sensorLogScan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		data, err = io.ReadAll(gz)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	scan := parseSensorLog(data)
+	scan.Path = path
+	return scan, nil
+}
+
+// Get the paths of the log files for one day name (like "2025-11-17-UTC") that
+// exist. There can be both a .csv.gz and a .csv if reports arrived after the
+// day was compressed.
+func sensorLogDayPaths(logDir, day string) []string {
+	paths := []string{}
+	path := filepath.Join(logDir, day+".csv")
+	for _, p := range []string{path + ".gz", path} {
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// Read all the reports for one day, sorted by time. Bad rows get logged and
+// skipped.
+func readSensorLogDay(logDir, day string) ([]SensorData, error) {
+	reports := []SensorData{}
+	for _, path := range sensorLogDayPaths(logDir, day) {
+		scan, err := scanSensorLog(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, bad := range scan.BadRows {
+			log.Printf("WARN: Skipping %s:%d: %v", path, bad.Line, bad.Err)
+		}
+		reports = append(reports, scan.Reports...)
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].Timestamp.Before(reports[j].Timestamp)
+	})
+	return reports, nil
+}
+
+// Encode reports as the contents of a log file in the current format
+func encodeSensorLog(reports []SensorData) []byte {
+	schema := currentSensorLogSchema(reports)
+	var buf bytes.Buffer
+	buf.WriteString(schema.HeaderLines())
+	w := csv.NewWriter(&buf)
+	for _, sd := range reports {
+		w.Write(schema.Record(sd))
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+// Atomically write log file data, gzip compressing it for .gz paths
+func writeSensorLog(path string, data []byte) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		if !strings.HasSuffix(path, ".gz") {
+			_, err := w.Write(data)
+			return err
+		}
+		gz := gzip.NewWriter(w)
+		if _, err := gz.Write(data); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+// Get the day names (sorted by date) that can have reports from the time
+// range from <= t < to, where a zero time means no limit. Local day files can
+// be up to a day off from UTC.
+func sensorLogDaysBetween(days []string, from, to time.Time) []string {
+	out := []string{}
+	for _, day := range days {
+		date := day[:len("2006-01-02")]
+		if !from.IsZero() &&
+			date < from.UTC().AddDate(0, 0, -1).Format("2006-01-02") {
+			continue
+		}
+		if !to.IsZero() &&
+			date > to.UTC().AddDate(0, 0, 1).Format("2006-01-02") {
+			break
+		}
+		out = append(out, day)
+	}
+	return out
+}
+
+// Parse a --from or --to time as a date (UTC midnight) or RFC3339 timestamp
+func parseToolTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Report fields for JSON export
+type exportRecord struct {
+	Timestamp string   `json:"timestamp"`
+	Node      string   `json:"node"`
+	Name      string   `json:"name,omitempty"`
+	RSSI      string   `json:"rssi"`
+	SNR       string   `json:"snr"`
+	BatteryV  float64  `json:"battery_v"`
+	TempF     float64  `json:"temp_f"`
+	Protocol  string   `json:"protocol,omitempty"`
+	NodeTime  string   `json:"node_time,omitempty"`
+	Gateway   string   `json:"gateway,omitempty"`
+	Humidity  *float64 `json:"humidity,omitempty"`
+}
+
+// Export reports from a time range as one CSV, JSON, or NDJSON file
+func exportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	from := flags.String("from", "", "start date or time (inclusive)")
+	to := flags.String("to", "", "end date or time (exclusive)")
+	node := flags.String("node", "", "only export reports from this node")
+	format := flags.String("format", exportCSV, "csv, json, or ndjson")
+	output := flags.String("o", "", "output file (default is stdout)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var fromTime, toTime time.Time
+	var err error
+	if *from != "" {
+		if fromTime, err = parseToolTime(*from); err != nil {
+			log.Printf("ERROR: Bad --from: %v", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if toTime, err = parseToolTime(*to); err != nil {
+			log.Printf("ERROR: Bad --to: %v", err)
+			return 2
+		}
+	}
+	switch *format {
+	case exportCSV, exportJSON, exportNDJSON:
+	default:
+		log.Printf("ERROR: Unknown --format: %q", *format)
+		return 2
+	}
+
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	days, err := listSensorLogDays(logDir)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return 1
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Printf("ERROR: %v", err)
+			return 1
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	csvOut := csv.NewWriter(w)
+	// CSV exports have every column (but no schema marker, since they're
+	// meant for spreadsheets and such)
+	schema, _ := newSensorLogSchema(sensorLogSchemaVersion,
+		append(append([]string{}, sensorLogColumns...),
+			sensorLogOptionalColumns...))
+	switch *format {
+	case exportCSV:
+		csvOut.Write(schema.Columns)
+	case exportJSON:
+		w.WriteString("[")
+	}
+
+	count := 0
+	for _, day := range sensorLogDaysBetween(days, fromTime, toTime) {
+		reports, err := readSensorLogDay(logDir, day)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return 1
+		}
+		for _, sd := range reports {
+			if (*node != "" && sd.Node != *node) ||
+				(!fromTime.IsZero() && sd.Timestamp.Before(fromTime)) ||
+				(!toTime.IsZero() && !sd.Timestamp.Before(toTime)) {
+				continue
+			}
+			switch *format {
+			case exportCSV:
+				csvOut.Write(schema.Record(sd))
+			case exportJSON, exportNDJSON:
+				line, _ := json.Marshal(exportRecord{
+					Timestamp: sd.Timestamp.UTC().Format(time.RFC3339),
+					Node:      sd.Node,
+					Name:      nodeName(sd.Node),
+					RSSI:      sd.RSSI,
+					SNR:       sd.SNR,
+					BatteryV:  sd.BatteryV,
+					TempF:     sd.TempF,
+					Protocol:  sd.Protocol,
+					NodeTime:  sd.NodeTime,
+					Gateway:   sd.Gateway,
+					Humidity:  sd.Humidity,
+				})
+				if *format == exportJSON && count > 0 {
+					w.WriteString(",")
+				}
+				if *format == exportJSON {
+					w.WriteString("\n  ")
+				}
+				w.Write(line)
+				if *format == exportNDJSON {
+					w.WriteString("\n")
+				}
+			}
+			count++
+		}
+		csvOut.Flush()
+	}
+	if *format == exportJSON {
+		w.WriteString("\n]\n")
+	}
+	if err := w.Flush(); err != nil {
+		log.Printf("ERROR: Writing export: %v", err)
+		return 1
+	}
+	log.Printf("INFO: Exported %d reports", count)
+	return 0
+}
+
+// Identity of a report for finding duplicates
+type reportKey struct {
+	node string
+	unix int64
+}
+
+// Merge reports from external CSV files into the daily log files, skipping
+// reports that are already logged (same node and timestamp)
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be imported")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		log.Printf("ERROR: import needs at least one CSV file")
+		return 2
+	}
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	// Read the import files, grouping reports by log file day
+	byDay := make(map[string][]SensorData)
+	for _, path := range flags.Args() {
+		scan, err := scanSensorLog(path)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return 1
+		}
+		// Files without a header get read as the version 1 column layout
+		if scan.SchemaErr != nil {
+			log.Printf("ERROR: %s: %v", path, scan.SchemaErr)
+			return 1
+		}
+		for _, bad := range scan.BadRows {
+			log.Printf("WARN: Skipping %s:%d: %v", path, bad.Line, bad.Err)
+		}
+		for _, sd := range scan.Reports {
+			day := sensorLogDayName(sd.Timestamp)
+			byDay[day] = append(byDay[day], sd)
+		}
+	}
+	days := []string{}
+	for day := range byDay {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	// Reports get added to the time-series store and its rollups too. An
+	// empty store gets filled from the CSV logs when the server starts, so
+	// it's left alone.
+	var store *Store
+	if !*dryRun {
+		if store, err = OpenStore(cfg.StoreDir); err != nil {
+			log.Printf("ERROR: Opening store: %v", err)
+			return 1
+		}
+		defer store.Close()
+		if store.Empty() {
+			store = nil
+		} else {
+			defer func() {
+				if err := store.Sync(); err != nil {
+					log.Printf("ERROR: Store sync: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Reports get added to the SQLite database too, if it's enabled
+	var db *SQLiteDB
+	if storageEnabled(storageSQLite) && !*dryRun {
+		if db, err = OpenSQLite(cfg.SQLitePath); err != nil {
+			log.Printf("ERROR: Opening SQLite database: %v", err)
+			return 1
+		}
+	}
+
+	added, dups := 0, 0
+	for _, day := range days {
+		// Refuse to rewrite files with rows that would get lost
+		paths := sensorLogDayPaths(logDir, day)
+		existing := []SensorData{}
+		for _, path := range paths {
+			scan, err := scanSensorLog(path)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				return 1
+			}
+			if scan.SchemaErr != nil || len(scan.BadRows) > 0 || scan.Torn {
+				log.Printf("ERROR: %s has bad rows; fix it with "+
+					"\"migrate\" before importing", path)
+				return 1
+			}
+			if err := scan.Schema.CheckRewrite(); err != nil {
+				log.Printf("ERROR: Can't import into %s: %v", path, err)
+				return 1
+			}
+			existing = append(existing, scan.Reports...)
+		}
+		seen := make(map[reportKey]bool)
+		for _, sd := range existing {
+			seen[reportKey{sd.Node, sd.Timestamp.Unix()}] = true
+		}
+		newReports := []SensorData{}
+		for _, sd := range byDay[day] {
+			key := reportKey{sd.Node, sd.Timestamp.Unix()}
+			if seen[key] {
+				dups++
+				continue
+			}
+			seen[key] = true
+			newReports = append(newReports, sd)
+		}
+		if len(newReports) == 0 {
+			continue
+		}
+		added += len(newReports)
+		log.Printf("INFO: %s: adding %d reports", day, len(newReports))
+		if *dryRun {
+			continue
+		}
+
+		// The store goes first, so if anything fails, running import again
+		// finishes (adding a report the store already has replaces it)
+		if store != nil {
+			if err := store.Merge(newReports); err != nil {
+				log.Printf("ERROR: Updating store: %v", err)
+				return 1
+			}
+		}
+
+		// Write everything for the day to one file, keeping it compressed
+		// if the day was already compressed
+		merged := append(existing, newReports...)
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].Timestamp.Before(merged[j].Timestamp)
+		})
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			log.Printf("ERROR: %v", err)
+			return 1
+		}
+		path := filepath.Join(logDir, day+".csv")
+		if len(paths) > 0 && strings.HasSuffix(paths[0], ".gz") {
+			path += ".gz"
+		}
+		if err := writeSensorLog(path, encodeSensorLog(merged)); err != nil {
+			log.Printf("ERROR: Writing %s: %v", path, err)
+			return 1
+		}
+		for _, p := range paths {
+			if p != path {
+				os.Remove(p)
+			}
+		}
+		if db != nil {
+			if err := db.Insert(newReports); err != nil {
+				log.Printf("ERROR: SQLite insert: %v", err)
+				return 1
+			}
+		}
+	}
+	log.Printf("INFO: Imported %d reports, skipped %d duplicates", added, dups)
+	return 0
+}
+
+// Get paths of all log files, oldest first (or just the past `days` days)
+func listSensorLogPaths(logDir string, days int) ([]string, error) {
+	allDays, err := listSensorLogDays(logDir)
+	if err != nil {
+		return nil, err
+	}
+	if days > 0 {
+		cutoff := clock.Now().UTC().AddDate(0, 0, 1-days).Format("2006-01-02")
+		for len(allDays) > 0 && allDays[0][:len(cutoff)] < cutoff {
+			allDays = allDays[1:]
+		}
+	}
+	paths := []string{}
+	for _, day := range allDays {
+		paths = append(paths, sensorLogDayPaths(logDir, day)...)
+	}
+	return paths, nil
+}
+
+// Check log files for rows that would be skipped when loading history. Exits
+// with status 1 if there are any problems.
+func verifyCommand(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	days := flags.Int("days", 0, "only check the past N days (default all)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	paths, err := listSensorLogPaths(logDir, *days)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return 1
+	}
+	rows, bad, problemFiles, oldFiles := 0, 0, 0, 0
+	for _, path := range paths {
+		scan, err := scanSensorLog(path)
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			problemFiles++
+			continue
+		}
+		problem := false
+		if scan.SchemaErr != nil {
+			// Every row would have the same error, so just report it once
+			fmt.Printf("%s:1: %v\n", path, scan.SchemaErr)
+			problem = true
+		} else {
+			for _, b := range scan.BadRows {
+				fmt.Printf("%s:%d: %v: %q\n", path, b.Line, b.Err, b.Text)
+				problem = true
+			}
+			if scan.Schema.Version < sensorLogSchemaVersion {
+				oldFiles++
+			}
+		}
+		if scan.Torn {
+			fmt.Printf("%s: last row is torn (no trailing newline)\n", path)
+			problem = true
+		}
+		if problem {
+			problemFiles++
+		}
+		rows += len(scan.Reports)
+		bad += len(scan.BadRows)
+	}
+	fmt.Printf("%d files, %d rows ok, %d bad rows, %d files with problems\n",
+		len(paths), rows, bad, problemFiles)
+	if oldFiles > 0 {
+		fmt.Printf("%d files use an older schema version (see migrate)\n",
+			oldFiles)
+	}
+	if problemFiles > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Rewrite log files in the current format, sorted by time. Rows that don't
+// parse get moved to the quarantine directory so nothing is lost.
+func migrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be changed")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	paths, err := listSensorLogPaths(logDir, 0)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return 1
+	}
+	changed, failed := 0, 0
+	for _, path := range paths {
+		scan, err := scanSensorLog(path)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return 1
+		}
+		if scan.SchemaErr != nil {
+			// Rewriting would quarantine every row, so leave it for a human
+			log.Printf("ERROR: Skipping %s: %v", path, scan.SchemaErr)
+			failed++
+			continue
+		}
+		if err := scan.Schema.CheckRewrite(); err != nil {
+			log.Printf("WARN: Skipping %s: %v", path, err)
+			continue
+		}
+		sort.SliceStable(scan.Reports, func(i, j int) bool {
+			return scan.Reports[i].Timestamp.Before(scan.Reports[j].Timestamp)
+		})
+		data := encodeSensorLog(scan.Reports)
+		if bytes.Equal(scan.Data, data) {
+			continue // Already in the current format
+		}
+		changed++
+		log.Printf("INFO: Migrating %s (%d rows, %d bad rows)", path,
+			len(scan.Reports), len(scan.BadRows))
+		if *dryRun {
+			continue
+		}
+		if len(scan.BadRows) > 0 {
+			if err := quarantineRows(path, scan.BadRows); err != nil {
+				log.Printf("ERROR: Quarantining bad rows: %v", err)
+				return 1
+			}
+		}
+		if err := writeSensorLog(path, data); err != nil {
+			log.Printf("ERROR: Writing %s: %v", path, err)
+			return 1
+		}
+	}
+	log.Printf("INFO: Migrated %d of %d files", changed, len(paths))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Calibrate logged reports again with the current calibrations, from their
+// raw readings where they have them. Reports without raw readings weren't
+// calibrated when they arrived, so their readings are the raw readings.
+func recalibrateCommand(args []string) int {
+	flags := flag.NewFlagSet("recalibrate", flag.ContinueOnError)
+	from := flags.String("from", "", "start date or time (inclusive)")
+	to := flags.String("to", "", "end date or time (exclusive)")
+	node := flags.String("node", "", "only recalibrate this node")
+	dryRun := flags.Bool("dry-run", false, "report what would be changed")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var fromTime, toTime time.Time
+	var err error
+	if *from != "" {
+		if fromTime, err = parseToolTime(*from); err != nil {
+			log.Printf("ERROR: Bad --from: %v", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if toTime, err = parseToolTime(*to); err != nil {
+			log.Printf("ERROR: Bad --to: %v", err)
+			return 2
+		}
+	}
+	logDir, err := getSensorLogDir()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	days, err := listSensorLogDays(logDir)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return 1
+	}
+	// Recalibrated reports get updated in the time-series store and the
+	// SQLite database too, since they don't keep raw readings
+	var store *Store
+	var db *SQLiteDB
+	if !*dryRun {
+		if store, err = OpenStore(cfg.StoreDir); err != nil {
+			log.Printf("ERROR: Opening store: %v", err)
+			return 1
+		}
+		defer store.Close()
+		defer func() {
+			if err := store.Sync(); err != nil {
+				log.Printf("ERROR: Store sync: %v", err)
+			}
+		}()
+		if storageEnabled(storageSQLite) {
+			if db, err = OpenSQLite(cfg.SQLitePath); err != nil {
+				log.Printf("ERROR: Opening SQLite database: %v", err)
+				return 1
+			}
+		}
+	}
+	files, changed, failed := 0, 0, 0
+	for _, day := range sensorLogDaysBetween(days, fromTime, toTime) {
+		for _, path := range sensorLogDayPaths(logDir, day) {
+			scan, err := scanSensorLog(path)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				return 1
+			}
+			if scan.SchemaErr != nil {
+				log.Printf("ERROR: Skipping %s: %v", path, scan.SchemaErr)
+				failed++
+				continue
+			}
+			if err := scan.Schema.CheckRewrite(); err != nil {
+				log.Printf("WARN: Skipping %s: %v", path, err)
+				continue
+			}
+			updated := []SensorData{}
+			for i := range scan.Reports {
+				sd := &scan.Reports[i]
+				if (*node != "" && sd.Node != *node) ||
+					(!fromTime.IsZero() && sd.Timestamp.Before(fromTime)) ||
+					(!toTime.IsZero() && !sd.Timestamp.Before(toTime)) {
+					continue
+				}
+				before := scan.Schema.Record(*sd)
+				sd.Calibrate(cfg.Calibration[sd.Node])
+				if !slices.Equal(before, scan.Schema.Record(*sd)) {
+					updated = append(updated, *sd)
+				}
+			}
+			if len(updated) == 0 {
+				continue
+			}
+			files++
+			changed += len(updated)
+			log.Printf("INFO: Recalibrating %d rows of %s", len(updated),
+				path)
+			if *dryRun {
+				continue
+			}
+			// Update the same reports in the store and database, leaving
+			// everything else in them alone. This goes before rewriting the
+			// log, so if anything fails, running recalibrate again finishes.
+			if err := store.Merge(updated); err != nil {
+				log.Printf("ERROR: Updating store: %v", err)
+				return 1
+			}
+			if db != nil {
+				if err := db.Replace(updated); err != nil {
+					log.Printf("ERROR: Updating SQLite database: %v", err)
+					return 1
+				}
+			}
+			if len(scan.BadRows) > 0 {
+				if err := quarantineRows(path, scan.BadRows); err != nil {
+					log.Printf("ERROR: Quarantining bad rows: %v", err)
+					return 1
+				}
+			}
+			err = writeSensorLog(path, encodeSensorLog(scan.Reports))
+			if err != nil {
+				log.Printf("ERROR: Writing %s: %v", path, err)
+				return 1
+			}
+		}
+	}
+	log.Printf("INFO: Recalibrated %d rows in %d files", changed, files)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Append the raw text of bad rows to the log file's quarantine file
+func quarantineRows(path string, rows []sensorLogBadRow) error {
+	qDir := filepath.Join(filepath.Dir(path), "quarantine")
+	if err := os.MkdirAll(qDir, 0755); err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	q, err := os.OpenFile(filepath.Join(qDir, name),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := q.WriteString(row.Text + "\n"); err != nil {
+			q.Close()
+			return err
+		}
+	}
+	if err := q.Sync(); err != nil {
+		q.Close()
+		return err
+	}
+	return q.Close()
+}
+
+// Usage message for the command line tools
+const toolsUsage = `Usage: serial-sensor-hub [-config FILE] [command] [options]
+
+With no command, run the server. Commands:
+  export       Export reports as one CSV, JSON, or NDJSON file
+               --from DATE --to DATE --node ID --format csv|json|ndjson
+               -o FILE
+  import       Merge reports from CSV files into the logs, skipping
+               duplicates
+               [--dry-run] FILE...
+  verify       Check log files for malformed rows
+               [--days N]
+  migrate      Rewrite log files in the current schema version, quarantining
+               bad rows
+               [--dry-run]
+  recalibrate  Apply the current calibrations to logged reports, starting
+               from their raw readings, and update them in the store and
+               SQLite database
+               [--dry-run] --from DATE --to DATE --node ID
+
+Dates are YYYY-MM-DD (UTC) or RFC3339 timestamps.
+
+Flags:
+`
+
+// Run a command line tool subcommand, returning the process exit status.
+// Settings come from the config file at configPath if it exists.
+func runCommand(name string, args []string, configPath string) int {
+	commands := map[string]func([]string) int{
+		"export":      exportCommand,
+		"import":      importCommand,
+		"verify":      verifyCommand,
+		"migrate":     migrateCommand,
+		"recalibrate": recalibrateCommand,
+	}
+	cmd, exists := commands[name]
+	if !exists {
+		fmt.Fprint(os.Stderr, toolsUsage)
+		if name == "help" || name == "-h" || name == "--help" {
+			return 0
+		}
+		return 2
+	}
+	// The default config file is optional for tools, but not one from -config
+	if err := LoadServerConfig(configPath); err != nil &&
+		(!errors.Is(err, fs.ErrNotExist) || configPath != defaultConfigPath) {
+		log.Printf("ERROR: Failed to load server config: %v", err)
+		return 1
+	}
+	clock = cfg.NewClock()
+	return cmd(args)
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportStore(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{
+		LogDir:   filepath.Join(dir, "logs"),
+		StoreDir: filepath.Join(dir, "store"),
+	})
+	fake := useFakeClock(t, mustTime(t, "2025-11-17T12:00:00Z"))
+
+	// The server has logged and stored a report from today
+	today := SensorData{Timestamp: mustTime(t, "2025-11-17T10:00:00Z"),
+		Node: "1", RSSI: "-60", SNR: "1.0", BatteryV: 3.8, TempF: 70}
+	store, err := OpenStore(cfg.StoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(today); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	fake.Set(today.Timestamp)
+	logFile := CurrentLogFile{}
+	if err := logFile.WriteReport(today); err != nil {
+		t.Fatal(err)
+	}
+	logFile.Close()
+
+	// The import has older reports from another hub, and today's duplicate
+	imported := []SensorData{
+		{Timestamp: mustTime(t, "2025-11-10T08:00:00Z"), Node: "1",
+			RSSI: "-70", SNR: "2.0", BatteryV: 3.9, TempF: 60},
+		{Timestamp: mustTime(t, "2025-11-10T09:00:00Z"), Node: "1",
+			RSSI: "-70", SNR: "2.0", BatteryV: 3.9, TempF: 64},
+		today,
+	}
+	importPath := filepath.Join(dir, "other.csv")
+	err = os.WriteFile(importPath, encodeSensorLog(imported), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := importCommand([]string{importPath}); code != 0 {
+		t.Fatalf("import exited with %d", code)
+	}
+
+	// The store has the imported reports before today's, with rollups
+	if store, err = OpenStore(cfg.StoreDir); err != nil {
+		t.Fatal(err)
+	}
+	from := mustTime(t, "2025-11-01T00:00:00Z")
+	to := mustTime(t, "2025-12-01T00:00:00Z")
+	samples, err := store.QueryRaw("1", from, to)
+	if err != nil || len(samples) != 3 {
+		t.Fatalf("got store samples %v, %v", samples, err)
+	}
+	for i, want := range []float64{60, 64, 70} {
+		if got := samples[i].Values[0]; got != want {
+			t.Errorf("sample %d: got %v°F, want %v", i, got, want)
+		}
+	}
+	hours, err := store.QueryRollups("1", "1h", from, to)
+	if err != nil || len(hours) != 3 {
+		t.Fatalf("got 1h rollups %v, %v", hours, err)
+	}
+	if !hours[1].Start.Equal(mustTime(t, "2025-11-10T09:00:00Z")) ||
+		hours[1].Stats[0].Mean() != 64 {
+		t.Errorf("got 1h rollup %+v", hours[1])
+	}
+	days, err := store.QueryRollups("1", "1d", from, to)
+	if err != nil || len(days) != 2 {
+		t.Fatalf("got 1d rollups %v, %v", days, err)
+	}
+	if s := days[0].Stats[0]; s.Count != 2 || s.Min != 60 || s.Max != 64 {
+		t.Errorf("got 1d rollup %+v", days[0])
+	}
+
+	// Importing again adds nothing
+	store.Close()
+	if code := importCommand([]string{importPath}); code != 0 {
+		t.Fatalf("second import exited with %d", code)
+	}
+	if store, err = OpenStore(cfg.StoreDir); err != nil {
+		t.Fatal(err)
+	}
+	samples, err = store.QueryRaw("1", from, to)
+	if err != nil || len(samples) != 3 {
+		t.Errorf("after second import, got store samples %v, %v", samples,
+			err)
+	}
+	store.Close()
+}
+
+func TestImportEmptyStore(t *testing.T) {
+	dir := t.TempDir()
+	useTestConfig(t, ServerConfig{
+		LogDir:   filepath.Join(dir, "logs"),
+		StoreDir: filepath.Join(dir, "store"),
+	})
+	useFakeClock(t, mustTime(t, "2025-11-17T12:00:00Z"))
+	importPath := filepath.Join(dir, "other.csv")
+	err := os.WriteFile(importPath, encodeSensorLog([]SensorData{
+		{Timestamp: mustTime(t, "2025-11-10T08:00:00Z"), Node: "1",
+			RSSI: "-70", SNR: "2.0", BatteryV: 3.9, TempF: 60},
+	}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := importCommand([]string{importPath}); code != 0 {
+		t.Fatalf("import exited with %d", code)
+	}
+
+	// An empty store stays empty, so the server fills it from all the logs
+	store, err := OpenStore(cfg.StoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if !store.Empty() {
+		t.Errorf("got store nodes %v, want none", store.Nodes())
+	}
+}
@@ -4,14 +4,62 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
+	"maps"
+	"math"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 )
 
-// Chart handler function to serve SVG file
+// Default web server listen address
+const defaultWebAddr = "0.0.0.0:8080"
+
+// Chart handler function to serve SVG file. The default 36 hour chart comes
+// from the chart cache. Longer charts (e.g. "/chart.svg?days=365") get
+// generated on request from the time-series store, and charts of other
+// metrics from the in-memory histories.
 func chartHandler(w http.ResponseWriter, r *http.Request) {
+	metric := r.URL.Query().Get("metric")
+	if metric == "" {
+		metric = metricTempF
+	}
+	if _, ok := chartAxes[metric]; !ok {
+		http.Error(w, "unknown metric "+strconv.Quote(metric),
+			http.StatusBadRequest)
+		return
+	}
+	var chartBytes []byte
+	var err error
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		days, convErr := strconv.Atoi(daysStr)
+		if convErr != nil || days < 1 || days > 3660 {
+			http.Error(w, "days must be 1 to 3660", http.StatusBadRequest)
+			return
+		}
+		if sensorStore == nil {
+			http.Error(w, "time-series store is not available",
+				http.StatusServiceUnavailable)
+			return
+		}
+		chartBytes, err = GenerateMetricChartDays(sensorStore, days, metric)
+	} else if metric != metricTempF {
+		snapshot := histories.Snapshot(snapReports)
+		chartBytes, err = GenerateMetricChart(snapshot, metric)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if chartBytes != nil {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Content-Length", strconv.Itoa(len(chartBytes)))
+		w.Write(chartBytes)
+		return
+	}
+
 	// Lock the chart cache for reading
 	chartCache.mu.Lock()
 	defer chartCache.mu.Unlock()
@@ -48,18 +96,326 @@ img{max-width:100%;height:auto;} /* scale width on narrow screens */
 	w.Write(html)
 }
 
+// Health handler function to report status of the sensor logger and the
+// output queues as JSON
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := struct {
+		Logger LoggerHealth `json:"logger"`
+		Queues []QueueStats `json:"queues"`
+	}{
+		Logger: loggerHealth.Snapshot(),
+		Queues: EventQueueStats(),
+	}
+	body, err := json.MarshalIndent(&health, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Use 503 status when unhealthy so simple monitoring tools notice
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if !health.Logger.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
+
+// Write a JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// API handler function to list nodes in the time-series store (or in the
+// in-memory histories if the store is not available)
+func apiNodesHandler(w http.ResponseWriter, r *http.Request) {
+	type node struct {
+		ID   string `json:"id"`
+		Name string `json:"name,omitempty"`
+	}
+	ids := histories.Nodes()
+	if sensorStore != nil {
+		ids = sensorStore.Nodes()
+	}
+	nodes := []node{}
+	for _, id := range ids {
+		nodes = append(nodes, node{ID: id, Name: nodeName(id)})
+	}
+	writeJSON(w, nodes)
+}
+
+// API handler function for rolling statistics from the in-memory node
+// histories, like:
+//
+//	/api/stats?node=1&window=24h
+//
+// node is a node ID (default is all nodes). window is one of the configured
+// windows, like "today" or "36h" (default is all windows).
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	window := q.Get("window")
+	if window != "" {
+		hw, ok := cfg.FindWindow(window)
+		if !ok {
+			http.Error(w, "unknown window", http.StatusBadRequest)
+			return
+		}
+		window = hw.name
+	}
+	var only []string
+	if node := q.Get("node"); node != "" {
+		only = []string{node}
+	}
+	snapshot := histories.Snapshot(snapStats, only...)
+	if len(only) > 0 && len(snapshot) == 0 {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+	ids := slices.Sorted(maps.Keys(snapshot))
+
+	type windowStats struct {
+		Window      string  `json:"window"`
+		Count       int     `json:"count"`
+		MinTempF    float64 `json:"min_temp_f"`
+		MaxTempF    float64 `json:"max_temp_f"`
+		MeanTempF   float64 `json:"mean_temp_f"`
+		StdDevTempF float64 `json:"stddev_temp_f"`
+		P10TempF    float64 `json:"p10_temp_f"`
+		MedianTempF float64 `json:"median_temp_f"`
+		P90TempF    float64 `json:"p90_temp_f"`
+	}
+	type nodeStats struct {
+		Node         string        `json:"node"`
+		Name         string        `json:"name,omitempty"`
+		Time         time.Time     `json:"time"`
+		TempF        float64       `json:"temp_f"`
+		BatteryV     float64       `json:"battery_v"`
+		Humidity     *float64      `json:"humidity,omitempty"`
+		DewPointF    *float64      `json:"dew_point_f,omitempty"`
+		HeatIndexF   *float64      `json:"heat_index_f,omitempty"`
+		VPDkPa       *float64      `json:"vpd_kpa,omitempty"`
+		RateFPerHour float64       `json:"rate_f_per_hour"`
+		GDD          float64       `json:"gdd"`
+		Windows      []windowStats `json:"windows"`
+	}
+	nodes := []nodeStats{}
+	for _, id := range ids {
+		h, ok := snapshot[id]
+		if !ok || len(h.Reports) == 0 {
+			continue
+		}
+		last := h.Reports[len(h.Reports)-1]
+		ns := nodeStats{
+			Node:         id,
+			Name:         nodeName(id),
+			Time:         last.Timestamp.UTC(),
+			TempF:        last.TempF,
+			BatteryV:     last.BatteryV,
+			RateFPerHour: h.RateFPerHour,
+			GDD:          h.GrowingDegreeDays(),
+			Windows:      []windowStats{},
+		}
+		if last.HasHumidity() {
+			for _, m := range []struct {
+				name string
+				v    **float64
+			}{
+				{metricHumidity, &ns.Humidity},
+				{metricDewPointF, &ns.DewPointF},
+				{metricHeatIndexF, &ns.HeatIndexF},
+				{metricVPDkPa, &ns.VPDkPa},
+			} {
+				v := last.Metric(m.name)
+				*m.v = &v
+			}
+		}
+		for _, ws := range h.Windows {
+			if window != "" && ws.Name != window {
+				continue
+			}
+			ns.Windows = append(ns.Windows, windowStats{
+				Window:      ws.Name,
+				Count:       ws.Count,
+				MinTempF:    ws.MinTempF,
+				MaxTempF:    ws.MaxTempF,
+				MeanTempF:   ws.MeanTempF,
+				StdDevTempF: ws.StdDevTempF,
+				P10TempF:    ws.PercentileTempF(10),
+				MedianTempF: ws.PercentileTempF(50),
+				P90TempF:    ws.PercentileTempF(90),
+			})
+		}
+		nodes = append(nodes, ns)
+	}
+	writeJSON(w, nodes)
+}
+
+// API handler function for the daily temperature ranges and growing degree
+// days of a node this growing season, like:
+//
+//	/api/daily?node=1
+func apiDailyHandler(w http.ResponseWriter, r *http.Request) {
+	node := r.URL.Query().Get("node")
+	if node == "" {
+		http.Error(w, "missing node", http.StatusBadRequest)
+		return
+	}
+	h, ok := histories.Snapshot(snapStats, node)[node]
+	if !ok {
+		http.Error(w, "unknown node", http.StatusNotFound)
+		return
+	}
+	type day struct {
+		Date     string  `json:"date"`
+		MinTempF float64 `json:"min_temp_f"`
+		MaxTempF float64 `json:"max_temp_f"`
+		GDD      float64 `json:"gdd"`
+		TotalGDD float64 `json:"total_gdd"` // Season so far
+	}
+	start := cfg.GDD.SeasonStart(clock.Now())
+	days := []day{}
+	total := 0.0
+	for _, d := range h.Days {
+		if d.Date.Before(start) {
+			continue
+		}
+		gdd := cfg.GDD.DegreeDays(d.MinTempF, d.MaxTempF)
+		total += gdd
+		days = append(days, day{
+			Date:     d.Date.Format("2006-01-02"),
+			MinTempF: d.MinTempF,
+			MaxTempF: d.MaxTempF,
+			GDD:      gdd,
+			TotalGDD: total,
+		})
+	}
+	writeJSON(w, map[string]any{
+		"node":         node,
+		"season_start": start.Format("2006-01-02"),
+		"base_f":       cfg.GDD.BaseF,
+		"cap_f":        cfg.GDD.CapF,
+		"days":         days,
+	})
+}
+
+// API handler function for range queries on the time-series store, like:
+//
+//	/api/range?node=1&res=1h&from=2025-11-01T00:00:00Z&to=2025-11-08T00:00:00Z
+//
+// res is "raw", "5m", "1h", or "1d" (default 5m). from and to are RFC3339
+// timestamps (default is the in-memory history window, 36 hours unless the
+// history_hours setting changes it).
+func apiRangeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	node := q.Get("node")
+	if node == "" {
+		http.Error(w, "missing node", http.StatusBadRequest)
+		return
+	}
+	res := q.Get("res")
+	if res == "" {
+		res = "5m"
+	}
+	if sensorStore == nil && (res != "raw" || sqliteDB == nil) {
+		http.Error(w, "time-series store is not available",
+			http.StatusServiceUnavailable)
+		return
+	}
+	to := clock.Now()
+	from := to.Add(-cfg.HistoryWindow())
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "bad "+p.name+": "+err.Error(),
+					http.StatusBadRequest)
+				return
+			}
+			*p.t = t
+		}
+	}
+
+	// Build points as maps so missing (NaN) values can be left out
+	points := []map[string]any{}
+	if res == "raw" {
+		// Raw reports come from the SQLite database when it is enabled
+		query := sensorStore.QueryRaw
+		if sqliteDB != nil {
+			query = sqliteDB.QueryRaw
+		}
+		samples, err := query(node, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, sample := range samples {
+			p := map[string]any{"time": sample.Time.UTC()}
+			for i, v := range sample.Values {
+				if !math.IsNaN(v) {
+					p[storeMeasurements[i]] = v
+				}
+			}
+			points = append(points, p)
+		}
+	} else {
+		rollups, err := sensorStore.QueryRollups(node, res, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rollup := range rollups {
+			p := map[string]any{"time": rollup.Start.UTC()}
+			for i, st := range rollup.Stats {
+				if st.Count > 0 {
+					p[storeMeasurements[i]] = map[string]any{
+						"min":   st.Min,
+						"mean":  st.Mean(),
+						"max":   st.Max,
+						"count": st.Count,
+					}
+				}
+			}
+			points = append(points, p)
+		}
+	}
+	writeJSON(w, map[string]any{
+		"node":   node,
+		"res":    res,
+		"from":   from.UTC(),
+		"to":     to.UTC(),
+		"points": points,
+	})
+}
+
 // Start the web server to serve the chart
 func StartWebServer(ctx context.Context) {
 	// Map URL paths to handler functions
 	mux := http.NewServeMux()
 	mux.HandleFunc("/chart.svg", chartHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/api/nodes", apiNodesHandler)
+	mux.HandleFunc("/api/range", apiRangeHandler)
+	mux.HandleFunc("/api/stats", apiStatsHandler)
+	mux.HandleFunc("/api/daily", apiDailyHandler)
 	mux.HandleFunc("/", htmlHandler)
 
-	// Server will bind to all IP addresses (0.0.0.0)
-	srv := &http.Server{Addr: "0.0.0.0:8080", Handler: mux}
+	// Server binds to web_addr (all IP addresses on port 8080 by default)
+	srv := &http.Server{Addr: cfg.WebAddr, Handler: mux}
 
 	// Handler goroutine will shut down the web server when ctx is canceled
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-ctx.Done()
 		log.Printf("DEBUG: Web server got <-ctx.Done()")
 		shutdownCtx, cancel := context.WithTimeout(context.Background(),
@@ -77,5 +433,8 @@ func StartWebServer(ctx context.Context) {
 		log.Printf("WARN: Web server: %v", err)
 	}
 
+	// Wait for open connections to finish
+	<-shutdownDone
+
 	log.Printf("INFO: Web server exited cleanly")
 }
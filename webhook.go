@@ -0,0 +1,327 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Starting delay for webhook delivery retry backoff (tests make this shorter)
+var webhookRetryDelay = 3 * time.Second
+
+// Webhook event types
+const (
+	webhookReport = "report"
+	webhookAlert  = "alert"
+)
+
+// Maximum number of undelivered events kept on disk for each webhook. When
+// the queue is full, the oldest events get dropped.
+const webhookQueueMax = 1000
+
+// Settings for one outbound webhook from the "webhooks" list in config.json
+type WebhookConfig struct {
+	URL     string            `json:"url"`     // Where to POST events
+	Events  []string          `json:"events"`  // "report", "alert" (def: both)
+	Headers map[string]string `json:"headers"` // Extra HTTP request headers
+	Secret  string            `json:"secret"`  // HMAC-SHA256 signing key
+}
+
+// JSON body of a webhook POST request
+type WebhookEvent struct {
+	Type      string  `json:"type"` // "report" or "alert"
+	Timestamp string  `json:"timestamp"`
+	Node      string  `json:"node"`
+	Name      string  `json:"name,omitempty"`
+	TempF     float64 `json:"temp_f"`
+	BatteryV  float64 `json:"battery_v,omitempty"`
+	RSSI      string  `json:"rssi,omitempty"`
+	SNR       string  `json:"snr,omitempty"`
+	State     string  `json:"state,omitempty"`   // Alert state
+	LimitF    float64 `json:"limit_f,omitempty"` // Alert threshold
+	Message   string  `json:"message,omitempty"` // Alert description
+}
+
+// Build a report event from sensor data
+func NewReportEvent(d SensorData) WebhookEvent {
+	return WebhookEvent{
+		Type:      webhookReport,
+		Timestamp: d.Timestamp.UTC().Format(time.RFC3339),
+		Node:      d.Node,
+		Name:      nodeName(d.Node),
+		TempF:     d.TempF,
+		BatteryV:  d.BatteryV,
+		RSSI:      d.RSSI,
+		SNR:       d.SNR,
+	}
+}
+
+// Build an alert event from an alert state change
+func NewAlertEvent(a Alert) WebhookEvent {
+	return WebhookEvent{
+		Type:      webhookAlert,
+		Timestamp: a.Timestamp.UTC().Format(time.RFC3339),
+		Node:      a.Node,
+		Name:      nodeName(a.Node),
+		TempF:     a.TempF,
+		State:     a.State,
+		LimitF:    a.LimitF,
+		Message:   a.Message(),
+	}
+}
+
+// Check webhook settings and fill in defaults
+func (w *WebhookConfig) Prepare() error {
+	if !strings.HasPrefix(w.URL, "http://") &&
+		!strings.HasPrefix(w.URL, "https://") {
+		return fmt.Errorf("webhook url must be http or https: %q", w.URL)
+	}
+	if len(w.Events) == 0 {
+		w.Events = []string{webhookReport, webhookAlert}
+	}
+	for _, e := range w.Events {
+		if e != webhookReport && e != webhookAlert {
+			return fmt.Errorf("webhook %s: unknown event %q", w.URL, e)
+		}
+	}
+	return nil
+}
+
+// Does this webhook want events of the given type?
+func (w *WebhookConfig) wants(eventType string) bool {
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Compute the signature header value for a request body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Persistent on-disk queue of undelivered events for one webhook. Each event
+// is one file named so that sorting the names gives delivery order.
+type webhookQueue struct {
+	dir string
+	seq atomic.Uint64 // Tie breaker for events queued in the same nanosecond
+}
+
+// Add an event to the queue, dropping oldest events if the queue is full
+func (q *webhookQueue) Push(body []byte) error {
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(),
+		q.seq.Add(1)%1000000)
+	tmp := filepath.Join(q.dir, name+".tmp")
+	if err := os.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		return err
+	}
+	names, err := q.List()
+	if err != nil {
+		return err
+	}
+	for len(names) > webhookQueueMax {
+		log.Printf("WARN: Webhook queue full, dropping %s", names[0])
+		os.Remove(filepath.Join(q.dir, names[0]))
+		names = names[1:]
+	}
+	return nil
+}
+
+// List queued event file names, oldest first
+func (q *webhookQueue) List() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Error for HTTP responses that won't get better by retrying
+type webhookPermanentError struct {
+	status int
+}
+
+func (e webhookPermanentError) Error() string {
+	return "HTTP status " + strconv.Itoa(e.status)
+}
+
+// POST one event body to the webhook URL
+func webhookPost(ctx context.Context, client *http.Client, w *WebhookConfig,
+	body []byte) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		return webhookPermanentError{}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "serial-sensor-hub")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.Secret != "" {
+		req.Header.Set("X-Hub-Signature-256", webhookSignature(w.Secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode >= 500:
+		return fmt.Errorf("HTTP status %d", resp.StatusCode)
+	default:
+		// Other 4xx errors mean the request itself is bad
+		return webhookPermanentError{status: resp.StatusCode}
+	}
+}
+
+// Deliver queued events for one webhook in order, retrying failed deliveries
+// with backoff. A signal on `notify` means new events were queued.
+func webhookWorker(ctx context.Context, w *WebhookConfig, q *webhookQueue,
+	notify <-chan struct{}) {
+
+	// These are for keeping track of delivery retry backoff delay
+	baseDelay := webhookRetryDelay
+	maxDelay := 10 * time.Minute
+	retryDelay := baseDelay
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	retry := time.NewTimer(0) // deliver anything left over from last run
+	defer retry.Stop()
+	backingOff := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("DEBUG: Webhook worker got <-ctx.Done()")
+			return
+		case <-notify:
+			if backingOff {
+				// New events wait in the queue until the retry timer fires
+				continue
+			}
+		case <-retry.C:
+			backingOff = false
+		}
+
+		// Deliver queued events oldest first until the queue is empty or a
+		// delivery fails
+		names, err := q.List()
+		if err != nil {
+			log.Printf("ERROR: Webhook queue: %v", err)
+			names = nil
+		}
+		failed := false
+		for _, name := range names {
+			path := filepath.Join(q.dir, name)
+			body, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("WARN: Webhook reading %s: %v", path, err)
+				os.Remove(path)
+				continue
+			}
+			err = webhookPost(ctx, client, w, body)
+			if perm, ok := err.(webhookPermanentError); ok {
+				log.Printf("WARN: Webhook %s rejected %s (%v), dropping it",
+					w.URL, name, perm)
+				os.Remove(path)
+				continue
+			}
+			if err != nil {
+				log.Printf("WARN: Webhook %s delivery failed: %v", w.URL, err)
+				failed = true
+				break
+			}
+			os.Remove(path)
+		}
+
+		// Schedule a retry with backoff, or reset backoff after success
+		retry.Stop()
+		if failed {
+			retry.Reset(retryDelay)
+			retryDelay = ircNextBackoff(retryDelay, maxDelay)
+			backingOff = true
+		} else {
+			retryDelay = baseDelay
+		}
+	}
+}
+
+// Queue incoming events for each interested webhook and start a delivery
+// worker per webhook. Events get written to each webhook's queue directory
+// (under queueDir) before delivery so nothing is lost across restarts or
+// while a webhook endpoint is down.
+func StartWebhooks(ctx context.Context, hooks []WebhookConfig,
+	queueDir string, in <-chan WebhookEvent) {
+
+	queues := make([]*webhookQueue, len(hooks))
+	notify := make([]chan struct{}, len(hooks))
+	for i := range hooks {
+		// Name queue directories by hash of URL so they survive reordering
+		sum := sha256.Sum256([]byte(hooks[i].URL))
+		dir := filepath.Join(queueDir, hex.EncodeToString(sum[:8]))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("ERROR: Creating webhook queue directory: %v", err)
+			continue
+		}
+		queues[i] = &webhookQueue{dir: dir}
+		notify[i] = make(chan struct{}, 1)
+		go webhookWorker(ctx, &hooks[i], queues[i], notify[i])
+	}
+
+	for event := range in {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("ERROR: Encoding webhook event: %v", err)
+			continue
+		}
+		for i := range hooks {
+			if queues[i] == nil || !hooks[i].wants(event.Type) {
+				continue
+			}
+			if err := queues[i].Push(body); err != nil {
+				log.Printf("ERROR: Queueing webhook event: %v", err)
+				continue
+			}
+			// Wake the worker without blocking if it is busy
+			select {
+			case notify[i] <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A webhook request as the test server got it
+type webhookRequest struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+	event  WebhookEvent
+}
+
+// Start a webhook endpoint that answers each request with the status from
+// `status` and hands the request to the test
+func newWebhookServer(t *testing.T, status func(WebhookEvent) int) (
+	*httptest.Server, <-chan webhookRequest) {
+
+	requests := make(chan webhookRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			req := webhookRequest{at: time.Now(), header: r.Header,
+				body: body}
+			json.Unmarshal(body, &req.event)
+			w.WriteHeader(status(req.event))
+			requests <- req
+		}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+// Wait for the next webhook request
+func waitWebhook(t *testing.T, requests <-chan webhookRequest) webhookRequest {
+	t.Helper()
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for webhook request")
+		return webhookRequest{}
+	}
+}
+
+// Run StartWebhooks with a short retry delay until the returned function
+// gets called
+func startTestWebhooks(t *testing.T, hooks []WebhookConfig,
+	queueDir string) (chan<- WebhookEvent, func()) {
+
+	t.Helper()
+	old := webhookRetryDelay
+	webhookRetryDelay = 20 * time.Millisecond
+	t.Cleanup(func() { webhookRetryDelay = old })
+	for i := range hooks {
+		if err := hooks[i].Prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := make(chan WebhookEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Go(func() { StartWebhooks(ctx, hooks, queueDir, in) })
+	stop := sync.OnceFunc(func() {
+		close(in)
+		cancel()
+		wg.Wait()
+	})
+	t.Cleanup(stop)
+	return in, stop
+}
+
+func TestWebhookSignature(t *testing.T) {
+	srv, requests := newWebhookServer(t,
+		func(WebhookEvent) int { return http.StatusOK })
+	in, _ := startTestWebhooks(t, []WebhookConfig{{URL: srv.URL,
+		Secret: "s3cret", Headers: map[string]string{"X-Room": "barn"}}},
+		t.TempDir())
+
+	in <- WebhookEvent{Type: webhookReport, Node: "2", TempF: 64}
+	req := waitWebhook(t, requests)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.header.Get("X-Hub-Signature-256"); got != want {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+	if req.header.Get("X-Room") != "barn" ||
+		req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("got headers %v", req.header)
+	}
+	if req.event.Node != "2" || req.event.TempF != 64 {
+		t.Errorf("got event %+v", req.event)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	// Node 1's event is bad, and node 2's fails a few times first
+	var mu sync.Mutex
+	failures := 3
+	srv, requests := newWebhookServer(t, func(e WebhookEvent) int {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case e.Node == "1":
+			return http.StatusBadRequest
+		case e.Node == "2" && failures > 0:
+			failures--
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	in, _ := startTestWebhooks(t, []WebhookConfig{{URL: srv.URL}},
+		t.TempDir())
+
+	in <- WebhookEvent{Type: webhookReport, Node: "1"}
+	in <- WebhookEvent{Type: webhookReport, Node: "2"}
+	in <- WebhookEvent{Type: webhookReport, Node: "3"}
+	if req := waitWebhook(t, requests); req.event.Node != "1" {
+		t.Fatalf("got node %s first, want 1", req.event.Node)
+	}
+	// The rejected event doesn't get retried, and the failing one holds up
+	// the ones after it, with each retry waiting longer than the last
+	var times []time.Time
+	for range 4 {
+		req := waitWebhook(t, requests)
+		if req.event.Node != "2" {
+			t.Fatalf("got node %s, want 2", req.event.Node)
+		}
+		times = append(times, req.at)
+	}
+	minGap := webhookRetryDelay
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < minGap {
+			t.Errorf("retry %d after %v, want at least %v", i, gap, minGap)
+		}
+		minGap = minGap * 3 / 2
+	}
+	if req := waitWebhook(t, requests); req.event.Node != "3" {
+		t.Errorf("got node %s last, want 3", req.event.Node)
+	}
+}
+
+func TestWebhookQueuePersists(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusServiceUnavailable
+	srv, requests := newWebhookServer(t, func(WebhookEvent) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return status
+	})
+	queueDir := t.TempDir()
+	hooks := []WebhookConfig{{URL: srv.URL}}
+
+	// Events that can't get delivered stay queued on disk
+	in, stop := startTestWebhooks(t, hooks, queueDir)
+	in <- WebhookEvent{Type: webhookReport, Node: "1"}
+	in <- WebhookEvent{Type: webhookReport, Node: "2"}
+	waitWebhook(t, requests)
+	stop()
+	for len(requests) > 0 {
+		<-requests
+	}
+
+	// After a restart, they get delivered in order
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	startTestWebhooks(t, hooks, queueDir)
+	for _, want := range []string{"1", "2"} {
+		if req := waitWebhook(t, requests); req.event.Node != want {
+			t.Errorf("got node %s, want %s", req.event.Node, want)
+		}
+	}
+}
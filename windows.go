@@ -0,0 +1,273 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the window that starts at local midnight in the display timezone
+const todayWindow = "today"
+
+// Default rolling windows, besides today and the history_hours window
+var defaultWindows = []string{"1h", "24h"}
+
+// A window of time that node statistics get kept for
+type historyWindow struct {
+	name string        // Name like "90m", "36h", "7d", or "today"
+	d    time.Duration // Length of a rolling window (0 for today)
+}
+
+// Get the name of a rolling window of length `d`: days for whole days from
+// 2 days up, or else hours or minutes
+func windowName(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d >= 2*day && d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	default:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+}
+
+// Parse a window like "90m", "36h", "7d", or "today". Different ways of
+// writing the same window (like "1d" and "24h") get the same name.
+func parseWindow(s string) (historyWindow, error) {
+	if s == todayWindow {
+		return historyWindow{name: todayWindow}, nil
+	}
+	var d time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d < time.Minute || d%time.Minute != 0 {
+		return historyWindow{}, fmt.Errorf("expected a window like 90m, "+
+			"36h, 7d, or today, got %q", s)
+	}
+	return historyWindow{name: windowName(d), d: d}, nil
+}
+
+// Get the windows to keep node statistics for: today, then the rolling
+// windows from shortest to longest (including the history_hours window)
+func (c *ServerConfig) HistoryWindows() []historyWindow {
+	if c.windows == nil {
+		// Not prepared, so use the defaults
+		c := ServerConfig{HistoryHours: c.HistoryHours}
+		c.prepareWindows()
+		return c.windows
+	}
+	return c.windows
+}
+
+// Parse the windows setting into c.windows and check summary_window
+func (c *ServerConfig) prepareWindows() error {
+	names := c.Windows
+	if names == nil {
+		names = defaultWindows
+	}
+	c.windows = []historyWindow{{name: todayWindow}}
+	history := windowName(c.HistoryWindow())
+	names = append([]string{history}, names...)
+	for _, name := range names {
+		w, err := parseWindow(name)
+		if err != nil {
+			return fmt.Errorf("windows: %v", err)
+		}
+		i := len(c.windows)
+		for i > 1 && c.windows[i-1].d > w.d {
+			i--
+		}
+		if c.windows[i-1].name != w.name {
+			c.windows = append(c.windows[:i],
+				append([]historyWindow{w}, c.windows[i:]...)...)
+		}
+	}
+	if c.SummaryWindow == "" {
+		c.SummaryWindow = history
+	}
+	w, ok := c.FindWindow(c.SummaryWindow)
+	if !ok {
+		return fmt.Errorf("summary_window: %q is not one of the windows",
+			c.SummaryWindow)
+	}
+	c.SummaryWindow = w.name
+	return nil
+}
+
+// Look up one of the configured windows by name, however it's written
+func (c *ServerConfig) FindWindow(name string) (historyWindow, bool) {
+	w, err := parseWindow(name)
+	if err != nil {
+		return historyWindow{}, false
+	}
+	for _, cw := range c.HistoryWindows() {
+		if cw.name == w.name {
+			return cw, true
+		}
+	}
+	return historyWindow{}, false
+}
+
+// Get how far back the in-memory report histories need to go to cover the
+// longest window (today's window can go back further, on a DST change day)
+func (c *ServerConfig) RetentionWindow() time.Duration {
+	longest := time.Duration(0)
+	for _, w := range c.HistoryWindows() {
+		longest = max(longest, w.d)
+	}
+	return longest
+}
+
+// Counts of temperatures rounded to whole degrees from tempHistMinF up, with
+// colder and hotter temperatures counted in the first and last bins
+const (
+	tempHistMinF = -60
+	tempHistBins = 221 // Up to 160°F
+)
+
+type tempHistogram [tempHistBins]int32
+
+func (t *tempHistogram) bin(tempF float64) int {
+	return max(0, min(tempHistBins-1, int(math.Round(tempF))-tempHistMinF))
+}
+
+// Rolling statistics over one window of a node's reports. These get updated
+// incrementally as reports enter and leave the window, so they take
+// amortized O(1) time per report.
+type WindowStats struct {
+	Name        string // Window name like "24h" or "today"
+	Count       int    // Number of reports in the window
+	MinTempF    float64
+	MaxTempF    float64
+	MeanTempF   float64
+	StdDevTempF float64
+
+	d          time.Duration // Length of the window (0 for today)
+	start      int           // Sequence number of the oldest report
+	minQ, maxQ []int         // Monotonic deques of report sequence numbers
+	shift      float64       // Temperature the sums are measured from
+	sum, sumSq float64       // Sums of differences from shift and squares
+	hist       tempHistogram // Temperature counts for percentiles
+	dayStart   time.Time     // Today's start and end, for the today window
+	dayEnd     time.Time
+}
+
+// Get the start of the window at time `now`
+func (w *WindowStats) cutoff(now time.Time) time.Time {
+	if w.d != 0 {
+		return now.Add(-w.d)
+	}
+	// Working out the day is slow-ish, so only do it when the day changes
+	if now.Before(w.dayStart) || !now.Before(w.dayEnd) {
+		w.dayStart = localDayStart(now)
+		w.dayEnd = w.dayStart.AddDate(0, 0, 1)
+	}
+	return w.dayStart
+}
+
+// Add the newest report of `h`, which has sequence number `seq`
+func (w *WindowStats) push(h *ReportHistory, seq int, tempF float64) {
+	// Later, colder reports make earlier, warmer ones irrelevant to the min
+	// (and the other way around for the max)
+	for len(w.minQ) > 0 && h.tempF(w.minQ[len(w.minQ)-1]) >= tempF {
+		w.minQ = w.minQ[:len(w.minQ)-1]
+	}
+	w.minQ = append(w.minQ, seq)
+	for len(w.maxQ) > 0 && h.tempF(w.maxQ[len(w.maxQ)-1]) <= tempF {
+		w.maxQ = w.maxQ[:len(w.maxQ)-1]
+	}
+	w.maxQ = append(w.maxQ, seq)
+
+	if w.start == seq {
+		// First report in an empty window, so measure from here
+		w.shift, w.sum, w.sumSq = tempF, 0, 0
+	}
+	dt := tempF - w.shift
+	w.sum += dt
+	w.sumSq += dt * dt
+	w.hist[w.hist.bin(tempF)]++
+}
+
+// Remove reports from the start of the window that are older than the
+// window at time `now`, or that come before sequence number `first` (the
+// oldest report `h` will keep). Then update the statistics.
+func (w *WindowStats) advance(h *ReportHistory, first int, now time.Time) {
+	cutoff := w.cutoff(now)
+	end := h.first + len(h.Reports)
+	for w.start < end && (w.start < first ||
+		h.Reports[w.start-h.first].Timestamp.Before(cutoff)) {
+
+		tempF := h.tempF(w.start)
+		dt := tempF - w.shift
+		w.sum -= dt
+		w.sumSq -= dt * dt
+		w.hist[w.hist.bin(tempF)]--
+		w.start++
+	}
+	for len(w.minQ) > 0 && w.minQ[0] < w.start {
+		w.minQ = w.minQ[1:]
+	}
+	for len(w.maxQ) > 0 && w.maxQ[0] < w.start {
+		w.maxQ = w.maxQ[1:]
+	}
+
+	w.Count = end - w.start
+	if w.Count == 0 {
+		w.MinTempF, w.MaxTempF, w.MeanTempF, w.StdDevTempF = 0, 0, 0, 0
+		return
+	}
+	w.MinTempF = h.tempF(w.minQ[0])
+	w.MaxTempF = h.tempF(w.maxQ[0])
+	if w.Count == 1 {
+		// Down to one report, so the sums can start over exactly
+		w.shift, w.sum, w.sumSq = w.MinTempF, 0, 0
+	}
+	// Measuring from a temperature in the window (rather than from 0)
+	// keeps the variance from getting lost in rounding errors
+	count := float64(w.Count)
+	mean := w.sum / count
+	w.MeanTempF = w.shift + mean
+	w.StdDevTempF = math.Sqrt(max(0, w.sumSq/count-mean*mean))
+}
+
+// Add up the sums from scratch, so rounding errors can't build up
+func (w *WindowStats) resum(h *ReportHistory) {
+	w.sum, w.sumSq = 0, 0
+	reports := h.Reports[w.start-h.first:]
+	if len(reports) > 0 {
+		w.shift = reports[0].TempF
+	}
+	for _, r := range reports {
+		dt := r.TempF - w.shift
+		w.sum += dt
+		w.sumSq += dt * dt
+	}
+}
+
+// Get the p-th percentile (0 to 100) of the temperatures in the window, to
+// the nearest degree (0 if there are no reports)
+func (w *WindowStats) PercentileTempF(p float64) float64 {
+	if w.Count == 0 {
+		return 0
+	}
+	rank := int(math.Round(max(0, min(100, p)) / 100 * float64(w.Count-1)))
+	seen := 0
+	for i, n := range w.hist {
+		seen += int(n)
+		if seen > rank {
+			return float64(i + tempHistMinF)
+		}
+	}
+	return float64(tempHistBins - 1 + tempHistMinF)
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright 2025 Sam Blenny
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"today", "today"},
+		{"90m", "90m"},
+		{"1h", "1h"},
+		{"60m", "1h"},
+		{"1d", "24h"},
+		{"36h", "36h"},
+		{"48h", "2d"},
+		{"7d", "7d"},
+		{"1h30m", "90m"},
+	}
+	for _, tt := range tests {
+		w, err := parseWindow(tt.in)
+		if err != nil || w.name != tt.want {
+			t.Errorf("parseWindow(%q) = %q, %v; want %q", tt.in, w.name, err,
+				tt.want)
+		}
+	}
+	for _, bad := range []string{"", "0h", "-1h", "30s", "1.5d", "xd",
+		"yesterday"} {
+		if _, err := parseWindow(bad); err == nil {
+			t.Errorf("parseWindow(%q) didn't fail", bad)
+		}
+	}
+}
+
+func TestConfigWindows(t *testing.T) {
+	names := func(c *ServerConfig) []string {
+		out := []string{}
+		for _, w := range c.HistoryWindows() {
+			out = append(out, w.name)
+		}
+		return out
+	}
+
+	// Defaults, plus the history_hours window
+	c := ServerConfig{}
+	if err := c.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"today", "1h", "24h", "36h"}
+	if got := names(&c); !slices.Equal(got, want) {
+		t.Errorf("default windows: got %v, want %v", got, want)
+	}
+	if c.SummaryWindow != "36h" || c.RetentionWindow() != 36*time.Hour {
+		t.Errorf("got summary window %q, retention %v", c.SummaryWindow,
+			c.RetentionWindow())
+	}
+
+	// Sorted, with duplicates left out
+	c = ServerConfig{HistoryHours: 24, SummaryWindow: "1d",
+		Windows: []string{"7d", "today", "1d", "90m", "168h"}}
+	if err := c.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"today", "90m", "24h", "7d"}
+	if got := names(&c); !slices.Equal(got, want) {
+		t.Errorf("got windows %v, want %v", got, want)
+	}
+	if c.SummaryWindow != "24h" || c.RetentionWindow() != 7*24*time.Hour {
+		t.Errorf("got summary window %q, retention %v", c.SummaryWindow,
+			c.RetentionWindow())
+	}
+
+	for _, bad := range []ServerConfig{
+		{Windows: []string{"soon"}},
+		{SummaryWindow: "7d"},
+		{IRC: []IRCTarget{{Server: "irc.test:6667", Nick: "hub",
+			Channels: []string{"#test"}, Window: "2h"}}},
+	} {
+		if err := bad.prepare(); err == nil {
+			t.Errorf("config with windows %q, summary_window %q, and IRC "+
+				"%v didn't fail", bad.Windows, bad.SummaryWindow, bad.IRC)
+		}
+	}
+}
+
+func TestIRCTargetFormatWindow(t *testing.T) {
+	useTestConfig(t, ServerConfig{Timezone: "UTC", IRC: []IRCTarget{{
+		Server:   "irc.test:6667",
+		Nick:     "hub",
+		Channels: []string{"#test"},
+		Mode:     ircModeMessage,
+		Window:   "1h",
+		Template: "{{.Window}} {{.MinTempF}}-{{.MaxTempF}} " +
+			"today {{.TodayMinTempF}} " +
+			"36h {{(index .Windows \"36h\").MinTempF}}",
+	}}})
+	now := mustTime(t, "2025-11-17T12:00:00Z")
+	useFakeClock(t, now)
+
+	histories := NodeHistories{"1": {}}
+	histories["1"].Add(now.Add(-20*time.Hour), 3.8, 40) // Yesterday
+	histories["1"].Add(now.Add(-2*time.Hour), 3.8, 50)
+	histories["1"].Add(now.Add(-30*time.Minute), 3.8, 60)
+	histories["1"].Add(now, 3.8, 65)
+
+	got, ok := cfg.IRC[0].Format(histories, "1")
+	if want := "1h 60-65 today 50 36h 40"; !ok || got != want {
+		t.Errorf("got %q, %v; want %q", got, ok, want)
+	}
+}